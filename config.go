@@ -0,0 +1,210 @@
+// sbc config.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/tnakagawa/sbc/spv"
+)
+
+// Config is sbc config type
+type Config struct {
+	Network  string   `json:"network"`
+	Peers    []string `json:"peers"`
+	MaxPeers int      `json:"maxpeers"`
+	SyncMode string   `json:"syncmode"`
+	Backend  string   `json:"backend"`
+	DataDir  string   `json:"datadir"`
+	// Birthday is the wallet birthday, height or date (2006-01-02 or RFC3339)
+	// it is stored in the wallet directory when the wallet is created
+	Birthday string `json:"birthday"`
+	// Checkpoints are "height:hash" strings
+	Checkpoints []string `json:"checkpoints"`
+	// Export and Import are the bootstrap file paths given by the command-line flags
+	Export string `json:"-"`
+	Import string `json:"-"`
+}
+
+// loadConfig loads config from the command-line flags and the config file
+// the command-line flags take precedence over the config file
+func loadConfig() (*Config, error) {
+	configFile := flag.String("config", "", "path to config file (json)")
+	network := flag.String("network", "", "network name (mainnet, testnet3, regtest, simnet, signet)")
+	connect := flag.String("connect", "", "comma separated peer addresses (host[:port])")
+	maxPeers := flag.Int("maxpeers", 0, "number of outbound peers")
+	syncMode := flag.String("syncmode", "", "block sync mode (block, bloom, cfilter)")
+	backend := flag.String("backend", "", "storage backend (sqlite, leveldb, memory, flat)")
+	dataDir := flag.String("datadir", "", "data directory (default $XDG_DATA_HOME/sbc)")
+	birthday := flag.String("birthday", "", "birthday of a new wallet (height, 2006-01-02 or RFC3339)")
+	checkpoints := flag.String("checkpoints", "", "comma separated trusted checkpoints (height:hash)")
+	exportFile := flag.String("exportheaders", "", "export the header chain to the bootstrap file and exit")
+	importFile := flag.String("importheaders", "", "import the header chain from the bootstrap file and exit")
+	flag.Parse()
+	config := &Config{}
+	config.Network = chaincfg.RegressionNetParams.Name
+	if *configFile != "" {
+		err := config.readFile(*configFile)
+		if err != nil {
+			log.Printf("config.readFile Error : %+v", err)
+			return nil, err
+		}
+	}
+	if *network != "" {
+		config.Network = *network
+	}
+	if *connect != "" {
+		config.Peers = strings.Split(*connect, ",")
+	}
+	if *maxPeers > 0 {
+		config.MaxPeers = *maxPeers
+	}
+	if *syncMode != "" {
+		config.SyncMode = *syncMode
+	}
+	if *backend != "" {
+		config.Backend = *backend
+	}
+	if *dataDir != "" {
+		config.DataDir = *dataDir
+	}
+	if *birthday != "" {
+		config.Birthday = *birthday
+	}
+	if *checkpoints != "" {
+		config.Checkpoints = strings.Split(*checkpoints, ",")
+	}
+	config.Export = *exportFile
+	config.Import = *importFile
+	return config, nil
+}
+
+func (config *Config) readFile(path string) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("config file not found : %s", path)
+		}
+		return err
+	}
+	return json.Unmarshal(bs, config)
+}
+
+// params returns chaincfg.Params of the network
+func (config *Config) params() (*chaincfg.Params, error) {
+	switch config.Network {
+	case chaincfg.MainNetParams.Name:
+		return &chaincfg.MainNetParams, nil
+	case chaincfg.TestNet3Params.Name:
+		return &chaincfg.TestNet3Params, nil
+	case chaincfg.RegressionNetParams.Name:
+		return &chaincfg.RegressionNetParams, nil
+	case chaincfg.SimNetParams.Name:
+		return &chaincfg.SimNetParams, nil
+	case chaincfg.SigNetParams.Name:
+		return &chaincfg.SigNetParams, nil
+	}
+	return nil, fmt.Errorf("unknown network : %s", config.Network)
+}
+
+// spvConfig returns spv.Config
+func (config *Config) spvConfig() (*spv.Config, error) {
+	spvConfig := spv.NewConfig()
+	for _, peer := range config.Peers {
+		spvConfig.Peers = append(spvConfig.Peers, strings.TrimSpace(peer))
+	}
+	if config.MaxPeers > 0 {
+		spvConfig.MaxPeers = config.MaxPeers
+	}
+	switch config.SyncMode {
+	case "", "block":
+		spvConfig.SyncMode = spv.SyncModeBlock
+	case "bloom":
+		spvConfig.SyncMode = spv.SyncModeBloom
+	case "cfilter":
+		spvConfig.SyncMode = spv.SyncModeCFilter
+	default:
+		return nil, fmt.Errorf("unknown sync mode : %s", config.SyncMode)
+	}
+	switch config.Backend {
+	case "", "sqlite":
+		spvConfig.Backend = spv.BackendSQLite
+	case "leveldb":
+		spvConfig.Backend = spv.BackendLevelDB
+	case "memory":
+		spvConfig.Backend = spv.BackendMemory
+	case "flat":
+		spvConfig.Backend = spv.BackendFlat
+	default:
+		return nil, fmt.Errorf("unknown backend : %s", config.Backend)
+	}
+	for _, str := range config.Checkpoints {
+		checkpoint, err := parseCheckpoint(strings.TrimSpace(str))
+		if err != nil {
+			return nil, err
+		}
+		spvConfig.Checkpoints = append(spvConfig.Checkpoints, *checkpoint)
+	}
+	spvConfig.DataDir = config.DataDir
+	return spvConfig, nil
+}
+
+// walletDir returns the wallet directory of the network
+func (config *Config) walletDir(network string) string {
+	dataDir := config.DataDir
+	if dataDir == "" {
+		dataDir = spv.DefaultDataDir()
+	}
+	return filepath.Join(spv.NetworkDir(dataDir, network), "wallet")
+}
+
+// birthday returns the wallet birthday, if it is empty, it returns zero birthday
+func (config *Config) birthday() (spv.Birthday, error) {
+	birthday := spv.Birthday{}
+	if config.Birthday == "" {
+		return birthday, nil
+	}
+	height, err := strconv.Atoi(config.Birthday)
+	if err == nil {
+		birthday.Height = height
+		return birthday, nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		t, err := time.Parse(layout, config.Birthday)
+		if err == nil {
+			birthday.Time = t
+			return birthday, nil
+		}
+	}
+	return birthday, fmt.Errorf("invalid birthday : %s", config.Birthday)
+}
+
+// parseCheckpoint parses "height:hash"
+func parseCheckpoint(str string) (*chaincfg.Checkpoint, error) {
+	items := strings.Split(str, ":")
+	if len(items) != 2 {
+		return nil, fmt.Errorf("invalid checkpoint : %s", str)
+	}
+	height, err := strconv.ParseInt(items[0], 10, 32)
+	if err != nil || height < 0 {
+		return nil, fmt.Errorf("invalid checkpoint height : %s", str)
+	}
+	hash, err := chainhash.NewHashFromStr(items[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint hash : %s", str)
+	}
+	checkpoint := &chaincfg.Checkpoint{}
+	checkpoint.Height = int32(height)
+	checkpoint.Hash = hash
+	return checkpoint, nil
+}
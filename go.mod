@@ -0,0 +1,11 @@
+module github.com/tnakagawa/sbc
+
+go 1.16
+
+require (
+	github.com/btcsuite/btcd v0.22.1
+	github.com/btcsuite/btcd/chaincfg/chainhash v1.0.1
+	github.com/btcsuite/btcutil v1.0.3-0.20201208143702-a53e38424cce
+	github.com/btcsuite/goleveldb v1.0.0
+	github.com/mattn/go-sqlite3 v1.14.6
+)
@@ -3,7 +3,9 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"log"
 	"os"
 	"strings"
 
@@ -12,12 +14,65 @@ import (
 )
 
 func main() {
-	spv := spv.NewSpv()
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("loadConfig Error : %+v", err)
+	}
+	params, err := config.params()
+	if err != nil {
+		log.Fatalf("config.params Error : %+v", err)
+	}
+	spvConfig, err := config.spvConfig()
+	if err != nil {
+		log.Fatalf("config.spvConfig Error : %+v", err)
+	}
 	wallet := wallet.NewWallet()
-	spv.AddCheckTxIn(wallet.CheckTxIn)
-	spv.AddCheckTxOut(wallet.CheckTxOut)
-	spv.Start()
+	if wallet == nil {
+		log.Fatalf("wallet.NewWallet Error")
+	}
+	birthday, err := config.birthday()
+	if err != nil {
+		log.Fatalf("config.birthday Error : %+v", err)
+	}
+	err = wallet.LoadBirthday(config.walletDir(params.Name), birthday)
+	if err != nil {
+		log.Fatalf("wallet.LoadBirthday Error : %+v", err)
+	}
+	spvConfig.Birthday = wallet.Birthday()
+	spv, err := spv.NewSpv(*params, spvConfig)
+	if err != nil {
+		log.Fatalf("spv.NewSpv Error : %+v", err)
+	}
+	if config.Export != "" || config.Import != "" {
+		err = bootstrap(spv, config)
+		spv.Stop()
+		if err != nil {
+			log.Fatalf("bootstrap Error : %+v", err)
+		}
+		return
+	}
+	spv.AddCheckTx(wallet.CheckTx, wallet.TxFilter())
+	spv.AddNotifyBlockDisconnected(wallet.BlockDisconnected)
+	spv.AddNotifyFork(wallet.NotifyFork)
+	spv.AddNotifyRemoveTx(wallet.RemoveTx)
+	sub := spv.Subscribe()
+	defer sub.Close()
+	go func() {
+		for event := range sub.Events() {
+			log.Printf("event : %T %+v", event, event)
+		}
+	}()
+	err = spv.Start(context.Background())
+	if err != nil {
+		log.Fatalf("spv.Start Error : %+v", err)
+	}
 	defer spv.Stop()
+	go func() {
+		err := spv.Wait()
+		if err != nil {
+			log.Fatalf("spv.Wait Error : %+v", err)
+		}
+	}()
 	scanner := bufio.NewScanner(os.Stdin)
 	fmt.Print("$ ")
 	for scanner.Scan() {
@@ -33,3 +88,31 @@ func main() {
 	}
 	fmt.Println("bye!")
 }
+
+// bootstrap exports or imports the header chain
+func bootstrap(spv *spv.Spv, config *Config) error {
+	if config.Export != "" {
+		file, err := os.Create(config.Export)
+		if err != nil {
+			return err
+		}
+		n, err := spv.ExportHeaders(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		fmt.Printf("exported %d headers to %s\n", n, config.Export)
+		return file.Close()
+	}
+	file, err := os.Open(config.Import)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	n, err := spv.ImportHeaders(file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d headers from %s\n", n, config.Import)
+	return nil
+}
@@ -0,0 +1,137 @@
+// Package spv project addrmgr.go
+package spv
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// address manager settings
+const (
+	AddrRetryInterval = 10 * time.Minute
+	AddrCandidates    = 20
+	AddrMaxAddrs      = 2500
+)
+
+// Resolver resolves host name to addresses
+type Resolver interface {
+	LookupHost(host string) ([]string, error)
+}
+
+// netResolver is Resolver using net.LookupHost
+type netResolver struct{}
+
+func (resolver *netResolver) LookupHost(host string) ([]string, error) {
+	return net.LookupHost(host)
+}
+
+// AddrManager is address book type
+type AddrManager struct {
+	data     Store
+	params   chaincfg.Params
+	resolver Resolver
+}
+
+// NewAddrManager returns a new AddrManager
+// if resolver is nil, net.LookupHost is used
+func NewAddrManager(data Store, params chaincfg.Params, resolver Resolver) *AddrManager {
+	if resolver == nil {
+		resolver = &netResolver{}
+	}
+	addrMgr := &AddrManager{}
+	addrMgr.data = data
+	addrMgr.params = params
+	addrMgr.resolver = resolver
+	return addrMgr
+}
+
+// AddAddrs adds addresses received from the peer
+// the addresses without SFNodeNetwork are ignored, and the address book is trimmed to AddrMaxAddrs
+// addrv2 (BIP155) is not supported, btcd v0.21 cannot parse it and the advertised protocol version (70013)
+// is lower than 70016, so peers do not send sendaddrv2 and addrv2
+func (addrMgr *AddrManager) AddAddrs(addrs []*wire.NetAddress) {
+	for _, na := range addrs {
+		if na.IP == nil || na.IP.IsUnspecified() || na.Port == 0 {
+			continue
+		}
+		if na.Services&wire.SFNodeNetwork == 0 {
+			continue
+		}
+		addr := net.JoinHostPort(na.IP.String(), strconv.Itoa(int(na.Port)))
+		err := addrMgr.data.PutAddr(addr, uint64(na.Services), na.Timestamp.Unix())
+		if err != nil {
+			log.Printf("addrMgr.data.PutAddr Error : %+v", err)
+			return
+		}
+	}
+	err := addrMgr.data.TrimAddrs(AddrMaxAddrs)
+	if err != nil {
+		log.Printf("addrMgr.data.TrimAddrs Error : %+v", err)
+	}
+}
+
+// Good marks the address as connected
+func (addrMgr *AddrManager) Good(addr string) {
+	err := addrMgr.data.MarkAddr(addr, true, time.Now().Unix())
+	if err != nil {
+		log.Printf("addrMgr.data.MarkAddr Error : %+v", err)
+	}
+}
+
+// Bad marks the address as failed
+func (addrMgr *AddrManager) Bad(addr string) {
+	err := addrMgr.data.MarkAddr(addr, false, time.Now().Unix())
+	if err != nil {
+		log.Printf("addrMgr.data.MarkAddr Error : %+v", err)
+	}
+}
+
+// Candidates returns addresses to connect ordered by score
+// addresses attempted within AddrRetryInterval are excluded
+func (addrMgr *AddrManager) Candidates() ([]string, error) {
+	cnt, err := addrMgr.data.CountAddrs()
+	if err != nil {
+		log.Printf("addrMgr.data.CountAddrs Error : %+v", err)
+		return nil, err
+	}
+	if cnt == 0 {
+		addrMgr.resolveSeeds()
+	}
+	lastAttempt := time.Now().Add(-AddrRetryInterval).Unix()
+	infos, err := addrMgr.data.ListAddrs(lastAttempt, AddrCandidates)
+	if err != nil {
+		log.Printf("addrMgr.data.ListAddrs Error : %+v", err)
+		return nil, err
+	}
+	var addrs []string
+	for _, info := range infos {
+		addrs = append(addrs, info.Addr)
+	}
+	return addrs, nil
+}
+
+// resolveSeeds resolves DNS seeds and adds the addresses
+func (addrMgr *AddrManager) resolveSeeds() {
+	now := time.Now()
+	for _, seed := range addrMgr.params.DNSSeeds {
+		ips, err := addrMgr.resolver.LookupHost(seed.Host)
+		if err != nil {
+			log.Printf("addrMgr.resolver.LookupHost Error : %s %+v", seed.Host, err)
+			continue
+		}
+		log.Printf("DNS seed %s : %d addresses", seed.Host, len(ips))
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip, addrMgr.params.DefaultPort)
+			err := addrMgr.data.PutAddr(addr, uint64(wire.SFNodeNetwork), now.Unix())
+			if err != nil {
+				log.Printf("addrMgr.data.PutAddr Error : %+v", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Package spv project birthday.go
+package spv
+
+import (
+	"log"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Birthday is the wallet birthday
+// the blocks before the birthday are not scanned, the headers are still synced from the checkpoint
+// if Height is positive, it is the first scanned block,
+// otherwise the first block whose timestamp is after Time minus MaxTimeOffsetSeconds is the first scanned block
+type Birthday struct {
+	Time   time.Time
+	Height int
+}
+
+// IsZero returns whether the birthday is not set
+func (birthday Birthday) IsZero() bool {
+	return birthday.Height <= 0 && birthday.Time.IsZero()
+}
+
+// skipToBirthday advances the check height to the birthday block
+// while the birthday block is not found in the headers, the blocks to the header tip are skipped
+// it returns false if the headers cannot be read
+func (spv *Spv) skipToBirthday() bool {
+	if spv.birthdayHeight == 0 {
+		return true
+	}
+	_, _, max, err := spv.data.GetCntMinMaxHeight()
+	if err != nil {
+		log.Printf("spv.data.GetCntMinMaxHeight Error : %+v", err)
+		return false
+	}
+	if spv.birthdayHeight < 0 {
+		err = spv.findBirthdayHeight(max)
+		if err != nil {
+			log.Printf("spv.findBirthdayHeight Error : %+v", err)
+			return false
+		}
+	}
+	height := spv.birthdayHeight
+	if height < 0 || height > max+1 {
+		height = max + 1
+	}
+	if spv.checkHeight >= height {
+		return true
+	}
+	log.Printf("skip blocks before birthday : %d -> %d", spv.checkHeight, height)
+	spv.checkHeight = height
+	err = spv.data.PutInt(KeyCheckHeight, spv.checkHeight)
+	if err != nil {
+		log.Printf("spv.data.PutInt Error : %+v", err)
+		return false
+	}
+	return true
+}
+
+// findBirthdayHeight finds the first block after the birthday time from the check height to the max height
+func (spv *Spv) findBirthdayHeight(max int) error {
+	birthday := spv.birthday.Time.Add(-time.Second * MaxTimeOffsetSeconds)
+	for height := spv.checkHeight; height <= max; height += wire.MaxBlockHeadersPerMsg {
+		headers, first, err := spv.data.GetHeadersByHeight(height, height+wire.MaxBlockHeadersPerMsg-1)
+		if err != nil {
+			return err
+		}
+		for i, header := range headers {
+			if !header.Timestamp.Before(birthday) {
+				spv.birthdayHeight = first + i
+				log.Printf("birthday height : %d", spv.birthdayHeight)
+				return nil
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Package spv project birthday_test.go
+package spv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// birthdayTime is the timestamp of the header at height 0 in the birthday tests, the headers are mined every hour
+var birthdayTime = time.Unix(1577836800, 0)
+
+// birthdayHeaders returns the headers from the height to the height+count-1 with the synthetic timestamps
+func birthdayHeaders(prev chainhash.Hash, height, count int) []*wire.BlockHeader {
+	headers := testHeaders(prev, count, uint32(height))
+	for i, header := range headers {
+		header.Timestamp = birthdayTime.Add(time.Duration(height+i) * time.Hour)
+		if i > 0 {
+			header.PrevBlock = headers[i-1].BlockHash()
+		}
+	}
+	return headers
+}
+
+// newBirthdayTest returns spv with the headers from height 10 to 30 and the check height 10
+func newBirthdayTest(t *testing.T, birthday Birthday) *Spv {
+	config := NewConfig()
+	config.Birthday = birthday
+	spv := newTestSpv(t, config)
+	putTestHeaders(t, spv, birthdayHeaders(chainhash.Hash{}, 10, 21), 10)
+	spv.checkHeight = 10
+	return spv
+}
+
+func TestSkipToBirthday(t *testing.T) {
+	offset := time.Second * MaxTimeOffsetSeconds
+	cases := []struct {
+		name     string
+		birthday Birthday
+		check    int
+		want     int
+	}{
+		{"none", Birthday{}, 10, 10},
+		{"time", Birthday{Time: birthdayTime.Add(20*time.Hour + offset)}, 10, 20},
+		{"after the header", Birthday{Time: birthdayTime.Add(20*time.Hour + offset + time.Second)}, 10, 21},
+		{"before the first header", Birthday{Time: birthdayTime}, 10, 10},
+		{"after the tip", Birthday{Time: birthdayTime.Add(100 * time.Hour)}, 10, 31},
+		{"checked", Birthday{Time: birthdayTime.Add(20*time.Hour + offset)}, 26, 26},
+		{"height", Birthday{Height: 25}, 10, 25},
+		{"height after the tip", Birthday{Height: 50}, 10, 31},
+		{"height before the check height", Birthday{Height: 25}, 28, 28},
+	}
+	for _, c := range cases {
+		spv := newBirthdayTest(t, c.birthday)
+		spv.checkHeight = c.check
+		if !spv.skipToBirthday() {
+			t.Errorf("%s : spv.skipToBirthday failed", c.name)
+			continue
+		}
+		if spv.checkHeight != c.want {
+			t.Errorf("%s : unmatch check height : %d %d", c.name, spv.checkHeight, c.want)
+		}
+		stored, err := spv.data.GetInt(KeyCheckHeight, -1)
+		if err != nil {
+			t.Fatalf("spv.data.GetInt Error : %+v", err)
+		}
+		if c.check != c.want && stored != c.want {
+			t.Errorf("%s : check height is not stored : %d", c.name, stored)
+		}
+	}
+}
+
+func TestFindBirthdayHeightLater(t *testing.T) {
+	spv := newBirthdayTest(t, Birthday{Time: birthdayTime.Add(100 * time.Hour)})
+	if !spv.skipToBirthday() || spv.checkHeight != 31 || spv.birthdayHeight >= 0 {
+		t.Fatalf("blocks to the tip are not skipped : %d %d", spv.checkHeight, spv.birthdayHeight)
+	}
+	// the birthday block is found in the headers synced later, over a getheaders batch
+	tip, _, err := spv.data.GetTip()
+	if err != nil {
+		t.Fatalf("spv.data.GetTip Error : %+v", err)
+	}
+	putTestHeaders(t, spv, birthdayHeaders(tip.BlockHash(), 31, wire.MaxBlockHeadersPerMsg+10), 31)
+	if !spv.skipToBirthday() {
+		t.Fatalf("spv.skipToBirthday failed")
+	}
+	want := 100 - MaxTimeOffsetSeconds/3600
+	if spv.birthdayHeight != want || spv.checkHeight != want {
+		t.Fatalf("unmatch birthday height : %d %d %d", spv.birthdayHeight, spv.checkHeight, want)
+	}
+	// the search starts from the check height
+	spv.birthdayHeight = -1
+	spv.checkHeight = 31 + wire.MaxBlockHeadersPerMsg
+	err = spv.findBirthdayHeight(31 + wire.MaxBlockHeadersPerMsg + 9)
+	if err != nil || spv.birthdayHeight != 31+wire.MaxBlockHeadersPerMsg {
+		t.Fatalf("unmatch birthday height : %d %+v", spv.birthdayHeight, err)
+	}
+}
@@ -2,12 +2,83 @@
 package spv
 
 import (
+	"bytes"
+	"fmt"
 	"log"
+	"time"
 
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
 )
 
+// BlockTxsDepth is the number of the recent blocks whose relevant transactions are kept to undo them by reorg
+const BlockTxsDepth = 100
+
+// SyncRequestTimeout is the time to wait for the response of the block, merkle block or filter request
+const SyncRequestTimeout = 30 * time.Second
+
+// syncRequest is the in-flight request of the block, merkle block or filter at the check height
+type syncRequest struct {
+	command string
+	height  int
+	peer    *Peer
+	time    time.Time
+}
+
+// setRequest records the request sent to the peer
+func (spv *Spv) setRequest(command string, peer *Peer) {
+	req := &syncRequest{}
+	req.command = command
+	req.height = spv.checkHeight
+	req.peer = peer
+	req.time = time.Now()
+	spv.request = req
+}
+
+// checkRequest re-requests the stalled request at the check height from another peer
+func (spv *Spv) checkRequest() {
+	req := spv.request
+	if req == nil {
+		return
+	}
+	if !req.peer.isClosed() && time.Since(req.time) < SyncRequestTimeout {
+		return
+	}
+	log.Printf("%s request timeout : %d %s", req.command, req.height, req.peer.addr)
+	spv.request = nil
+	spv.merkleBlock = nil
+	if req.height != spv.checkHeight {
+		return
+	}
+	header, _, err := spv.data.GetHeaderByHeight(spv.checkHeight)
+	if err != nil || header == nil {
+		log.Printf("spv.data.GetHeaderByHeight Error : %d %+v", spv.checkHeight, err)
+		spv.errBlock = true
+		return
+	}
+	if spv.syncMode == SyncModeCFilter {
+		except := req.peer
+		if spv.cfCheck != nil && spv.cfCheck.stalled() != nil {
+			except = spv.cfCheck.stalled()
+		}
+		spv.updateCFilter(header, except)
+		return
+	}
+	hash := header.BlockHash()
+	spv.requestBlock(&hash, req.peer)
+}
+
+// updateBlock requests the block at the check height, or the blocks in the window in SyncModeBlock
+// in SyncModeBloom and SyncModeCFilter, one block is requested per round trip,
+// because the transactions follow the merkle block and the filter is checked at the check height only
 func (spv *Spv) updateBlock() {
+	spv.request = nil
+	if !spv.skipToBirthday() {
+		spv.errBlock = true
+		return
+	}
 	header, _, err := spv.data.GetHeaderByHeight(spv.checkHeight)
 	if err != nil {
 		log.Printf("spv.data.GetHeaderByHeight Error : %+v", err)
@@ -21,16 +92,106 @@ func (spv *Spv) updateBlock() {
 			spv.errBlock = true
 			return
 		}
+		spv.checkSynced()
+		return
+	}
+	if spv.syncMode == SyncModeCFilter {
+		spv.updateCFilter(header, nil)
+		return
+	}
+	if spv.syncMode == SyncModeBlock {
+		spv.fillDownloads()
 		return
 	}
 	hash := header.BlockHash()
+	spv.requestBlock(&hash, nil)
+}
+
+// checkSynced emits SyncedToTip when all blocks to the header tip are processed
+// and no peer has a higher best height
+func (spv *Spv) checkSynced() {
+	if spv.synced {
+		return
+	}
+	height := spv.checkHeight - 1
+	peer := spv.bestPeer()
+	if peer == nil || int(peer.BestHeight()) > height {
+		return
+	}
+	spv.synced = true
+	log.Printf("synced to tip : %d", height)
+	spv.publish(SyncedToTip{Height: height})
+}
+
+// headerTipChanged emits HeaderTipChanged
+func (spv *Spv) headerTipChanged(hash chainhash.Hash, height int) {
+	spv.synced = false
+	spv.publish(HeaderTipChanged{Hash: hash, Height: height})
+}
+
+// requestBlock sends getdata of the block to the best peer except the peer
+func (spv *Spv) requestBlock(hash *chainhash.Hash, except *Peer) {
+	peer := spv.bestPeerExcept(except)
+	if peer == nil {
+		log.Printf("no peer to request block %v", hash)
+		spv.errBlock = true
+		return
+	}
 	msg := wire.NewMsgGetData()
-	inv := wire.NewInvVect(wire.InvTypeBlock, &hash)
+	inv := wire.NewInvVect(spv.blockInvType(peer), hash)
 	msg.AddInvVect(inv)
-	spv.sendMsg(msg)
+	peer.sendMsg(msg)
+	spv.setRequest("block", peer)
+}
+
+// blockInvType returns the inventory type to request the block from the peer
+func (spv *Spv) blockInvType(peer *Peer) wire.InvType {
+	if spv.syncMode == SyncModeBloom {
+		return wire.InvTypeFilteredBlock
+	}
+	if peer.hasService(wire.SFNodeWitness) {
+		return wire.InvTypeWitnessBlock
+	}
+	return wire.InvTypeBlock
+}
+
+// checkBlock checks the block sanity, the merkle root and the witness commitment
+// it returns the merkle tree store of the transactions
+func (spv *Spv) checkBlock(peer *Peer, block *wire.MsgBlock, header *wire.BlockHeader) ([]*chainhash.Hash, error) {
+	if len(block.Transactions) == 0 {
+		return nil, fmt.Errorf("block has no transactions")
+	}
+	if !blockchain.IsCoinBaseTx(block.Transactions[0]) {
+		return nil, fmt.Errorf("first transaction is not coinbase")
+	}
+	txids := make(map[chainhash.Hash]bool)
+	for i, tx := range block.Transactions {
+		if i > 0 && blockchain.IsCoinBaseTx(tx) {
+			return nil, fmt.Errorf("multiple coinbase transactions : %d", i)
+		}
+		txid := tx.TxHash()
+		if txids[txid] {
+			return nil, fmt.Errorf("duplicate transaction : %v", txid)
+		}
+		txids[txid] = true
+	}
+	blk := btcutil.NewBlock(block)
+	merkles := blockchain.BuildMerkleTreeStore(blk.Transactions(), false)
+	root := merkles[len(merkles)-1]
+	if !header.MerkleRoot.IsEqual(root) {
+		return nil, fmt.Errorf("unmatch merkle root : %v %v", header.MerkleRoot, root)
+	}
+	// the witness commitment can be checked only if the block is requested with witness
+	if peer.hasService(wire.SFNodeWitness) {
+		err := blockchain.ValidateWitnessCommitment(blk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return merkles, nil
 }
 
-func (spv *Spv) recvBlock(block *wire.MsgBlock) {
+func (spv *Spv) recvBlock(peer *Peer, block *wire.MsgBlock) {
 	header, height, err := spv.data.GetHeaderByHash(block.BlockHash())
 	if err != nil {
 		log.Printf("spv.data.GetHeaderByHash Error : %+v", err)
@@ -45,32 +206,125 @@ func (spv *Spv) recvBlock(block *wire.MsgBlock) {
 			spv.errBlock = true
 			return
 		}
-		err := spv.data.PutHeaders([]*wire.BlockHeader{&block.Header}, height)
+		_, err := spv.checkBlock(peer, block, &block.Header)
+		if err != nil {
+			log.Printf("spv.checkBlock Error : %+v", err)
+			peer.penalize(PeerBanScore, "invalid block")
+			spv.errHeaders = true
+			return
+		}
+		err = spv.data.PutHeaders([]*wire.BlockHeader{&block.Header}, height)
 		if err != nil {
 			log.Printf("spv.data.PutHeaders Error : %+v", err)
 			spv.errHeaders = true
 			return
 		}
+		spv.headerTipChanged(blockHash, height)
 		spv.updateHeaders()
 		return
 	}
+	if spv.recvBlockCheck(peer, block, header, height) {
+		return
+	}
+	if spv.syncMode == SyncModeBlock {
+		spv.recvDownloadedBlock(peer, block, header, height)
+		return
+	}
 	if height != spv.checkHeight {
 		log.Printf("unmatch height : %d %d", height, spv.checkHeight)
 		spv.errBlock = true
 		return
 	}
-	for _, tx := range block.Transactions {
-		for _, txin := range tx.TxIn {
-			for _, checkTxIn := range spv.checkTxIns {
-				checkTxIn(txin)
-			}
-		}
-		for idx, txout := range tx.TxOut {
-			for _, checkTxOut := range spv.checkTxOuts {
-				checkTxOut(height, tx.TxHash(), idx, txout)
-			}
+	merkles, err := spv.checkBlock(peer, block, header)
+	if err != nil {
+		log.Printf("spv.checkBlock Error : %+v", err)
+		peer.penalize(PeerBanScore, "invalid block")
+		hash := block.BlockHash()
+		spv.requestBlock(&hash, peer)
+		return
+	}
+	spv.processTxs(height, blockTxInfos(block, height, merkles))
+}
+
+// processTxs calls the callbacks with the transactions in the block and updates the block
+func (spv *Spv) processTxs(height int, infos []*TxInfo) {
+	spv.deliverTxs(height, infos)
+	spv.updateBlock()
+}
+
+// deliverTxs calls the callbacks with the transactions in the block and increments the check height
+func (spv *Spv) deliverTxs(height int, infos []*TxInfo) {
+	var txs []*wire.MsgTx
+	for _, info := range infos {
+		txs = append(txs, info.Tx)
+	}
+	spv.confirmMempoolTxs(txs)
+	spv.confirmTxs(txs)
+	var relevant []*wire.MsgTx
+	for _, info := range infos {
+		if spv.isRelevantTx(info.Tx) || spv.getTxStatus(info.Hash) >= 0 {
+			relevant = append(relevant, info.Tx)
 		}
+		spv.callCheckTx(info)
+	}
+	err := spv.putBlockTxs(height, relevant)
+	if err != nil {
+		log.Printf("spv.putBlockTxs Error : %+v", err)
 	}
+	spv.callBlockConnected(height, txs)
 	spv.checkHeight++
-	spv.updateBlock()
+	spv.publish(BlockProcessed{Height: height})
+}
+
+// blockTxsKey returns the key of the relevant transactions in the block at the height
+func blockTxsKey(height int) string {
+	return fmt.Sprintf("%s%d", KeyBlockTxs, height)
+}
+
+// putBlockTxs stores the relevant transactions in the block at the height
+// and removes the transactions of the block BlockTxsDepth before
+func (spv *Spv) putBlockTxs(height int, txs []*wire.MsgTx) error {
+	err := spv.data.Del(blockTxsKey(height - BlockTxsDepth))
+	if err != nil {
+		return err
+	}
+	if len(txs) == 0 {
+		return spv.data.Del(blockTxsKey(height))
+	}
+	buf := &bytes.Buffer{}
+	err = wire.WriteVarInt(buf, 0, uint64(len(txs)))
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		err = tx.Serialize(buf)
+		if err != nil {
+			return err
+		}
+	}
+	return spv.data.Put(blockTxsKey(height), buf.Bytes())
+}
+
+// getBlockTxs returns the relevant transactions in the block at the height
+// if the block is older than BlockTxsDepth, it returns nil
+func (spv *Spv) getBlockTxs(height int) ([]*wire.MsgTx, error) {
+	bs, err := spv.data.Get(blockTxsKey(height))
+	if err != nil || bs == nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(bs)
+	cnt, err := wire.ReadVarInt(reader, 0)
+	if err != nil {
+		return nil, err
+	}
+	var txs []*wire.MsgTx
+	for i := uint64(0); i < cnt; i++ {
+		tx := &wire.MsgTx{}
+		err = tx.Deserialize(reader)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
 }
@@ -0,0 +1,265 @@
+// Package spv project bloom.go
+package spv
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/bloom"
+)
+
+// bloom filter settings
+const (
+	BloomFilterElements = 1000
+	BloomFilterFPRate   = 0.0001
+)
+
+// merkleBlock is the merkle block waiting for the matched transactions
+type merkleBlock struct {
+	height    int
+	blockHash chainhash.Hash
+	hashes    []*chainhash.Hash
+	indexes   []int
+	proofs    [][]chainhash.Hash
+	txs       map[chainhash.Hash]*wire.MsgTx
+	pending   int
+}
+
+// partialMerkleTree is BIP37 partial merkle tree
+type partialMerkleTree struct {
+	numTx      uint32
+	hashes     []*chainhash.Hash
+	flags      []byte
+	bitPos     int
+	hashPos    int
+	matched    []*chainhash.Hash
+	matchedPos []uint32
+	height     uint32
+	nodes      map[[2]uint32]*chainhash.Hash
+}
+
+func newBloomFilter() *bloom.Filter {
+	return bloom.NewFilter(BloomFilterElements, rand.Uint32(), BloomFilterFPRate, wire.BloomUpdateAll)
+}
+
+// AddFilterData adds data (e.g. publickey hash) to the bloom filter
+func (spv *Spv) AddFilterData(data []byte) {
+	if spv.filter == nil {
+		return
+	}
+	spv.filter.Add(data)
+	spv.broadcastFilterMsg(wire.NewMsgFilterAdd(data))
+}
+
+// AddFilterOutPoint adds outpoint to the bloom filter to detect the spending transaction
+func (spv *Spv) AddFilterOutPoint(outpoint *wire.OutPoint) {
+	if spv.filter == nil {
+		return
+	}
+	spv.filter.AddOutPoint(outpoint)
+	spv.broadcastFilterMsg(spv.filter.MsgFilterLoad())
+}
+
+func (spv *Spv) broadcastFilterMsg(msg wire.Message) {
+	for _, peer := range spv.Peers() {
+		if peer.IsReady() && peer.hasService(wire.SFNodeBloom) {
+			peer.sendMsg(msg)
+		}
+	}
+}
+
+// loadFilter sends filterload to the peer
+func (spv *Spv) loadFilter(peer *Peer) {
+	if spv.filter == nil {
+		return
+	}
+	if !peer.hasService(wire.SFNodeBloom) {
+		log.Printf("peer %s does not support bloom filter", peer.addr)
+		return
+	}
+	peer.sendMsg(spv.filter.MsgFilterLoad())
+}
+
+func (spv *Spv) recvMerkleBlock(peer *Peer, msg *wire.MsgMerkleBlock) {
+	hash := msg.Header.BlockHash()
+	header, height, err := spv.data.GetHeaderByHash(hash)
+	if err != nil {
+		log.Printf("spv.data.GetHeaderByHash Error : %+v", err)
+		spv.errBlock = true
+		return
+	}
+	if header == nil {
+		log.Printf("Not found header : %v", hash)
+		spv.errBlock = true
+		return
+	}
+	if height != spv.checkHeight {
+		log.Printf("unmatch height : %d %d", height, spv.checkHeight)
+		spv.errBlock = true
+		return
+	}
+	tree := &partialMerkleTree{}
+	tree.numTx = msg.Transactions
+	tree.hashes = msg.Hashes
+	tree.flags = msg.Flags
+	root, err := tree.extractMatches()
+	if err != nil {
+		log.Printf("tree.extractMatches Error : %+v", err)
+		peer.penalize(PeerBanScore, "invalid merkle block")
+		spv.errBlock = true
+		return
+	}
+	if !root.IsEqual(&header.MerkleRoot) {
+		log.Printf("unmatch merkle root : %v %v", root, header.MerkleRoot)
+		peer.penalize(PeerBanScore, "invalid merkle root")
+		spv.errBlock = true
+		return
+	}
+	mb := &merkleBlock{}
+	mb.height = height
+	mb.blockHash = hash
+	mb.hashes = tree.matched
+	for _, pos := range tree.matchedPos {
+		mb.indexes = append(mb.indexes, int(pos))
+		mb.proofs = append(mb.proofs, tree.merkleBranch(pos))
+	}
+	mb.txs = make(map[chainhash.Hash]*wire.MsgTx)
+	mb.pending = len(tree.matched)
+	spv.merkleBlock = mb
+	if mb.pending == 0 {
+		spv.merkleBlock = nil
+		spv.processTxs(height, nil)
+	}
+}
+
+// recvMerkleTx receives the transaction matched in the merkle block
+// it returns false if the transaction is not waited
+func (spv *Spv) recvMerkleTx(tx *wire.MsgTx) bool {
+	mb := spv.merkleBlock
+	if mb == nil {
+		return false
+	}
+	hash := tx.TxHash()
+	found := false
+	for _, h := range mb.hashes {
+		if h.IsEqual(&hash) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if _, ok := mb.txs[hash]; !ok {
+		mb.txs[hash] = tx
+		mb.pending--
+	}
+	if mb.pending > 0 {
+		return true
+	}
+	spv.merkleBlock = nil
+	var infos []*TxInfo
+	for i, h := range mb.hashes {
+		info := &TxInfo{}
+		info.Tx = mb.txs[*h]
+		info.Hash = *h
+		info.Height = mb.height
+		info.BlockHash = mb.blockHash
+		info.Index = mb.indexes[i]
+		info.MerkleProof = mb.proofs[i]
+		infos = append(infos, info)
+	}
+	spv.processTxs(mb.height, infos)
+	return true
+}
+
+func (tree *partialMerkleTree) calcTreeWidth(height uint32) uint32 {
+	return (tree.numTx + (1 << height) - 1) >> height
+}
+
+// extractMatches returns the merkle root and sets the matched transaction hashes
+func (tree *partialMerkleTree) extractMatches() (*chainhash.Hash, error) {
+	if tree.numTx == 0 {
+		return nil, fmt.Errorf("no transactions")
+	}
+	if uint32(len(tree.hashes)) > tree.numTx {
+		return nil, fmt.Errorf("too many hashes : %d %d", len(tree.hashes), tree.numTx)
+	}
+	if len(tree.flags)*8 < len(tree.hashes) {
+		return nil, fmt.Errorf("not enough flags : %d %d", len(tree.flags), len(tree.hashes))
+	}
+	height := uint32(0)
+	for tree.calcTreeWidth(height) > 1 {
+		height++
+	}
+	tree.height = height
+	tree.nodes = make(map[[2]uint32]*chainhash.Hash)
+	root, err := tree.traverse(height, 0)
+	if err != nil {
+		return nil, err
+	}
+	if (tree.bitPos+7)/8 != len(tree.flags) {
+		return nil, fmt.Errorf("not all flags are consumed")
+	}
+	if tree.hashPos != len(tree.hashes) {
+		return nil, fmt.Errorf("not all hashes are consumed")
+	}
+	return root, nil
+}
+
+func (tree *partialMerkleTree) traverse(height, pos uint32) (*chainhash.Hash, error) {
+	if tree.bitPos >= len(tree.flags)*8 {
+		return nil, fmt.Errorf("overflowed the flags")
+	}
+	flag := (tree.flags[tree.bitPos/8] >> uint(tree.bitPos%8)) & 1
+	tree.bitPos++
+	if height == 0 || flag == 0 {
+		if tree.hashPos >= len(tree.hashes) {
+			return nil, fmt.Errorf("overflowed the hashes")
+		}
+		hash := tree.hashes[tree.hashPos]
+		tree.hashPos++
+		if height == 0 && flag == 1 {
+			tree.matched = append(tree.matched, hash)
+			tree.matchedPos = append(tree.matchedPos, pos)
+		}
+		tree.nodes[[2]uint32{height, pos}] = hash
+		return hash, nil
+	}
+	left, err := tree.traverse(height-1, pos*2)
+	if err != nil {
+		return nil, err
+	}
+	right := left
+	if pos*2+1 < tree.calcTreeWidth(height-1) {
+		right, err = tree.traverse(height-1, pos*2+1)
+		if err != nil {
+			return nil, err
+		}
+		if right.IsEqual(left) {
+			return nil, fmt.Errorf("duplicate hashes in the merkle tree")
+		}
+	}
+	hash := blockchain.HashMerkleBranches(left, right)
+	tree.nodes[[2]uint32{height, pos}] = hash
+	return hash, nil
+}
+
+// merkleBranch returns the sibling hashes from the matched leaf to the root
+// all siblings on the path of the matched leaf are traversed by extractMatches
+func (tree *partialMerkleTree) merkleBranch(pos uint32) []chainhash.Hash {
+	var branch []chainhash.Hash
+	for height := uint32(0); height < tree.height; height++ {
+		sibling := pos ^ 1
+		if sibling >= tree.calcTreeWidth(height) {
+			sibling = pos
+		}
+		branch = append(branch, *tree.nodes[[2]uint32{height, sibling}])
+		pos >>= 1
+	}
+	return branch
+}
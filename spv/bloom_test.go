@@ -0,0 +1,175 @@
+// Package spv project bloom_test.go
+package spv
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/bloom"
+)
+
+// testBlock returns a block of count transactions whose merkle root is set to the header
+func testBlock(count int) *wire.MsgBlock {
+	block := wire.NewMsgBlock(&wire.BlockHeader{Version: 1})
+	for i := 0; i < count; i++ {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: uint32(i)}, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(int64(i+1), []byte{0x51}))
+		block.AddTransaction(tx)
+	}
+	block.Header.MerkleRoot = testMerkleRoot(block)
+	return block
+}
+
+// testMerkleRoot returns the merkle root of the transactions in the block
+func testMerkleRoot(block *wire.MsgBlock) chainhash.Hash {
+	merkles := blockchain.BuildMerkleTreeStore(btcutil.NewBlock(block).Transactions(), false)
+	return *merkles[len(merkles)-1]
+}
+
+// testMerkleBlock returns the merkle block of the block matching the transactions at the indexes
+func testMerkleBlock(block *wire.MsgBlock, indexes []int) *wire.MsgMerkleBlock {
+	filter := bloom.NewFilter(10, 0, 0.000001, wire.BloomUpdateNone)
+	for _, i := range indexes {
+		hash := block.Transactions[i].TxHash()
+		filter.AddHash(&hash)
+	}
+	msg, _ := bloom.NewMerkleBlock(btcutil.NewBlock(block), filter)
+	return msg
+}
+
+// newTestTree returns the partial merkle tree of the merkle block
+func newTestTree(msg *wire.MsgMerkleBlock) *partialMerkleTree {
+	tree := &partialMerkleTree{}
+	tree.numTx = msg.Transactions
+	tree.hashes = msg.Hashes
+	tree.flags = msg.Flags
+	return tree
+}
+
+// branchRoot returns the merkle root computed from the leaf, its index and the merkle branch
+func branchRoot(hash chainhash.Hash, index int, branch []chainhash.Hash) chainhash.Hash {
+	for i := range branch {
+		if index&1 == 0 {
+			hash = *blockchain.HashMerkleBranches(&hash, &branch[i])
+		} else {
+			hash = *blockchain.HashMerkleBranches(&branch[i], &hash)
+		}
+		index >>= 1
+	}
+	return hash
+}
+
+func TestExtractMatches(t *testing.T) {
+	cases := []struct {
+		count   int
+		indexes []int
+	}{
+		{1, []int{0}},
+		{1, nil},
+		{2, []int{1}},
+		{3, []int{2}},
+		{5, []int{0, 4}},
+		{7, []int{1, 2, 6}},
+		{7, nil},
+		{16, []int{0, 5, 10, 15}},
+		{17, []int{16}},
+	}
+	for _, c := range cases {
+		block := testBlock(c.count)
+		tree := newTestTree(testMerkleBlock(block, c.indexes))
+		root, err := tree.extractMatches()
+		if err != nil {
+			t.Fatalf("%d %v : tree.extractMatches Error : %+v", c.count, c.indexes, err)
+		}
+		if !root.IsEqual(&block.Header.MerkleRoot) {
+			t.Fatalf("%d %v : unmatch merkle root : %v", c.count, c.indexes, root)
+		}
+		if len(tree.matched) != len(c.indexes) {
+			t.Fatalf("%d %v : unmatch matched count : %d", c.count, c.indexes, len(tree.matched))
+		}
+		for i, index := range c.indexes {
+			hash := block.Transactions[index].TxHash()
+			if !tree.matched[i].IsEqual(&hash) || int(tree.matchedPos[i]) != index {
+				t.Fatalf("%d %v : unmatch matched transaction : %d", c.count, c.indexes, i)
+			}
+			proof := branchRoot(hash, index, tree.merkleBranch(tree.matchedPos[i]))
+			if !proof.IsEqual(&block.Header.MerkleRoot) {
+				t.Fatalf("%d %v : merkle branch does not verify : %d", c.count, c.indexes, index)
+			}
+		}
+	}
+}
+
+func TestExtractMatchesMalformed(t *testing.T) {
+	block := testBlock(7)
+	valid := testMerkleBlock(block, []int{1, 6})
+	hash := chainhash.Hash{1}
+	cases := []struct {
+		name   string
+		modify func(msg *wire.MsgMerkleBlock)
+	}{
+		{"no transactions", func(msg *wire.MsgMerkleBlock) {
+			msg.Transactions = 0
+		}},
+		{"more hashes than transactions", func(msg *wire.MsgMerkleBlock) {
+			msg.Transactions = uint32(len(msg.Hashes) - 1)
+		}},
+		{"not enough flags", func(msg *wire.MsgMerkleBlock) {
+			msg.Flags = msg.Flags[:len(msg.Flags)-1]
+		}},
+		{"unused flag byte", func(msg *wire.MsgMerkleBlock) {
+			msg.Flags = append(msg.Flags, 0)
+		}},
+		{"unused hash", func(msg *wire.MsgMerkleBlock) {
+			msg.Hashes = append(msg.Hashes, &hash)
+		}},
+		{"missing hash", func(msg *wire.MsgMerkleBlock) {
+			msg.Hashes = msg.Hashes[:len(msg.Hashes)-1]
+		}},
+		{"no flags", func(msg *wire.MsgMerkleBlock) {
+			msg.Flags = nil
+		}},
+	}
+	for _, c := range cases {
+		msg := *valid
+		msg.Hashes = append([]*chainhash.Hash{}, valid.Hashes...)
+		msg.Flags = append([]byte{}, valid.Flags...)
+		c.modify(&msg)
+		_, err := newTestTree(&msg).extractMatches()
+		if err == nil {
+			t.Errorf("%s : malformed merkle block is accepted", c.name)
+		}
+	}
+	// the modified hash is accepted by the tree, but the root does not match the header
+	msg := *valid
+	msg.Hashes = append([]*chainhash.Hash{}, valid.Hashes...)
+	msg.Hashes[0] = &hash
+	root, err := newTestTree(&msg).extractMatches()
+	if err != nil || root.IsEqual(&block.Header.MerkleRoot) {
+		t.Fatalf("modified hash matches the merkle root : %v %+v", root, err)
+	}
+}
+
+// CVE-2012-2459, the last transaction is duplicated to make the same merkle root with another transaction count
+func TestExtractMatchesDuplicate(t *testing.T) {
+	block := testBlock(3)
+	mutated := testBlock(3)
+	mutated.AddTransaction(mutated.Transactions[2])
+	if testMerkleRoot(mutated) != block.Header.MerkleRoot {
+		t.Fatalf("mutated block does not have the same merkle root")
+	}
+	tree := newTestTree(testMerkleBlock(mutated, []int{0, 1, 2, 3}))
+	_, err := tree.extractMatches()
+	if err == nil {
+		t.Fatalf("duplicate subtree is accepted")
+	}
+	tree = newTestTree(testMerkleBlock(block, []int{0, 1, 2}))
+	root, err := tree.extractMatches()
+	if err != nil || !root.IsEqual(&block.Header.MerkleRoot) {
+		t.Fatalf("odd transactions are not accepted : %v %+v", root, err)
+	}
+}
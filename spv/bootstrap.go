@@ -0,0 +1,231 @@
+// Package spv project bootstrap.go
+package spv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// bootstrap file format : magic (4 bytes), version, network, start height and count (4 bytes each, big endian)
+// and serialized headers
+const (
+	bootstrapMagic   = "SBCB"
+	bootstrapVersion = 1
+	bootstrapBatch   = 2000
+)
+
+// bootstrapHeader is the header of the bootstrap file
+type bootstrapHeader struct {
+	Magic       [4]byte
+	Version     uint32
+	Net         uint32
+	StartHeight uint32
+	Count       uint32
+}
+
+// ExportHeaders writes the main chain headers to the bootstrap file
+// it returns the number of exported headers
+func (spv *Spv) ExportHeaders(w io.Writer) (int, error) {
+	cnt, min, max, err := spv.data.GetCntMinMaxHeight()
+	if err != nil {
+		log.Printf("spv.data.GetCntMinMaxHeight Error : %+v", err)
+		return 0, err
+	}
+	if cnt == 0 {
+		return 0, fmt.Errorf("no header to export")
+	}
+	writer := bufio.NewWriter(w)
+	head := bootstrapHeader{}
+	copy(head.Magic[:], bootstrapMagic)
+	head.Version = bootstrapVersion
+	head.Net = uint32(spv.params.Net)
+	head.StartHeight = uint32(min)
+	head.Count = uint32(cnt)
+	err = binary.Write(writer, binary.BigEndian, &head)
+	if err != nil {
+		log.Printf("binary.Write Error : %+v", err)
+		return 0, err
+	}
+	exported := 0
+	for height := min; height <= max; height += bootstrapBatch {
+		headers, first, err := spv.data.GetHeadersByHeight(height, height+bootstrapBatch-1)
+		if err != nil {
+			log.Printf("spv.data.GetHeadersByHeight Error : %+v", err)
+			return exported, err
+		}
+		if first != height {
+			return exported, fmt.Errorf("header not found : %d", height)
+		}
+		for _, header := range headers {
+			err = header.Serialize(writer)
+			if err != nil {
+				log.Printf("header.Serialize Error : %+v", err)
+				return exported, err
+			}
+		}
+		exported += len(headers)
+	}
+	if exported != cnt {
+		return exported, fmt.Errorf("unmatch header count : %d %d", exported, cnt)
+	}
+	return exported, writer.Flush()
+}
+
+// ImportHeaders reads the bootstrap file and stores the headers which extend the main chain
+// the headers are validated (proof of work, difficulty, timestamp and linkage) before they are stored,
+// the headers which are already stored are skipped, and the headers which conflict with them are rejected
+// if no header is stored, the headers are stored from the first checkpoint or the genesis in the file,
+// the headers before it are skipped, so the file exported from the older checkpoint can be imported
+// it must be called before Start, and it returns the number of imported headers
+func (spv *Spv) ImportHeaders(r io.Reader) (int, error) {
+	spv.stateMutex.Lock()
+	started := spv.done != nil
+	spv.stateMutex.Unlock()
+	if started {
+		return 0, fmt.Errorf("spv is already started")
+	}
+	reader := bufio.NewReader(r)
+	head := bootstrapHeader{}
+	err := binary.Read(reader, binary.BigEndian, &head)
+	if err != nil {
+		log.Printf("binary.Read Error : %+v", err)
+		return 0, err
+	}
+	if string(head.Magic[:]) != bootstrapMagic {
+		return 0, fmt.Errorf("invalid bootstrap file")
+	}
+	if head.Version != bootstrapVersion {
+		return 0, fmt.Errorf("unknown bootstrap version : %d", head.Version)
+	}
+	if head.Net != uint32(spv.params.Net) {
+		return 0, fmt.Errorf("unmatch network : %v %v", wire.BitcoinNet(head.Net), spv.params.Net)
+	}
+	imported := 0
+	height := int(head.StartHeight)
+	var headers []*wire.BlockHeader
+	for i := 0; i < int(head.Count); i++ {
+		header := new(wire.BlockHeader)
+		err = header.Deserialize(reader)
+		if err != nil {
+			log.Printf("header.Deserialize Error : %+v", err)
+			return imported, err
+		}
+		headers = append(headers, header)
+		if len(headers) == bootstrapBatch || i == int(head.Count)-1 {
+			n, err := spv.importHeaders(headers, height)
+			imported += n
+			if err != nil {
+				log.Printf("spv.importHeaders Error : %+v", err)
+				return imported, err
+			}
+			height += len(headers)
+			headers = nil
+		}
+	}
+	log.Printf("imported headers : %d", imported)
+	return imported, nil
+}
+
+// importHeaders validates and stores the headers from startHeight
+// it returns the number of stored headers
+func (spv *Spv) importHeaders(headers []*wire.BlockHeader, startHeight int) (int, error) {
+	tip, max, err := spv.data.GetTip()
+	if err != nil {
+		log.Printf("spv.data.GetTip Error : %+v", err)
+		return 0, err
+	}
+	if tip == nil {
+		_, height := spv.getInitHashHeight()
+		if startHeight > height {
+			return 0, fmt.Errorf("headers start after the last checkpoint : %d %d", startHeight, height)
+		}
+		i, err := spv.importAnchor(headers, startHeight)
+		if err != nil {
+			return 0, err
+		}
+		if i < 0 {
+			return 0, nil
+		}
+		headers = headers[i:]
+		startHeight += i
+		err = spv.checkProofOfWork(headers[0])
+		if err != nil {
+			return 0, err
+		}
+		err = spv.data.PutHeaders(headers[:1], startHeight)
+		if err != nil {
+			log.Printf("spv.data.PutHeaders Error : %+v", err)
+			return 0, err
+		}
+		n, err := spv.importHeaders(headers[1:], startHeight+1)
+		return n + 1, err
+	}
+	if startHeight > max+1 {
+		return 0, fmt.Errorf("headers do not connect to the tip : %d %d", startHeight, max)
+	}
+	skip := max + 1 - startHeight
+	if skip > len(headers) {
+		skip = len(headers)
+	}
+	if skip > 0 {
+		stored, first, err := spv.data.GetHeadersByHeight(startHeight, startHeight+skip-1)
+		if err != nil {
+			log.Printf("spv.data.GetHeadersByHeight Error : %+v", err)
+			return 0, err
+		}
+		for i, header := range stored {
+			if header.BlockHash() != headers[first-startHeight+i].BlockHash() {
+				return 0, fmt.Errorf("header conflicts with the stored header : %d", first+i)
+			}
+		}
+	}
+	headers = headers[skip:]
+	if len(headers) == 0 {
+		return 0, nil
+	}
+	chain, err := spv.newValidationChain(tip.BlockHash(), max+1)
+	if err != nil {
+		log.Printf("spv.newValidationChain Error : %+v", err)
+		return 0, err
+	}
+	for i, header := range headers {
+		err = spv.validateHeader(chain, header, max+1+i)
+		if err != nil {
+			return 0, err
+		}
+		chain.add(header, max+1+i)
+	}
+	err = spv.data.PutHeaders(headers, max+1)
+	if err != nil {
+		log.Printf("spv.data.PutHeaders Error : %+v", err)
+		return 0, err
+	}
+	return len(headers), nil
+}
+
+// importAnchor returns the index of the first header which is the genesis or a checkpoint
+// if the headers include neither of them, it returns -1
+func (spv *Spv) importAnchor(headers []*wire.BlockHeader, startHeight int) (int, error) {
+	anchors := append([]chaincfg.Checkpoint{{Height: 0, Hash: spv.params.GenesisHash}}, spv.params.Checkpoints...)
+	for _, anchor := range anchors {
+		i := int(anchor.Height) - startHeight
+		if i < 0 {
+			continue
+		}
+		if i >= len(headers) {
+			break
+		}
+		hash := headers[i].BlockHash()
+		if !hash.IsEqual(anchor.Hash) {
+			return 0, fmt.Errorf("header conflicts with checkpoint : %d %v %v", anchor.Height, hash, anchor.Hash)
+		}
+		return i, nil
+	}
+	return -1, nil
+}
@@ -0,0 +1,123 @@
+// Package spv project bootstrap_test.go
+package spv
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// exportTestHeaders returns the bootstrap file of the headers from the height
+func exportTestHeaders(t *testing.T, headers []*wire.BlockHeader, height int) []byte {
+	spv := newTestSpv(t, nil)
+	putTestHeaders(t, spv, headers, height)
+	buf := &bytes.Buffer{}
+	n, err := spv.ExportHeaders(buf)
+	if err != nil || n != len(headers) {
+		t.Fatalf("spv.ExportHeaders : %d %+v", n, err)
+	}
+	return buf.Bytes()
+}
+
+// testCheckpoint returns the checkpoint of the header at the height
+func testCheckpoint(header *wire.BlockHeader, height int) chaincfg.Checkpoint {
+	hash := header.BlockHash()
+	return chaincfg.Checkpoint{Height: int32(height), Hash: &hash}
+}
+
+func TestImportHeaders(t *testing.T) {
+	genesis := chaincfg.RegressionNetParams.GenesisBlock.Header
+	main := append([]*wire.BlockHeader{&genesis}, mineChain(&genesis, 30, 0)...)
+	full := exportTestHeaders(t, main, 0)
+	partial := exportTestHeaders(t, main[10:], 10)
+	wrong := testCheckpoint(main[14], 15)
+	cases := []struct {
+		name        string
+		file        []byte
+		checkpoints []chaincfg.Checkpoint
+		imported    int
+		min         int
+		ok          bool
+	}{
+		{"genesis", full, nil, 31, 0, true},
+		{"genesis with checkpoints", full, []chaincfg.Checkpoint{testCheckpoint(main[20], 20)}, 31, 0, true},
+		{"last checkpoint", partial, []chaincfg.Checkpoint{testCheckpoint(main[20], 20)}, 11, 20, true},
+		{"older checkpoint", partial, []chaincfg.Checkpoint{testCheckpoint(main[10], 10), testCheckpoint(main[20], 20)}, 21, 10, true},
+		{"checkpoint in the file", partial, []chaincfg.Checkpoint{testCheckpoint(main[5], 5), testCheckpoint(main[15], 15)}, 16, 15, true},
+		{"after the last checkpoint", partial, []chaincfg.Checkpoint{testCheckpoint(main[5], 5)}, 0, -1, false},
+		{"without checkpoint", partial, nil, 0, -1, false},
+		{"conflict with checkpoint", partial, []chaincfg.Checkpoint{wrong, testCheckpoint(main[20], 20)}, 0, -1, false},
+		{"truncated", full[:len(full)-40], nil, 0, -1, false},
+		{"truncated head", full[:10], nil, 0, -1, false},
+	}
+	for _, c := range cases {
+		config := NewConfig()
+		config.Checkpoints = c.checkpoints
+		spv := newTestSpv(t, config)
+		n, err := spv.ImportHeaders(bytes.NewReader(c.file))
+		if (err == nil) != c.ok || n != c.imported {
+			t.Errorf("%s : spv.ImportHeaders : %d %+v", c.name, n, err)
+			continue
+		}
+		cnt, min, max, err := spv.data.GetCntMinMaxHeight()
+		if err != nil {
+			t.Fatalf("spv.data.GetCntMinMaxHeight Error : %+v", err)
+		}
+		if !c.ok {
+			if cnt != 0 {
+				t.Errorf("%s : headers are stored : %d", c.name, cnt)
+			}
+			continue
+		}
+		if cnt != c.imported || min != c.min || max != 30 {
+			t.Errorf("%s : unmatch stored headers : %d %d %d", c.name, cnt, min, max)
+		}
+		tip, _, err := spv.data.GetTip()
+		if err != nil || tip.BlockHash() != main[30].BlockHash() {
+			t.Errorf("%s : unmatch tip : %+v", c.name, err)
+		}
+	}
+}
+
+func TestImportHeadersRoundTrip(t *testing.T) {
+	genesis := chaincfg.RegressionNetParams.GenesisBlock.Header
+	main := append([]*wire.BlockHeader{&genesis}, mineChain(&genesis, 30, 0)...)
+	side := append(append([]*wire.BlockHeader{}, main[:16]...), mineChain(main[15], 15, time.Minute)...)
+	spv := newTestSpv(t, nil)
+	n, err := spv.ImportHeaders(bytes.NewReader(exportTestHeaders(t, main[:21], 0)))
+	if err != nil || n != 21 {
+		t.Fatalf("spv.ImportHeaders : %d %+v", n, err)
+	}
+	// the stored headers are skipped and the rest extends the tip
+	n, err = spv.ImportHeaders(bytes.NewReader(exportTestHeaders(t, main, 0)))
+	if err != nil || n != 10 {
+		t.Fatalf("spv.ImportHeaders : %d %+v", n, err)
+	}
+	n, err = spv.ImportHeaders(bytes.NewReader(exportTestHeaders(t, main, 0)))
+	if err != nil || n != 0 {
+		t.Fatalf("spv.ImportHeaders : %d %+v", n, err)
+	}
+	// the branch which conflicts with the stored headers is rejected
+	n, err = spv.ImportHeaders(bytes.NewReader(exportTestHeaders(t, side, 0)))
+	if err == nil || n != 0 {
+		t.Fatalf("conflicting headers are imported : %d", n)
+	}
+	// the exported file is the same as the imported file
+	buf := &bytes.Buffer{}
+	n, err = spv.ExportHeaders(buf)
+	if err != nil || n != 31 {
+		t.Fatalf("spv.ExportHeaders : %d %+v", n, err)
+	}
+	if !bytes.Equal(buf.Bytes(), exportTestHeaders(t, main, 0)) {
+		t.Fatalf("unmatch exported headers")
+	}
+	// the headers of the other network are rejected
+	other := newTestSpvParams(t, chaincfg.SimNetParams, nil)
+	n, err = other.ImportHeaders(bytes.NewReader(buf.Bytes()))
+	if err == nil || n != 0 {
+		t.Fatalf("headers of the other network are imported : %d", n)
+	}
+}
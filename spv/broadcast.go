@@ -0,0 +1,269 @@
+// Package spv project broadcast.go
+package spv
+
+import (
+	"log"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// TxRebroadcastInterval is the interval to rebroadcast unconfirmed transactions
+const TxRebroadcastInterval = 10 * time.Minute
+
+// TxStatus
+const (
+	TxStatusPending = iota + 1
+	TxStatusAnnounced
+	TxStatusRequested
+	TxStatusSeen
+	TxStatusConfirmed
+	TxStatusRejected
+)
+
+// TxStatus is broadcast status type
+type TxStatus struct {
+	Hash    chainhash.Hash
+	Status  int
+	Updated time.Time
+	Reason  string
+}
+
+// SendMsgTx sends MsgTx
+// the transaction is announced to all peers and rebroadcasted until it is confirmed or rejected
+// if the transaction is already sent, it is announced again, and the status is reset only if it is rejected
+func (spv *Spv) SendMsgTx(tx *wire.MsgTx) error {
+	err := spv.data.PutTx(tx)
+	if err != nil {
+		log.Printf("spv.data.PutTx Error : %+v", err)
+		return err
+	}
+	hash := tx.TxHash()
+	status := spv.getTxStatus(hash)
+	if status < 0 || status == TxStatusRejected {
+		err = spv.setTxStatus(hash, TxStatusPending, "")
+		if err != nil {
+			log.Printf("spv.setTxStatus Error : %+v", err)
+			return err
+		}
+	}
+	spv.announceTxs([]chainhash.Hash{hash}, nil)
+	return nil
+}
+
+// GetTxStatus returns the broadcast status of the transaction
+// if the transaction is not broadcasted, it returns nil
+func (spv *Spv) GetTxStatus(hash chainhash.Hash) (*TxStatus, error) {
+	status, updated, reason, err := spv.data.GetTxStatus(hash)
+	if err != nil {
+		log.Printf("spv.data.GetTxStatus Error : %+v", err)
+		return nil, err
+	}
+	if status < 0 {
+		return nil, nil
+	}
+	txStatus := &TxStatus{}
+	txStatus.Hash = hash
+	txStatus.Status = status
+	txStatus.Updated = time.Unix(updated, 0)
+	txStatus.Reason = reason
+	return txStatus, nil
+}
+
+// ListTxStatus returns the broadcast status of all transactions
+func (spv *Spv) ListTxStatus() ([]*TxStatus, error) {
+	hashes, err := spv.data.ListTxHash()
+	if err != nil {
+		log.Printf("spv.data.ListTxHash Error : %+v", err)
+		return nil, err
+	}
+	var list []*TxStatus
+	for _, hash := range hashes {
+		txStatus, err := spv.GetTxStatus(hash)
+		if err != nil {
+			return nil, err
+		}
+		if txStatus != nil {
+			list = append(list, txStatus)
+		}
+	}
+	return list, nil
+}
+
+// setTxStatus updates the broadcast status
+func (spv *Spv) setTxStatus(hash chainhash.Hash, status int, reason string) error {
+	spv.txStatusMutex.Lock()
+	spv.txStatus[hash] = status
+	spv.txStatusMutex.Unlock()
+	log.Printf("tx status %v : %d %s", hash, status, reason)
+	err := spv.data.PutTxStatus(hash, status, time.Now().Unix(), reason)
+	if err != nil {
+		return err
+	}
+	spv.publish(TxBroadcastStatus{Hash: hash, Status: status, Reason: reason})
+	return nil
+}
+
+// getTxStatus returns the broadcast status, if the transaction is not broadcasted, it returns -1
+func (spv *Spv) getTxStatus(hash chainhash.Hash) int {
+	spv.txStatusMutex.Lock()
+	defer spv.txStatusMutex.Unlock()
+	status, ok := spv.txStatus[hash]
+	if !ok {
+		return -1
+	}
+	return status
+}
+
+// updateTxStatus updates the status if the transaction is broadcasted and the status is progressed
+// the rejected transaction is always updated, because it may be rejected only by the local policy of the peer
+// and be seen or mined later
+func (spv *Spv) updateTxStatus(hash chainhash.Hash, status int, reason string) {
+	current := spv.getTxStatus(hash)
+	if current < 0 || current == status || (current > status && current != TxStatusRejected) {
+		return
+	}
+	err := spv.setTxStatus(hash, status, reason)
+	if err != nil {
+		log.Printf("spv.setTxStatus Error : %+v", err)
+	}
+}
+
+// loadTxStatus loads the broadcast status of stored transactions
+func (spv *Spv) loadTxStatus() error {
+	hashes, err := spv.data.ListTxHash()
+	if err != nil {
+		log.Printf("spv.data.ListTxHash Error : %+v", err)
+		return err
+	}
+	spv.txStatusMutex.Lock()
+	defer spv.txStatusMutex.Unlock()
+	for _, hash := range hashes {
+		status, _, _, err := spv.data.GetTxStatus(hash)
+		if err != nil {
+			log.Printf("spv.data.GetTxStatus Error : %+v", err)
+			return err
+		}
+		if status < 0 {
+			status = TxStatusPending
+		}
+		spv.txStatus[hash] = status
+	}
+	return nil
+}
+
+// unconfirmedTxs returns the hashes of transactions which are neither confirmed nor rejected
+func (spv *Spv) unconfirmedTxs() []chainhash.Hash {
+	spv.txStatusMutex.Lock()
+	defer spv.txStatusMutex.Unlock()
+	var hashes []chainhash.Hash
+	for hash, status := range spv.txStatus {
+		if status == TxStatusConfirmed || status == TxStatusRejected {
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// announceTxs sends inv of the transactions to the peer, if peer is nil, to all ready peers
+func (spv *Spv) announceTxs(hashes []chainhash.Hash, peer *Peer) {
+	if len(hashes) == 0 {
+		return
+	}
+	msg := wire.NewMsgInv()
+	for i := range hashes {
+		msg.AddInvVect(wire.NewInvVect(wire.InvTypeTx, &hashes[i]))
+	}
+	if peer != nil {
+		peer.sendMsg(msg)
+	} else if spv.PeerCount() > 0 {
+		spv.broadcastMsg(msg)
+	} else {
+		return
+	}
+	for _, hash := range hashes {
+		spv.updateTxStatus(hash, TxStatusAnnounced, "")
+	}
+}
+
+// rebroadcastTxs announces unconfirmed transactions to all peers every TxRebroadcastInterval
+func (spv *Spv) rebroadcastTxs() {
+	if time.Since(spv.rebroadcastTime) < TxRebroadcastInterval {
+		return
+	}
+	spv.rebroadcastTime = time.Now()
+	spv.announceTxs(spv.unconfirmedTxs(), nil)
+}
+
+// sendTxs sends the requested transactions
+func (spv *Spv) sendTxs(peer *Peer, invList []*wire.InvVect) {
+	for _, inv := range invList {
+		if inv.Type != wire.InvTypeTx && inv.Type != wire.InvTypeWitnessTx {
+			continue
+		}
+		tx, err := spv.data.GetTx(inv.Hash)
+		if err != nil {
+			log.Printf("spv.data.GetTx Error : %+v", err)
+			continue
+		}
+		if tx == nil {
+			log.Printf("Unknown hash %v", inv.Hash)
+			continue
+		}
+		peer.sendMsg(tx)
+		spv.updateTxStatus(inv.Hash, TxStatusRequested, peer.addr)
+	}
+}
+
+// recvReject marks the transaction rejected
+// the duplicate is ignored, and the announced, seen or confirmed transaction is not downgraded
+func (spv *Spv) recvReject(peer *Peer, msg *wire.MsgReject) {
+	log.Printf("<<< MsgReject %s %v %s %v", msg.Cmd, msg.Code, msg.Reason, msg.Hash)
+	if msg.Cmd != wire.CmdTx || msg.Code == wire.RejectDuplicate {
+		return
+	}
+	status := spv.getTxStatus(msg.Hash)
+	if status != TxStatusPending && status != TxStatusRequested {
+		return
+	}
+	err := spv.setTxStatus(msg.Hash, TxStatusRejected, msg.Reason)
+	if err != nil {
+		log.Printf("spv.setTxStatus Error : %+v", err)
+	}
+}
+
+// seenTxs marks the transactions announced by peers as seen in mempool
+func (spv *Spv) seenTxs(invList []*wire.InvVect) {
+	for _, inv := range invList {
+		if inv.Type != wire.InvTypeTx && inv.Type != wire.InvTypeWitnessTx {
+			continue
+		}
+		spv.updateTxStatus(inv.Hash, TxStatusSeen, "")
+	}
+}
+
+// confirmTxs marks the transactions in the block as confirmed, even if they are rejected
+func (spv *Spv) confirmTxs(txs []*wire.MsgTx) {
+	for _, tx := range txs {
+		spv.updateTxStatus(tx.TxHash(), TxStatusConfirmed, "")
+	}
+}
+
+// unconfirmTxs marks the confirmed transactions in the disconnected block as announced
+// so they are rebroadcasted at the next cycle
+func (spv *Spv) unconfirmTxs(txs []*wire.MsgTx) {
+	for _, tx := range txs {
+		hash := tx.TxHash()
+		if spv.getTxStatus(hash) != TxStatusConfirmed {
+			continue
+		}
+		err := spv.setTxStatus(hash, TxStatusAnnounced, "reorg")
+		if err != nil {
+			log.Printf("spv.setTxStatus Error : %+v", err)
+			continue
+		}
+		spv.rebroadcastTime = time.Time{}
+	}
+}
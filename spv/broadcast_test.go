@@ -0,0 +1,126 @@
+// Package spv project broadcast_test.go
+package spv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestRecvReject(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	cases := []struct {
+		status int
+		code   wire.RejectCode
+		want   int
+	}{
+		{TxStatusRequested, wire.RejectInvalid, TxStatusRejected},
+		{TxStatusRequested, wire.RejectDuplicate, TxStatusRequested},
+		{TxStatusAnnounced, wire.RejectInvalid, TxStatusAnnounced},
+		{TxStatusSeen, wire.RejectInsufficientFee, TxStatusSeen},
+		{TxStatusConfirmed, wire.RejectInvalid, TxStatusConfirmed},
+	}
+	for i, c := range cases {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.LockTime = uint32(i)
+		hash := tx.TxHash()
+		err := spv.setTxStatus(hash, c.status, "")
+		if err != nil {
+			t.Fatalf("spv.setTxStatus Error : %+v", err)
+		}
+		msg := wire.NewMsgReject(wire.CmdTx, c.code, "test")
+		msg.Hash = hash
+		spv.recvReject(nil, msg)
+		if status := spv.getTxStatus(hash); status != c.want {
+			t.Errorf("case %d : unmatch status : %d %d", i, status, c.want)
+		}
+	}
+}
+
+func TestUnconfirmTxs(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+	err := spv.data.PutTx(tx)
+	if err != nil {
+		t.Fatalf("spv.data.PutTx Error : %+v", err)
+	}
+	hash := tx.TxHash()
+	err = spv.setTxStatus(hash, TxStatusAnnounced, "")
+	if err != nil {
+		t.Fatalf("spv.setTxStatus Error : %+v", err)
+	}
+	spv.confirmTxs([]*wire.MsgTx{tx})
+	err = spv.putBlockTxs(10, []*wire.MsgTx{tx})
+	if err != nil {
+		t.Fatalf("spv.putBlockTxs Error : %+v", err)
+	}
+	if status := spv.getTxStatus(hash); status != TxStatusConfirmed {
+		t.Fatalf("transaction is not confirmed : %d", status)
+	}
+	txs, err := spv.getBlockTxs(10)
+	if err != nil || len(txs) != 1 || txs[0].TxHash() != hash {
+		t.Fatalf("spv.getBlockTxs : %v %+v", txs, err)
+	}
+	spv.rebroadcastTime = time.Now()
+	spv.unconfirmTxs(txs)
+	if status := spv.getTxStatus(hash); status != TxStatusAnnounced {
+		t.Fatalf("transaction is not announced : %d", status)
+	}
+	if !spv.rebroadcastTime.IsZero() {
+		t.Fatalf("rebroadcast is not scheduled")
+	}
+	hashes := spv.unconfirmedTxs()
+	if len(hashes) != 1 || hashes[0] != hash {
+		t.Fatalf("unmatch unconfirmed txs : %v", hashes)
+	}
+	err = spv.putBlockTxs(10+BlockTxsDepth, nil)
+	if err != nil {
+		t.Fatalf("spv.putBlockTxs Error : %+v", err)
+	}
+	txs, err = spv.getBlockTxs(10)
+	if err != nil || txs != nil {
+		t.Fatalf("old block txs are not removed : %v %+v", txs, err)
+	}
+}
+
+func TestConfirmRejectedTx(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	sub := spv.Subscribe()
+	defer sub.Close()
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+	hash := tx.TxHash()
+	err := spv.setTxStatus(hash, TxStatusRequested, "")
+	if err != nil {
+		t.Fatalf("spv.setTxStatus Error : %+v", err)
+	}
+	msg := wire.NewMsgReject(wire.CmdTx, wire.RejectInsufficientFee, "min relay fee not met")
+	msg.Hash = hash
+	spv.recvReject(nil, msg)
+	if status := spv.getTxStatus(hash); status != TxStatusRejected {
+		t.Fatalf("transaction is not rejected : %d", status)
+	}
+	if hashes := spv.unconfirmedTxs(); len(hashes) != 0 {
+		t.Fatalf("rejected transaction is rebroadcasted : %v", hashes)
+	}
+	spv.confirmTxs([]*wire.MsgTx{tx})
+	if status := spv.getTxStatus(hash); status != TxStatusConfirmed {
+		t.Fatalf("rejected transaction is not confirmed : %d", status)
+	}
+	var last TxBroadcastStatus
+	for len(sub.Events()) > 0 {
+		if event, ok := (<-sub.Events()).(TxBroadcastStatus); ok {
+			last = event
+		}
+	}
+	if last.Hash != hash || last.Status != TxStatusConfirmed {
+		t.Fatalf("confirmed status is not published : %+v", last)
+	}
+	spv.unconfirmTxs([]*wire.MsgTx{tx})
+	hashes := spv.unconfirmedTxs()
+	if len(hashes) != 1 || hashes[0] != hash {
+		t.Fatalf("unconfirmed transaction is not rebroadcasted : %v", hashes)
+	}
+}
@@ -0,0 +1,301 @@
+// Package spv project callback.go
+package spv
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"reflect"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// TxInfo is the transaction passed to checkTx functions
+// for the unconfirmed transaction, Height is HeightUnconfirmed, Index is -1 and MerkleProof is nil
+type TxInfo struct {
+	Tx          *wire.MsgTx
+	Hash        chainhash.Hash
+	Height      int
+	BlockHash   chainhash.Hash
+	Index       int
+	MerkleProof []chainhash.Hash
+}
+
+// TxFilter selects the items dispatched to the callback
+// the outpoints of the outputs which match PkScripts are added to OutPoints automatically
+type TxFilter struct {
+	PkScripts [][]byte
+	OutPoints []*wire.OutPoint
+}
+
+// Registration is the handle of the registered callback
+type Registration struct {
+	spv *Spv
+	id  uint64
+}
+
+// callback is the registered callback type
+type callback struct {
+	id        uint64
+	fn        interface{}
+	scripts   [][]byte
+	outpoints map[wire.OutPoint]bool
+}
+
+// AddCheckTxIn adds checkTxIn function
+// it is an adapter of checkTx, checkTxIn is called with each input of the transaction
+func (spv *Spv) AddCheckTxIn(checkTxIn func(*wire.TxIn)) (*Registration, error) {
+	return spv.addCallback("checkTxIn", checkTxIn, nil)
+}
+
+// AddCheckTxOut adds checkTxOut function
+// it is an adapter of checkTx, checkTxOut is called with the height, the txid, the index and each output
+func (spv *Spv) AddCheckTxOut(checkTxOut func(int, chainhash.Hash, int, *wire.TxOut)) (*Registration, error) {
+	return spv.addCallback("checkTxOut", checkTxOut, nil)
+}
+
+// AddCheckTx adds checkTx function
+// checkTx is called with the relevant transactions in the block and the unconfirmed transactions
+// if filter is not nil, only the transactions which spend its outpoints or pay to its scripts are dispatched,
+// and the scripts and the outpoints are added to the bloom filter and the watched scripts
+func (spv *Spv) AddCheckTx(checkTx func(*TxInfo), filter *TxFilter) (*Registration, error) {
+	reg, err := spv.addCallback("checkTx", checkTx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		spv.watchFilter(filter)
+	}
+	return reg, nil
+}
+
+// AddNotifyFork adds notifyFork function
+// notifyFork is called with the fork height and the new tip height when the header chain reorgs
+func (spv *Spv) AddNotifyFork(notifyFork func(int, int)) (*Registration, error) {
+	return spv.addCallback("notifyFork", notifyFork, nil)
+}
+
+// AddNotifyBlockConnected adds notifyBlockConnected function
+// notifyBlockConnected is called with the header, the height and the transactions after checkTx functions,
+// the transactions are all transactions in block mode and the relevant transactions in the other modes
+func (spv *Spv) AddNotifyBlockConnected(notifyBlockConnected func(*wire.BlockHeader, int, []*wire.MsgTx)) (*Registration, error) {
+	return spv.addCallback("notifyBlockConnected", notifyBlockConnected, nil)
+}
+
+// AddNotifyBlockDisconnected adds notifyBlockDisconnected function
+// notifyBlockDisconnected is called from the tip when the processed blocks are disconnected by reorg,
+// with the relevant transactions which were delivered in the block (Index is -1 and MerkleProof is nil),
+// the transactions are kept for the last BlockTxsDepth blocks
+func (spv *Spv) AddNotifyBlockDisconnected(notifyBlockDisconnected func(*wire.BlockHeader, int, []*TxInfo)) (*Registration, error) {
+	return spv.addCallback("notifyBlockDisconnected", notifyBlockDisconnected, nil)
+}
+
+// Remove removes the registered callback
+// the scripts and the outpoints added to the bloom filter are not removed
+func (reg *Registration) Remove() {
+	spv := reg.spv
+	spv.callbackMutex.Lock()
+	defer spv.callbackMutex.Unlock()
+	for i, c := range spv.callbacks {
+		if c.id == reg.id {
+			spv.callbacks = append(spv.callbacks[:i:i], spv.callbacks[i+1:]...)
+			return
+		}
+	}
+}
+
+// addCallback registers the function, the same function of the same type cannot be registered twice
+func (spv *Spv) addCallback(name string, fn interface{}, filter *TxFilter) (*Registration, error) {
+	spv.callbackMutex.Lock()
+	defer spv.callbackMutex.Unlock()
+	f1 := reflect.ValueOf(fn)
+	for _, c := range spv.callbacks {
+		f2 := reflect.ValueOf(c.fn)
+		if f1.Type() == f2.Type() && f1.Pointer() == f2.Pointer() {
+			return nil, fmt.Errorf("%s is already exist", name)
+		}
+	}
+	spv.callbackID++
+	c := &callback{}
+	c.id = spv.callbackID
+	c.fn = fn
+	if filter != nil {
+		c.scripts = filter.PkScripts
+		c.outpoints = make(map[wire.OutPoint]bool)
+		for _, outpoint := range filter.OutPoints {
+			c.outpoints[*outpoint] = true
+		}
+	}
+	spv.callbacks = append(spv.callbacks, c)
+	reg := &Registration{}
+	reg.spv = spv
+	reg.id = c.id
+	return reg, nil
+}
+
+// getCallbacks returns the registered callbacks
+func (spv *Spv) getCallbacks() []*callback {
+	spv.callbackMutex.Lock()
+	defer spv.callbackMutex.Unlock()
+	return spv.callbacks
+}
+
+// watchFilter adds the scripts and the outpoints of the filter to the bloom filter and the watched scripts
+func (spv *Spv) watchFilter(filter *TxFilter) {
+	for _, script := range filter.PkScripts {
+		spv.AddWatchScript(script)
+		pushes, err := txscript.PushedData(script)
+		if err != nil {
+			log.Printf("txscript.PushedData Error : %+v", err)
+			continue
+		}
+		for _, data := range pushes {
+			spv.AddFilterData(data)
+		}
+	}
+	for _, outpoint := range filter.OutPoints {
+		spv.AddFilterOutPoint(outpoint)
+		spv.watchMutex.Lock()
+		spv.watchOutPoints[*outpoint] = true
+		spv.watchMutex.Unlock()
+	}
+}
+
+// match returns whether the transaction matches the filter of the callback
+// the outpoints of the matched outputs are added to the filter
+// callbacks are matched only in the msgHandler goroutine
+func (c *callback) match(info *TxInfo) bool {
+	if c.outpoints == nil {
+		return true
+	}
+	matched := false
+	for _, txin := range info.Tx.TxIn {
+		if c.outpoints[txin.PreviousOutPoint] {
+			matched = true
+		}
+	}
+	for idx, txout := range info.Tx.TxOut {
+		for _, script := range c.scripts {
+			if bytes.Equal(txout.PkScript, script) {
+				c.outpoints[*wire.NewOutPoint(&info.Hash, uint32(idx))] = true
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// callCheckTx calls checkTx functions, and checkTxIn and checkTxOut functions as adapters
+func (spv *Spv) callCheckTx(info *TxInfo) {
+	for _, c := range spv.getCallbacks() {
+		switch fn := c.fn.(type) {
+		case func(*TxInfo):
+			if c.match(info) {
+				fn(info)
+			}
+		case func(*wire.TxIn):
+			for _, txin := range info.Tx.TxIn {
+				fn(txin)
+			}
+		case func(int, chainhash.Hash, int, *wire.TxOut):
+			for idx, txout := range info.Tx.TxOut {
+				fn(info.Height, info.Hash, idx, txout)
+			}
+		}
+	}
+}
+
+// callBlockConnected calls notifyBlockConnected functions
+func (spv *Spv) callBlockConnected(height int, txs []*wire.MsgTx) {
+	var header *wire.BlockHeader
+	for _, c := range spv.getCallbacks() {
+		notifyBlockConnected, ok := c.fn.(func(*wire.BlockHeader, int, []*wire.MsgTx))
+		if !ok {
+			continue
+		}
+		if header == nil {
+			var err error
+			header, _, err = spv.data.GetHeaderByHeight(height)
+			if err != nil {
+				log.Printf("spv.data.GetHeaderByHeight Error : %+v", err)
+				return
+			}
+			if header == nil {
+				log.Printf("Not found header height : %d", height)
+				return
+			}
+		}
+		notifyBlockConnected(header, height, txs)
+	}
+}
+
+// callBlockDisconnected calls notifyBlockDisconnected functions from the last header
+// txs are the relevant transactions of each header
+func (spv *Spv) callBlockDisconnected(headers []*wire.BlockHeader, txs [][]*wire.MsgTx, startHeight int) {
+	callbacks := spv.getCallbacks()
+	for i := len(headers) - 1; i >= 0; i-- {
+		var infos []*TxInfo
+		for _, tx := range txs[i] {
+			info := &TxInfo{}
+			info.Tx = tx
+			info.Hash = tx.TxHash()
+			info.Height = startHeight + i
+			info.BlockHash = headers[i].BlockHash()
+			info.Index = -1
+			infos = append(infos, info)
+		}
+		for _, c := range callbacks {
+			if notifyBlockDisconnected, ok := c.fn.(func(*wire.BlockHeader, int, []*TxInfo)); ok {
+				notifyBlockDisconnected(headers[i], startHeight+i, infos)
+			}
+		}
+	}
+}
+
+// unconfirmedTxInfo returns TxInfo of the unconfirmed transaction
+func unconfirmedTxInfo(tx *wire.MsgTx) *TxInfo {
+	info := &TxInfo{}
+	info.Tx = tx
+	info.Hash = tx.TxHash()
+	info.Height = HeightUnconfirmed
+	info.Index = -1
+	return info
+}
+
+// blockTxInfos returns TxInfo of all transactions in the block
+// store is the merkle tree store of the transactions which checkBlock built
+func blockTxInfos(block *wire.MsgBlock, height int, store []*chainhash.Hash) []*TxInfo {
+	blockHash := block.BlockHash()
+	var infos []*TxInfo
+	for i, tx := range block.Transactions {
+		info := &TxInfo{}
+		info.Tx = tx
+		info.Hash = tx.TxHash()
+		info.Height = height
+		info.BlockHash = blockHash
+		info.Index = i
+		info.MerkleProof = merkleBranch(store, i)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// merkleBranch returns the sibling hashes from the leaf to the root in the merkle tree store
+func merkleBranch(store []*chainhash.Hash, index int) []chainhash.Hash {
+	var branch []chainhash.Hash
+	offset := 0
+	width := (len(store) + 1) / 2
+	for width > 1 {
+		sibling := store[offset+(index^1)]
+		if sibling == nil {
+			sibling = store[offset+index]
+		}
+		branch = append(branch, *sibling)
+		offset += width
+		width /= 2
+		index /= 2
+	}
+	return branch
+}
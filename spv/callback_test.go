@@ -0,0 +1,123 @@
+// Package spv project callback_test.go
+package spv
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testCoinbaseBlock returns a block of count transactions whose first transaction is coinbase
+func testCoinbaseBlock(count int) *wire.MsgBlock {
+	block := testBlock(count)
+	block.Transactions[0].TxIn[0].PreviousOutPoint.Index = wire.MaxPrevOutIndex
+	block.Header.MerkleRoot = testMerkleRoot(block)
+	return block
+}
+
+func TestBlockTxInfos(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	peer := newTestPeer(t, spv, "peer", wire.SFNodeNetwork, 0)
+	for _, count := range []int{1, 2, 3, 5, 6, 7, 8, 11} {
+		block := testCoinbaseBlock(count)
+		merkles, err := spv.checkBlock(peer, block, &block.Header)
+		if err != nil {
+			t.Fatalf("%d : spv.checkBlock Error : %+v", count, err)
+		}
+		infos := blockTxInfos(block, 10, merkles)
+		if len(infos) != count {
+			t.Fatalf("%d : unmatch infos : %d", count, len(infos))
+		}
+		for i, info := range infos {
+			if info.Index != i || info.Height != 10 || info.Hash != block.Transactions[i].TxHash() {
+				t.Fatalf("%d : unmatch info : %d %+v", count, i, info)
+			}
+			root := branchRoot(info.Hash, info.Index, info.MerkleProof)
+			if !root.IsEqual(&block.Header.MerkleRoot) {
+				t.Fatalf("%d : merkle proof does not verify : %d", count, i)
+			}
+		}
+	}
+}
+
+func TestRegistrationRemove(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	called := 0
+	checkTx := func(info *TxInfo) {
+		called++
+	}
+	reg, err := spv.AddCheckTx(checkTx, nil)
+	if err != nil {
+		t.Fatalf("spv.AddCheckTx Error : %+v", err)
+	}
+	_, err = spv.AddCheckTx(checkTx, nil)
+	if err == nil {
+		t.Fatalf("same function is registered twice")
+	}
+	other, err := spv.AddNotifyFork(func(int, int) {})
+	if err != nil {
+		t.Fatalf("spv.AddNotifyFork Error : %+v", err)
+	}
+	tx := testBlock(1).Transactions[0]
+	spv.callCheckTx(unconfirmedTxInfo(tx))
+	reg.Remove()
+	reg.Remove()
+	spv.callCheckTx(unconfirmedTxInfo(tx))
+	if called != 1 {
+		t.Fatalf("removed function is called : %d", called)
+	}
+	if callbacks := spv.getCallbacks(); len(callbacks) != 1 || callbacks[0].id != other.id {
+		t.Fatalf("another function is removed : %d", len(callbacks))
+	}
+	_, err = spv.AddCheckTx(checkTx, nil)
+	if err != nil {
+		t.Fatalf("removed function is not registered again : %+v", err)
+	}
+}
+
+func TestTxFilterMatch(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	script := []byte{0x00, 0x14, 0x01}
+	watched := wire.OutPoint{Hash: chainhash.Hash{1}, Index: 0}
+	var matched []chainhash.Hash
+	checkTx := func(info *TxInfo) {
+		matched = append(matched, info.Hash)
+	}
+	filter := &TxFilter{PkScripts: [][]byte{script}, OutPoints: []*wire.OutPoint{&watched}}
+	_, err := spv.AddCheckTx(checkTx, filter)
+	if err != nil {
+		t.Fatalf("spv.AddCheckTx Error : %+v", err)
+	}
+	// pay pays to the script, spend spends its output, and spendWatched spends the watched outpoint
+	pay := wire.NewMsgTx(wire.TxVersion)
+	pay.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 1}, nil, nil))
+	pay.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+	pay.AddTxOut(wire.NewTxOut(1000, script))
+	payHash := pay.TxHash()
+	spend := wire.NewMsgTx(wire.TxVersion)
+	spend.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&payHash, 1), nil, nil))
+	spendOther := wire.NewMsgTx(wire.TxVersion)
+	spendOther.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&payHash, 0), nil, nil))
+	spendWatched := wire.NewMsgTx(wire.TxVersion)
+	spendWatched.AddTxIn(wire.NewTxIn(&watched, nil, nil))
+	for _, tx := range []*wire.MsgTx{spend, pay, spend, spendOther, spendWatched} {
+		spv.callCheckTx(unconfirmedTxInfo(tx))
+	}
+	want := []chainhash.Hash{payHash, spend.TxHash(), spendWatched.TxHash()}
+	if len(matched) != len(want) {
+		t.Fatalf("unmatch matched transactions : %v", matched)
+	}
+	for i := range want {
+		if matched[i] != want[i] {
+			t.Fatalf("unmatch matched transaction : %d %v %v", i, matched[i], want[i])
+		}
+	}
+	c := spv.getCallbacks()[0]
+	if !c.outpoints[*wire.NewOutPoint(&payHash, 1)] || c.outpoints[*wire.NewOutPoint(&payHash, 0)] {
+		t.Fatalf("outpoint of the matched output is not added : %v", c.outpoints)
+	}
+	if len(filter.OutPoints) != 1 {
+		t.Fatalf("outpoints of the filter are changed : %v", filter.OutPoints)
+	}
+}
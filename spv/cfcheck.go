@@ -0,0 +1,334 @@
+// Package spv project cfcheck.go
+package spv
+
+import (
+	"log"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/gcs"
+	"github.com/btcsuite/btcutil/gcs/builder"
+)
+
+// CFHeadersPeers is the number of peers whose filter headers are compared
+// if fewer peers support compact filters, the filter headers of one peer are trusted
+const CFHeadersPeers = 2
+
+// cfHeadersCheck is the filter headers requested from the peers to compare them
+// if the filter hashes conflict, the block and the filters at the first conflict height are requested
+// to find the peer which sent the invalid filter
+type cfHeadersCheck struct {
+	required int
+	start    int
+	stopHash chainhash.Hash
+	peers    []*Peer
+	msgs     map[*Peer]*wire.MsgCFHeaders
+	conflict int
+	block    *wire.MsgBlock
+	filters  map[*Peer]*wire.MsgCFilter
+	resolved bool
+}
+
+// requestCFHeaders sends getcfheaders to CFHeadersPeers peers except the peer
+// if only one peer supports compact filters, it is sent to the peer without the comparison
+func (spv *Spv) requestCFHeaders(start int, stopHash *chainhash.Hash, except *Peer) {
+	peers := spv.cfPeers(except)
+	if len(peers) == 0 {
+		log.Printf("no peer supports compact filters")
+		spv.errBlock = true
+		return
+	}
+	required := CFHeadersPeers
+	if len(peers) < required {
+		log.Printf("WARNING: filter headers are not compared, only %d peer supports compact filters", len(peers))
+		required = len(peers)
+	}
+	check := &cfHeadersCheck{}
+	check.required = required
+	check.start = start
+	check.stopHash = *stopHash
+	check.msgs = make(map[*Peer]*wire.MsgCFHeaders)
+	check.conflict = -1
+	spv.cfCheck = check
+	for _, peer := range peers[:required] {
+		spv.addCFHeadersPeer(peer)
+	}
+}
+
+// addCFHeadersPeer sends getcfheaders of the check to the peer
+func (spv *Spv) addCFHeadersPeer(peer *Peer) {
+	check := spv.cfCheck
+	check.peers = append(check.peers, peer)
+	check.msgs[peer] = nil
+	check.resolved = false
+	peer.sendMsg(wire.NewMsgGetCFHeaders(wire.GCSFilterRegular, uint32(check.start), &check.stopHash))
+	spv.setRequest("cfheaders", peer)
+}
+
+// stalled returns the peer which has not responded yet
+func (check *cfHeadersCheck) stalled() *Peer {
+	for _, peer := range check.peers {
+		msg, ok := check.msgs[peer]
+		if ok && msg == nil {
+			return peer
+		}
+		filter, ok := check.filters[peer]
+		if ok && filter == nil {
+			return peer
+		}
+	}
+	return nil
+}
+
+// requested returns true if the filter headers are requested to the peer
+func (check *cfHeadersCheck) requested(peer *Peer) bool {
+	for _, p := range check.peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// waiting returns true if the filter headers of the peer are waited
+func (check *cfHeadersCheck) waiting(peer *Peer, msg *wire.MsgCFHeaders) bool {
+	old, ok := check.msgs[peer]
+	return ok && old == nil && check.filters == nil && check.stopHash.IsEqual(&msg.StopHash)
+}
+
+// rejectCFHeaders penalizes the peer and removes its filter headers from the check
+func (spv *Spv) rejectCFHeaders(peer *Peer, reason string) {
+	peer.penalize(PeerBanScore, reason)
+	delete(spv.cfCheck.msgs, peer)
+	spv.checkCFHeaders()
+}
+
+// responses returns the responded filter headers in the requested order
+// it returns nil until all peers respond
+func (check *cfHeadersCheck) responses() []*wire.MsgCFHeaders {
+	var msgs []*wire.MsgCFHeaders
+	for _, peer := range check.peers {
+		msg, ok := check.msgs[peer]
+		if !ok {
+			continue
+		}
+		if msg == nil {
+			return nil
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// sameCFHeaders returns true if the filter headers are same
+func sameCFHeaders(a, b *wire.MsgCFHeaders) bool {
+	if !a.PrevFilterHeader.IsEqual(&b.PrevFilterHeader) || len(a.FilterHashes) != len(b.FilterHashes) {
+		return false
+	}
+	for i := range a.FilterHashes {
+		if !a.FilterHashes[i].IsEqual(b.FilterHashes[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// conflictIndex returns the index of the first filter hash which differs among the filter headers
+// if all filter hashes are same, it returns -1
+func conflictIndex(msgs []*wire.MsgCFHeaders) int {
+	for i := range msgs[0].FilterHashes {
+		for _, msg := range msgs[1:] {
+			if !msg.FilterHashes[i].IsEqual(msgs[0].FilterHashes[i]) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// checkCFHeaders compares the filter headers of the peers when all peers respond
+// the same filter headers are stored, the conflict is resolved with the block
+// and if the block can not prove it, the filter headers of the majority are stored
+func (spv *Spv) checkCFHeaders() {
+	check := spv.cfCheck
+	msgs := check.responses()
+	if msgs == nil {
+		return
+	}
+	if len(msgs) == 0 {
+		log.Printf("no valid filter headers : %d", check.start)
+		spv.cfCheck = nil
+		spv.errBlock = true
+		return
+	}
+	same := true
+	for _, msg := range msgs[1:] {
+		if !sameCFHeaders(msgs[0], msg) {
+			same = false
+			break
+		}
+	}
+	if same && len(msgs) >= check.required {
+		spv.cfCheck = nil
+		spv.putCFHeaders(msgs[0], check.start)
+		return
+	}
+	if !same && !check.resolved {
+		index := conflictIndex(msgs)
+		if index >= 0 {
+			spv.resolveCFHeaders(index)
+			return
+		}
+	}
+	for _, msg := range msgs {
+		agree := 0
+		for _, other := range msgs {
+			if sameCFHeaders(msg, other) {
+				agree++
+			}
+		}
+		if len(msgs) < CFHeadersPeers+1 || agree*2 <= len(msgs) {
+			continue
+		}
+		for peer, other := range check.msgs {
+			if other != nil && !sameCFHeaders(msg, other) {
+				peer.penalize(PeerBanScore, "unmatch filter headers")
+			}
+		}
+		spv.cfCheck = nil
+		spv.putCFHeaders(msg, check.start)
+		return
+	}
+	for _, peer := range spv.cfPeers(nil) {
+		if check.requested(peer) {
+			continue
+		}
+		log.Printf("unmatch filter headers, request to another peer : %d %s", check.start, peer.addr)
+		spv.addCFHeadersPeer(peer)
+		return
+	}
+	log.Printf("unresolved filter headers conflict : %d", check.start)
+	spv.cfCheck = nil
+	spv.errBlock = true
+}
+
+// resolveCFHeaders requests the block and the filters of the peers at the conflict index
+func (spv *Spv) resolveCFHeaders(index int) {
+	check := spv.cfCheck
+	height := check.start + index
+	header, _, err := spv.data.GetHeaderByHeight(height)
+	if err != nil || header == nil {
+		log.Printf("spv.data.GetHeaderByHeight Error : %d %+v", height, err)
+		spv.cfCheck = nil
+		spv.errBlock = true
+		return
+	}
+	log.Printf("unmatch filter hashes, check the block : %d", height)
+	check.conflict = index
+	check.filters = make(map[*Peer]*wire.MsgCFilter)
+	hash := header.BlockHash()
+	for peer, msg := range check.msgs {
+		if msg == nil {
+			continue
+		}
+		check.filters[peer] = nil
+		peer.sendMsg(wire.NewMsgGetCFilters(wire.GCSFilterRegular, uint32(height), &hash))
+	}
+	spv.requestBlock(&hash, nil)
+}
+
+// recvCFilterCheck receives the filter at the conflict height
+// it returns false if the filter is not requested
+func (spv *Spv) recvCFilterCheck(peer *Peer, msg *wire.MsgCFilter) bool {
+	check := spv.cfCheck
+	if check == nil || check.filters == nil {
+		return false
+	}
+	if old, ok := check.filters[peer]; !ok || old != nil {
+		return false
+	}
+	check.filters[peer] = msg
+	spv.checkCFilters()
+	return true
+}
+
+// recvBlockCheck receives the block at the conflict height
+// it returns false if the block is not requested
+func (spv *Spv) recvBlockCheck(peer *Peer, block *wire.MsgBlock, header *wire.BlockHeader, height int) bool {
+	check := spv.cfCheck
+	if check == nil || check.filters == nil || check.block != nil || height != check.start+check.conflict {
+		return false
+	}
+	_, err := spv.checkBlock(peer, block, header)
+	if err != nil {
+		log.Printf("spv.checkBlock Error : %+v", err)
+		peer.penalize(PeerBanScore, "invalid block")
+		hash := block.BlockHash()
+		spv.requestBlock(&hash, peer)
+		return true
+	}
+	check.block = block
+	spv.checkCFilters()
+	return true
+}
+
+// checkCFilters checks the filters at the conflict height with the block when all of them are received
+// the peer whose filter does not match its filter hash or misses the output scripts of the block is penalized
+func (spv *Spv) checkCFilters() {
+	check := spv.cfCheck
+	if check.block == nil {
+		return
+	}
+	for _, msg := range check.filters {
+		if msg == nil {
+			return
+		}
+	}
+	blockHash := check.block.BlockHash()
+	for peer, msg := range check.filters {
+		filterHash := chainhash.DoubleHashH(msg.Data)
+		if !filterHash.IsEqual(check.msgs[peer].FilterHashes[check.conflict]) ||
+			!msg.BlockHash.IsEqual(&blockHash) || !matchBlockOutputs(check.block, msg.Data) {
+			log.Printf("invalid filter : %d %s", check.start+check.conflict, peer.addr)
+			peer.penalize(PeerBanScore, "invalid filter headers")
+			delete(check.msgs, peer)
+		}
+	}
+	check.block = nil
+	check.filters = nil
+	check.resolved = true
+	spv.request = nil
+	spv.checkCFHeaders()
+}
+
+// matchBlockOutputs returns true if the filter matches all output scripts of the block
+// the filter also contains the previous output scripts, but they can not be checked without the previous transactions
+func matchBlockOutputs(block *wire.MsgBlock, data []byte) bool {
+	var scripts [][]byte
+	for _, tx := range block.Transactions {
+		for _, txOut := range tx.TxOut {
+			if len(txOut.PkScript) == 0 || txOut.PkScript[0] == txscript.OP_RETURN {
+				continue
+			}
+			scripts = append(scripts, txOut.PkScript)
+		}
+	}
+	if len(scripts) == 0 {
+		return true
+	}
+	filter, err := gcs.FromNBytes(builder.DefaultP, builder.DefaultM, data)
+	if err != nil || filter.N() == 0 {
+		return false
+	}
+	blockHash := block.BlockHash()
+	key := builder.DeriveKey(&blockHash)
+	for _, script := range scripts {
+		match, err := filter.Match(key, script)
+		if err != nil || !match {
+			log.Printf("filter misses the output script : %x", script)
+			return false
+		}
+	}
+	return true
+}
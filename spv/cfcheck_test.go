@@ -0,0 +1,199 @@
+// Package spv project cfcheck_test.go
+package spv
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/gcs/builder"
+)
+
+// testFilterBlock returns a block which pays to two scripts and the filter data of the block and of its first tx only
+func testFilterBlock(t *testing.T) (*wire.MsgBlock, []byte, []byte) {
+	block := wire.NewMsgBlock(&wire.BlockHeader{Version: 1, Bits: 0x207fffff})
+	for i := 1; i <= 2; i++ {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: uint32(i)}, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(1000, []byte{txscript.OP_0, txscript.OP_DATA_20, byte(i), 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}))
+		block.AddTransaction(tx)
+	}
+	full, err := builder.BuildBasicFilter(block, nil)
+	if err != nil {
+		t.Fatalf("builder.BuildBasicFilter Error : %+v", err)
+	}
+	fullData, err := full.NBytes()
+	if err != nil {
+		t.Fatalf("filter.NBytes Error : %+v", err)
+	}
+	// the header is not changed, so the filter key is same
+	partialBlock := wire.NewMsgBlock(&block.Header)
+	partialBlock.AddTransaction(block.Transactions[0])
+	partial, err := builder.BuildBasicFilter(partialBlock, nil)
+	if err != nil {
+		t.Fatalf("builder.BuildBasicFilter Error : %+v", err)
+	}
+	partialData, err := partial.NBytes()
+	if err != nil {
+		t.Fatalf("filter.NBytes Error : %+v", err)
+	}
+	return block, fullData, partialData
+}
+
+// testCFHeaders returns the filter headers whose first filter hash is the hash of the data
+func testCFHeaders(data []byte, count int) *wire.MsgCFHeaders {
+	msg := wire.NewMsgCFHeaders()
+	msg.FilterType = wire.GCSFilterRegular
+	for i := 0; i < count; i++ {
+		hash := chainhash.Hash{byte(i)}
+		if i == 0 {
+			hash = chainhash.DoubleHashH(data)
+		}
+		msg.AddCFHash(&hash)
+	}
+	return msg
+}
+
+// requestedCFHeaders returns true if getcfheaders is sent to the peer
+func requestedCFHeaders(peer *Peer) bool {
+	for _, msg := range queuedMsgs(peer) {
+		if _, ok := msg.(*wire.MsgGetCFHeaders); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMatchBlockOutputs(t *testing.T) {
+	block, full, partial := testFilterBlock(t)
+	if !matchBlockOutputs(block, full) {
+		t.Fatalf("filter of the block does not match")
+	}
+	if matchBlockOutputs(block, partial) {
+		t.Fatalf("filter missing the output script matches")
+	}
+	if matchBlockOutputs(block, []byte{0x00}) {
+		t.Fatalf("empty filter matches the block with outputs")
+	}
+	empty := wire.NewMsgBlock(&block.Header)
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_RETURN, 0x01}))
+	empty.AddTransaction(tx)
+	if !matchBlockOutputs(empty, []byte{0x00}) {
+		t.Fatalf("block without scripts does not match")
+	}
+}
+
+func TestCFHeadersSinglePeer(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	peer := newTestPeer(t, spv, "peer", wire.SFNodeCF, 10)
+	stopHash := chainhash.Hash{1}
+	spv.requestCFHeaders(1, &stopHash, nil)
+	if spv.cfCheck == nil || spv.cfCheck.required != 1 || !requestedCFHeaders(peer) {
+		t.Fatalf("filter headers are not requested to the single peer")
+	}
+	msg := testCFHeaders([]byte{1}, 3)
+	spv.cfCheck.msgs[peer] = msg
+	spv.checkCFHeaders()
+	tip, err := spv.data.GetCFHeaderTip()
+	if err != nil || tip != 3 {
+		t.Fatalf("filter headers are not stored : %d %+v", tip, err)
+	}
+}
+
+func TestCFHeadersNoPeer(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	newTestPeer(t, spv, "peer", wire.SFNodeNetwork, 10)
+	stopHash := chainhash.Hash{1}
+	spv.requestCFHeaders(1, &stopHash, nil)
+	if spv.cfCheck != nil || !spv.errBlock {
+		t.Fatalf("filter headers are requested without compact filter peers")
+	}
+}
+
+func TestCFHeadersMajority(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	a := newTestPeer(t, spv, "a", wire.SFNodeCF, 10)
+	b := newTestPeer(t, spv, "b", wire.SFNodeCF, 9)
+	c := newTestPeer(t, spv, "c", wire.SFNodeCF, 8)
+	stopHash := chainhash.Hash{1}
+	spv.requestCFHeaders(1, &stopHash, nil)
+	check := spv.cfCheck
+	if !requestedCFHeaders(a) || !requestedCFHeaders(b) || requestedCFHeaders(c) {
+		t.Fatalf("filter headers are not requested to the best peers")
+	}
+	good := testCFHeaders([]byte{1}, 3)
+	bad := testCFHeaders([]byte{2}, 3)
+	check.msgs[a] = good
+	check.msgs[b] = bad
+	// the block could not prove which filter is invalid
+	check.resolved = true
+	spv.checkCFHeaders()
+	if spv.cfCheck != check || !check.requested(c) || !requestedCFHeaders(c) {
+		t.Fatalf("filter headers are not requested to another peer")
+	}
+	// the block is checked again with the filter of the new peer, and it could not prove either
+	check.msgs[c] = good
+	check.resolved = true
+	spv.checkCFHeaders()
+	if !b.isClosed() || a.isClosed() || c.isClosed() {
+		t.Fatalf("the peer of the minority is not penalized")
+	}
+	tip, err := spv.data.GetCFHeaderTip()
+	if err != nil || tip != 3 {
+		t.Fatalf("filter headers are not stored : %d %+v", tip, err)
+	}
+	prev := chainhash.Hash{}
+	want := makeCFHeader(good.FilterHashes[0], &prev)
+	cfheader, err := spv.data.GetCFHeader(1)
+	if err != nil || cfheader == nil || !cfheader.IsEqual(&want) {
+		t.Fatalf("filter headers of the majority are not stored : %v %+v", cfheader, err)
+	}
+}
+
+func TestCheckCFilters(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	a := newTestPeer(t, spv, "a", wire.SFNodeCF, 10)
+	b := newTestPeer(t, spv, "b", wire.SFNodeCF, 9)
+	c := newTestPeer(t, spv, "c", wire.SFNodeCF, 8)
+	d := newTestPeer(t, spv, "d", wire.SFNodeCF, 7)
+	block, full, partial := testFilterBlock(t)
+	blockHash := block.BlockHash()
+	stopHash := chainhash.Hash{1}
+	spv.requestCFHeaders(1, &stopHash, nil)
+	check := spv.cfCheck
+	// b sends the filter which misses the output script, and c sends the filter which does not match its filter hash
+	check.peers = append(check.peers, c)
+	check.msgs[a] = testCFHeaders(full, 3)
+	check.msgs[b] = testCFHeaders(partial, 3)
+	check.msgs[c] = testCFHeaders([]byte{3}, 3)
+	check.conflict = 0
+	check.filters = map[*Peer]*wire.MsgCFilter{
+		a: wire.NewMsgCFilter(wire.GCSFilterRegular, &blockHash, full),
+		b: wire.NewMsgCFilter(wire.GCSFilterRegular, &blockHash, partial),
+		c: wire.NewMsgCFilter(wire.GCSFilterRegular, &blockHash, full),
+	}
+	queuedMsgs(a)
+	spv.checkCFilters()
+	if !check.requested(c) || check.resolved {
+		t.Fatalf("filters are checked before the block is received")
+	}
+	check.block = block
+	spv.checkCFilters()
+	if a.isClosed() || !b.isClosed() || !c.isClosed() {
+		t.Fatalf("the peers of the invalid filters are not penalized")
+	}
+	if _, ok := check.msgs[b]; ok {
+		t.Fatalf("the filter headers of the invalid filter are not removed")
+	}
+	if check.filters != nil || !requestedCFHeaders(d) {
+		t.Fatalf("filter headers are not requested to another peer")
+	}
+	check.msgs[d] = check.msgs[a]
+	spv.checkCFHeaders()
+	tip, err := spv.data.GetCFHeaderTip()
+	if err != nil || tip != 3 {
+		t.Fatalf("filter headers are not stored : %d %+v", tip, err)
+	}
+}
@@ -0,0 +1,270 @@
+// Package spv project cfilter.go
+package spv
+
+import (
+	"log"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/gcs"
+	"github.com/btcsuite/btcutil/gcs/builder"
+)
+
+// AddWatchScript adds pkScript to match with compact filters and unconfirmed transactions
+// the scripts should be added before Start, the peers connected before anything is watched do not relay transactions
+func (spv *Spv) AddWatchScript(pkScript []byte) {
+	spv.watchMutex.Lock()
+	defer spv.watchMutex.Unlock()
+	spv.watchScripts = append(spv.watchScripts, pkScript)
+}
+
+// cfPeer returns the best peer which supports compact filters except the peer
+func (spv *Spv) cfPeer(except *Peer) *Peer {
+	peers := spv.cfPeers(except)
+	if len(peers) == 0 {
+		return nil
+	}
+	return peers[0]
+}
+
+// cfPeers returns the ready peers which support compact filters except the peer, from the best
+func (spv *Spv) cfPeers(except *Peer) []*Peer {
+	var peers []*Peer
+	for _, peer := range spv.Peers() {
+		if peer == except || !peer.IsReady() || !peer.hasService(wire.SFNodeCF) {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].BestHeight() != peers[j].BestHeight() {
+			return peers[i].BestHeight() > peers[j].BestHeight()
+		}
+		return peers[i].Latency() < peers[j].Latency()
+	})
+	return peers
+}
+
+// updateCFilter requests filter headers to the check height, and then the filter at the check height
+// the requests are sent to the best peer except the peer
+func (spv *Spv) updateCFilter(header *wire.BlockHeader, except *Peer) {
+	spv.cfCheck = nil
+	peer := spv.cfPeer(except)
+	if peer == nil {
+		log.Printf("no peer supports compact filters")
+		spv.errBlock = true
+		return
+	}
+	cfTip, err := spv.data.GetCFHeaderTip()
+	if err != nil {
+		log.Printf("spv.data.GetCFHeaderTip Error : %+v", err)
+		spv.errBlock = true
+		return
+	}
+	if cfTip < spv.checkHeight {
+		start := cfTip + 1
+		if cfTip < 0 {
+			start = spv.checkHeight
+		}
+		_, _, max, err := spv.data.GetCntMinMaxHeight()
+		if err != nil {
+			log.Printf("spv.data.GetCntMinMaxHeight Error : %+v", err)
+			spv.errBlock = true
+			return
+		}
+		stop := start + wire.MaxCFHeadersPerMsg - 1
+		if stop > max {
+			stop = max
+		}
+		stopHeader, _, err := spv.data.GetHeaderByHeight(stop)
+		if err != nil || stopHeader == nil {
+			log.Printf("spv.data.GetHeaderByHeight Error : %d %+v", stop, err)
+			spv.errBlock = true
+			return
+		}
+		stopHash := stopHeader.BlockHash()
+		spv.requestCFHeaders(start, &stopHash, except)
+		return
+	}
+	hash := header.BlockHash()
+	peer.sendMsg(wire.NewMsgGetCFilters(wire.GCSFilterRegular, uint32(spv.checkHeight), &hash))
+	spv.setRequest("cfilter", peer)
+}
+
+// recvCFHeaders validates the filter headers and adds them to the check
+// the filter headers are stored when the peers agree, see checkCFHeaders
+func (spv *Spv) recvCFHeaders(peer *Peer, msg *wire.MsgCFHeaders) {
+	if msg.FilterType != wire.GCSFilterRegular || len(msg.FilterHashes) == 0 {
+		return
+	}
+	check := spv.cfCheck
+	if check == nil || !check.waiting(peer, msg) {
+		return
+	}
+	_, stopHeight, err := spv.data.GetHeaderByHash(msg.StopHash)
+	if err != nil {
+		log.Printf("spv.data.GetHeaderByHash Error : %+v", err)
+		spv.cfCheck = nil
+		spv.errBlock = true
+		return
+	}
+	if stopHeight < 0 {
+		log.Printf("unknown stop hash : %v", msg.StopHash)
+		spv.cfCheck = nil
+		spv.errBlock = true
+		return
+	}
+	start := stopHeight - len(msg.FilterHashes) + 1
+	if start != check.start {
+		log.Printf("unmatch filter header height : %d %d", start, check.start)
+		spv.rejectCFHeaders(peer, "invalid filter headers")
+		return
+	}
+	cfTip, err := spv.data.GetCFHeaderTip()
+	if err != nil {
+		log.Printf("spv.data.GetCFHeaderTip Error : %+v", err)
+		spv.cfCheck = nil
+		spv.errBlock = true
+		return
+	}
+	if cfTip >= 0 {
+		prev, err := spv.data.GetCFHeader(cfTip)
+		if err != nil {
+			log.Printf("spv.data.GetCFHeader Error : %+v", err)
+			spv.cfCheck = nil
+			spv.errBlock = true
+			return
+		}
+		if prev == nil || !prev.IsEqual(&msg.PrevFilterHeader) {
+			log.Printf("unmatch previous filter header : %v %v", prev, msg.PrevFilterHeader)
+			spv.rejectCFHeaders(peer, "invalid filter headers")
+			return
+		}
+	}
+	check.msgs[peer] = msg
+	spv.checkCFHeaders()
+}
+
+// putCFHeaders stores the filter headers from the start height
+// the first filter headers are anchored by the previous filter header which the peers agree
+// or which the only peer supporting compact filters sends
+func (spv *Spv) putCFHeaders(msg *wire.MsgCFHeaders, start int) {
+	cfTip, err := spv.data.GetCFHeaderTip()
+	if err != nil {
+		log.Printf("spv.data.GetCFHeaderTip Error : %+v", err)
+		spv.errBlock = true
+		return
+	}
+	if cfTip >= 0 && start != cfTip+1 {
+		log.Printf("unmatch filter header height : %d %d", start, cfTip+1)
+		spv.errBlock = true
+		return
+	}
+	var cfheaders []chainhash.Hash
+	if cfTip < 0 {
+		cfheaders = append(cfheaders, msg.PrevFilterHeader)
+		start--
+	}
+	prev := msg.PrevFilterHeader
+	for _, filterHash := range msg.FilterHashes {
+		prev = makeCFHeader(filterHash, &prev)
+		cfheaders = append(cfheaders, prev)
+	}
+	err = spv.data.PutCFHeaders(cfheaders, start)
+	if err != nil {
+		log.Printf("spv.data.PutCFHeaders Error : %+v", err)
+		spv.errBlock = true
+		return
+	}
+	spv.updateBlock()
+}
+
+// recvCFilter validates the filter with the filter header and matches the watched scripts
+// if the filter matches, the block is requested
+func (spv *Spv) recvCFilter(peer *Peer, msg *wire.MsgCFilter) {
+	if msg.FilterType != wire.GCSFilterRegular {
+		return
+	}
+	if spv.recvCFilterCheck(peer, msg) {
+		return
+	}
+	header, height, err := spv.data.GetHeaderByHash(msg.BlockHash)
+	if err != nil {
+		log.Printf("spv.data.GetHeaderByHash Error : %+v", err)
+		spv.errBlock = true
+		return
+	}
+	if header == nil || height != spv.checkHeight {
+		log.Printf("unmatch height : %d %d", height, spv.checkHeight)
+		spv.errBlock = true
+		return
+	}
+	cfheader, err := spv.data.GetCFHeader(height)
+	if err != nil {
+		log.Printf("spv.data.GetCFHeader Error : %+v", err)
+		spv.errBlock = true
+		return
+	}
+	prev, err := spv.data.GetCFHeader(height - 1)
+	if err != nil {
+		log.Printf("spv.data.GetCFHeader Error : %+v", err)
+		spv.errBlock = true
+		return
+	}
+	if cfheader == nil || prev == nil {
+		log.Printf("filter header not found : %d", height)
+		spv.errBlock = true
+		return
+	}
+	filterHash := chainhash.DoubleHashH(msg.Data)
+	computed := makeCFHeader(&filterHash, prev)
+	if !computed.IsEqual(cfheader) {
+		log.Printf("unmatch filter header : %d %v %v", height, computed, cfheader)
+		peer.penalize(PeerBanScore, "invalid filter")
+		spv.errBlock = true
+		return
+	}
+	match, err := spv.matchCFilter(&msg.BlockHash, msg.Data)
+	if err != nil {
+		log.Printf("spv.matchCFilter Error : %+v", err)
+		peer.penalize(PeerBanScore, "invalid filter")
+		spv.errBlock = true
+		return
+	}
+	if !match {
+		spv.processTxs(height, nil)
+		return
+	}
+	log.Printf("filter matched : %d %v", height, msg.BlockHash)
+	smsg := wire.NewMsgGetData()
+	smsg.AddInvVect(wire.NewInvVect(spv.blockInvType(peer), &msg.BlockHash))
+	peer.sendMsg(smsg)
+	spv.setRequest("block", peer)
+}
+
+func (spv *Spv) matchCFilter(blockHash *chainhash.Hash, data []byte) (bool, error) {
+	spv.watchMutex.Lock()
+	watchScripts := spv.watchScripts
+	spv.watchMutex.Unlock()
+	if len(watchScripts) == 0 {
+		return false, nil
+	}
+	filter, err := gcs.FromNBytes(builder.DefaultP, builder.DefaultM, data)
+	if err != nil {
+		return false, err
+	}
+	if filter.N() == 0 {
+		return false, nil
+	}
+	key := builder.DeriveKey(blockHash)
+	return filter.MatchAny(key, watchScripts)
+}
+
+// makeCFHeader returns double sha256 of the filter hash and the previous filter header
+func makeCFHeader(filterHash *chainhash.Hash, prev *chainhash.Hash) chainhash.Hash {
+	bs := make([]byte, 0, chainhash.HashSize*2)
+	bs = append(bs, filterHash[:]...)
+	bs = append(bs, prev[:]...)
+	return chainhash.DoubleHashH(bs)
+}
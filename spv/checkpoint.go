@@ -0,0 +1,86 @@
+// Package spv project checkpoint.go
+package spv
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// mergeCheckpoints returns the checkpoints of the params and the config sorted by height
+// the checkpoint of the config replaces the checkpoint of the params at the same height
+func mergeCheckpoints(params, config []chaincfg.Checkpoint) []chaincfg.Checkpoint {
+	checkpoints := make(map[int32]chaincfg.Checkpoint)
+	for _, checkpoint := range params {
+		checkpoints[checkpoint.Height] = checkpoint
+	}
+	for _, checkpoint := range config {
+		checkpoints[checkpoint.Height] = checkpoint
+	}
+	var merged []chaincfg.Checkpoint
+	for _, checkpoint := range checkpoints {
+		merged = append(merged, checkpoint)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Height < merged[j].Height
+	})
+	return merged
+}
+
+// checkpoint returns the checkpoint at the height, if there is no checkpoint, it returns nil
+func (spv *Spv) checkpoint(height int) *chaincfg.Checkpoint {
+	for i := range spv.params.Checkpoints {
+		if int(spv.params.Checkpoints[i].Height) == height {
+			return &spv.params.Checkpoints[i]
+		}
+	}
+	return nil
+}
+
+// lastCheckpointHeight returns the height of the last checkpoint at or below the height
+// if there is no checkpoint, it returns -1
+func (spv *Spv) lastCheckpointHeight(height int) int {
+	last := -1
+	for _, checkpoint := range spv.params.Checkpoints {
+		if int(checkpoint.Height) <= height {
+			last = int(checkpoint.Height)
+		}
+	}
+	return last
+}
+
+// checkCheckpoint checks the header hash at the checkpoint height
+func (spv *Spv) checkCheckpoint(hash *chainhash.Hash, height int) error {
+	checkpoint := spv.checkpoint(height)
+	if checkpoint == nil {
+		return nil
+	}
+	if !hash.IsEqual(checkpoint.Hash) {
+		return fmt.Errorf("header conflicts with checkpoint : %d %v %v", height, hash, checkpoint.Hash)
+	}
+	return nil
+}
+
+// checkStoredCheckpoints checks the stored headers at the checkpoint heights
+// it detects the stored chain which conflicts with the checkpoints added after it is synced
+func (spv *Spv) checkStoredCheckpoints() error {
+	for _, checkpoint := range spv.params.Checkpoints {
+		header, _, err := spv.data.GetHeaderByHeight(int(checkpoint.Height))
+		if err != nil {
+			log.Printf("spv.data.GetHeaderByHeight Error : %+v", err)
+			return err
+		}
+		if header == nil {
+			continue
+		}
+		hash := header.BlockHash()
+		err = spv.checkCheckpoint(&hash, int(checkpoint.Height))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Package spv project checkpoint_test.go
+package spv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestMergeCheckpoints(t *testing.T) {
+	hash1 := &chainhash.Hash{1}
+	hash2 := &chainhash.Hash{2}
+	hash3 := &chainhash.Hash{3}
+	cases := []struct {
+		name   string
+		params []chaincfg.Checkpoint
+		config []chaincfg.Checkpoint
+		want   []chaincfg.Checkpoint
+	}{
+		{"none", nil, nil, nil},
+		{"params", []chaincfg.Checkpoint{{Height: 10, Hash: hash1}, {Height: 20, Hash: hash2}}, nil,
+			[]chaincfg.Checkpoint{{Height: 10, Hash: hash1}, {Height: 20, Hash: hash2}}},
+		{"config", nil, []chaincfg.Checkpoint{{Height: 20, Hash: hash2}, {Height: 10, Hash: hash1}},
+			[]chaincfg.Checkpoint{{Height: 10, Hash: hash1}, {Height: 20, Hash: hash2}}},
+		{"added", []chaincfg.Checkpoint{{Height: 10, Hash: hash1}, {Height: 30, Hash: hash3}}, []chaincfg.Checkpoint{{Height: 20, Hash: hash2}},
+			[]chaincfg.Checkpoint{{Height: 10, Hash: hash1}, {Height: 20, Hash: hash2}, {Height: 30, Hash: hash3}}},
+		{"override", []chaincfg.Checkpoint{{Height: 10, Hash: hash1}, {Height: 20, Hash: hash2}}, []chaincfg.Checkpoint{{Height: 20, Hash: hash3}},
+			[]chaincfg.Checkpoint{{Height: 10, Hash: hash1}, {Height: 20, Hash: hash3}}},
+		{"override last", []chaincfg.Checkpoint{{Height: 10, Hash: hash1}}, []chaincfg.Checkpoint{{Height: 10, Hash: hash2}, {Height: 10, Hash: hash3}},
+			[]chaincfg.Checkpoint{{Height: 10, Hash: hash3}}},
+	}
+	for _, c := range cases {
+		merged := mergeCheckpoints(c.params, c.config)
+		if !reflect.DeepEqual(merged, c.want) {
+			t.Errorf("%s : unmatch checkpoints : %v %v", c.name, merged, c.want)
+		}
+	}
+}
+
+func TestCheckStoredCheckpoints(t *testing.T) {
+	headers := testHeaders(chainhash.Hash{}, 20, 0)
+	checkpoint := func(height int) chaincfg.Checkpoint {
+		hash := headers[height].BlockHash()
+		return chaincfg.Checkpoint{Height: int32(height), Hash: &hash}
+	}
+	wrong := chaincfg.Checkpoint{Height: 15, Hash: &chainhash.Hash{1}}
+	cases := []struct {
+		name        string
+		checkpoints []chaincfg.Checkpoint
+		ok          bool
+	}{
+		{"none", nil, true},
+		{"match", []chaincfg.Checkpoint{checkpoint(5), checkpoint(15)}, true},
+		{"above the tip", []chaincfg.Checkpoint{checkpoint(5), {Height: 30, Hash: &chainhash.Hash{1}}}, true},
+		{"mismatch", []chaincfg.Checkpoint{checkpoint(5), wrong}, false},
+	}
+	for _, c := range cases {
+		data, err := NewMemData()
+		if err != nil {
+			t.Fatalf("NewMemData Error : %+v", err)
+		}
+		err = data.PutHeaders(headers, 0)
+		if err != nil {
+			t.Fatalf("data.PutHeaders Error : %+v", err)
+		}
+		config := NewConfig()
+		config.Store = data
+		config.Checkpoints = c.checkpoints
+		spv, err := NewSpv(chaincfg.RegressionNetParams, config)
+		if (err == nil) != c.ok {
+			t.Errorf("%s : NewSpv : %+v", c.name, err)
+		}
+		if spv != nil {
+			spv.Stop()
+		}
+	}
+}
+
+func TestLastCheckpointHeight(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	spv.params.Checkpoints = []chaincfg.Checkpoint{{Height: 10}, {Height: 20}}
+	for height, want := range map[int]int{0: -1, 9: -1, 10: 10, 19: 10, 20: 20, 100: 20} {
+		if last := spv.lastCheckpointHeight(height); last != want {
+			t.Errorf("unmatch last checkpoint : %d %d %d", height, last, want)
+		}
+	}
+	hash := (&wire.BlockHeader{}).BlockHash()
+	spv.params.Checkpoints[0].Hash = &hash
+	if spv.checkCheckpoint(&hash, 10) != nil || spv.checkCheckpoint(&chainhash.Hash{1}, 10) == nil || spv.checkCheckpoint(&chainhash.Hash{1}, 11) != nil {
+		t.Fatalf("unmatch checkpoint check")
+	}
+}
@@ -0,0 +1,106 @@
+// Package spv project config.go
+package spv
+
+import (
+	"net"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// Config is spv config type
+type Config struct {
+	// Peers is a list of peer addresses ("host" or "host:port")
+	Peers []string
+	// MaxPeers is the number of outbound peers to maintain
+	MaxPeers int
+	// Resolver resolves DNS seeds, if nil, net.LookupHost is used
+	Resolver Resolver
+	// SyncMode is the way to download blocks
+	SyncMode int
+	// Backend is the storage backend used when Store is nil
+	Backend int
+	// Store is the storage, if nil, the store of Backend is opened in the data directory
+	Store Store
+	// Checkpoints are the trusted checkpoints added to the checkpoints of the network,
+	// the sync starts from the last checkpoint and all checkpoints are enforced
+	Checkpoints []chaincfg.Checkpoint
+	// Birthday is the wallet birthday, the blocks before it are not scanned
+	Birthday Birthday
+	// DataDir is the data directory, if empty, DefaultDataDir is used
+	// chain data is stored in <DataDir>/<network>/chain, which is locked while spv is open
+	// the in-memory backend does not use it
+	DataDir string
+}
+
+// DefaultMaxPeers is the default number of outbound peers
+const DefaultMaxPeers = 3
+
+// SyncMode
+const (
+	// SyncModeBlock downloads full blocks
+	SyncModeBlock = iota
+	// SyncModeBloom downloads merkle blocks filtered by BIP37 bloom filter
+	SyncModeBloom
+	// SyncModeCFilter downloads blocks matched by BIP157/158 compact filters
+	SyncModeCFilter
+)
+
+// Backend
+const (
+	// BackendSQLite stores data in sqlite (cgo)
+	BackendSQLite = iota
+	// BackendLevelDB stores data in leveldb (pure Go)
+	BackendLevelDB
+	// BackendMemory stores data in memory, it is for tests
+	BackendMemory
+	// BackendFlat stores the main chain headers in a flat file and the other data in sqlite (cgo)
+	BackendFlat
+)
+
+// NewConfig returns a new Config
+func NewConfig() *Config {
+	config := &Config{}
+	config.MaxPeers = DefaultMaxPeers
+	return config
+}
+
+// maxPeers returns the number of outbound peers
+func (config *Config) maxPeers() int {
+	if config.MaxPeers <= 0 {
+		return DefaultMaxPeers
+	}
+	return config.MaxPeers
+}
+
+// dataDir returns the data directory
+func (config *Config) dataDir() string {
+	if config.DataDir == "" {
+		return DefaultDataDir()
+	}
+	return config.DataDir
+}
+
+// peerAddrs returns peer addresses with port
+// if there is no peer and no DNS seed, it returns localhost with default port
+func (config *Config) peerAddrs(defaultPort string, hasSeeds bool) []string {
+	var addrs []string
+	for _, peer := range config.Peers {
+		if peer == "" {
+			continue
+		}
+		addrs = append(addrs, normalizeAddr(peer, defaultPort))
+	}
+	if len(addrs) == 0 && !hasSeeds {
+		addrs = append(addrs, net.JoinHostPort("127.0.0.1", defaultPort))
+	}
+	return addrs
+}
+
+// normalizeAddr adds default port to the address if it has no port
+func normalizeAddr(addr, defaultPort string) string {
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return net.JoinHostPort(addr, defaultPort)
+	}
+	return addr
+}
@@ -17,15 +17,46 @@ import (
 )
 
 // key names for kvs
+// KeyBlockTxs is followed by the height
 const (
 	KeyCheckHeight = "checkHeight"
+	KeyBlockTxs    = "blockTxs"
 )
 
 // Data is data type
 type Data struct {
 	name    string
 	datadir string
+	db      *sql.DB
+	stmts   map[string]*sql.Stmt
 	mutex   *sync.Mutex
+	cache   *headerCache
+}
+
+// migrations are the schema changes applied in order
+// the number of applied migrations is stored in user_version,
+// a new schema change must be appended as a new migration
+var migrations = [][]string{
+	// 1 : initial tables
+	{
+		"CREATE TABLE IF NOT EXISTS headers (hash BLOB, height INTEGER, data BLOB, PRIMARY KEY(hash), UNIQUE(height))",
+		"CREATE TABLE IF NOT EXISTS kvs (key TEXT, val BLOB, PRIMARY KEY(key))",
+		"CREATE TABLE IF NOT EXISTS cfheaders (height INTEGER, header BLOB, PRIMARY KEY(height))",
+		"CREATE TABLE IF NOT EXISTS txstatus (hash BLOB, status INTEGER, updated INTEGER, reason TEXT, PRIMARY KEY(hash))",
+		"CREATE TABLE IF NOT EXISTS mempool (hash BLOB, data BLOB, time INTEGER, PRIMARY KEY(hash))",
+		"CREATE TABLE IF NOT EXISTS forks (hash BLOB, height INTEGER, data BLOB, PRIMARY KEY(hash))",
+		"CREATE TABLE IF NOT EXISTS tx (hash BLOB, data BLOB, PRIMARY KEY(hash))",
+		"CREATE TABLE IF NOT EXISTS addrs (addr TEXT, services INTEGER, lastseen INTEGER, lastattempt INTEGER, success INTEGER, failure INTEGER, PRIMARY KEY(addr))",
+	},
+	// 2 : indexes
+	{
+		"CREATE INDEX IF NOT EXISTS mempool_time ON mempool (time)",
+		"CREATE INDEX IF NOT EXISTS forks_height ON forks (height)",
+	},
+	// 3 : cumulative chain work of the headers, it is filled by fillChainWork
+	{
+		"ALTER TABLE headers ADD COLUMN chainwork BLOB",
+	},
 }
 
 // NewData returns a new Data
@@ -33,44 +64,69 @@ func NewData(name, datadir string) (*Data, error) {
 	data := &Data{}
 	data.name = name
 	data.datadir = datadir
+	data.stmts = make(map[string]*sql.Stmt)
 	data.mutex = new(sync.Mutex)
-	err := data.init()
+	data.cache = newHeaderCache()
+	dataSourceName := fmt.Sprintf("file:%sheaders-%s.db?mode=rwc&_journal_mode=WAL&_busy_timeout=5000", datadir, name)
+	log.Printf("%s", dataSourceName)
+	db, err := sql.Open("sqlite3", dataSourceName)
+	if err != nil {
+		log.Printf("sql.Open Error : %+v", err)
+		return nil, err
+	}
+	data.db = db
+	err = data.migrate()
 	if err != nil {
-		log.Printf("data.init Error : %+v", err)
+		log.Printf("data.migrate Error : %+v", err)
+		db.Close()
+		return nil, err
+	}
+	err = data.fillChainWork()
+	if err != nil {
+		log.Printf("data.fillChainWork Error : %+v", err)
+		data.Close()
 		return nil, err
 	}
 	return data, nil
 }
 
-func (data *Data) init() error {
-	db, err := data.openDb()
-	defer data.closeDb(db)
+// Close closes the prepared statements and the database
+func (data *Data) Close() error {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	for _, stmt := range data.stmts {
+		stmt.Close()
+	}
+	data.stmts = make(map[string]*sql.Stmt)
+	return data.db.Close()
+}
+
+// migrate applies the migrations which are not applied yet
+func (data *Data) migrate() error {
+	var version int
+	err := data.db.QueryRow("PRAGMA user_version").Scan(&version)
 	if err != nil {
-		log.Printf("data.openDb Error : %+v", err)
+		log.Printf("db.QueryRow Error : %+v", err)
 		return err
 	}
-	tables := [][]string{
-		{"headers", "CREATE TABLE headers (hash BLOB, height INTEGER, data BLOB, PRIMARY KEY(hash), UNIQUE(height))"},
-		{"kvs", "CREATE TABLE kvs (key TEXT, val BLOB, PRIMARY KEY(key))"},
-		{"tx", "CREATE TABLE tx (hash BLOB, data BLOB, PRIMARY KEY(hash))"},
+	if version > len(migrations) {
+		return fmt.Errorf("unknown schema version : %d", version)
 	}
-	for _, table := range tables {
-		rows, err := db.Query("SELECT name FROM sqlite_master WHERE name = ?", table[0])
-		if err != nil {
-			log.Printf("db.Query Error : %+v", err)
-			return err
-		}
-		exist := rows.Next()
-		rows.Close()
-		if exist {
-			continue
-		}
-		tx, err := db.Begin()
+	for ; version < len(migrations); version++ {
+		tx, err := data.db.Begin()
 		if err != nil {
 			log.Printf("db.Begin Error : %+v", err)
 			return err
 		}
-		_, err = tx.Exec(table[1])
+		for _, query := range migrations[version] {
+			_, err = tx.Exec(query)
+			if err != nil {
+				tx.Rollback()
+				log.Printf("tx.Exec : %+v", err)
+				return err
+			}
+		}
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
 		if err != nil {
 			tx.Rollback()
 			log.Printf("tx.Exec : %+v", err)
@@ -81,30 +137,63 @@ func (data *Data) init() error {
 			log.Printf("tx.Commit Error : %+v", err)
 			return err
 		}
+		log.Printf("schema version : %d", version+1)
 	}
 	return nil
 }
 
-func (data *Data) openDb() (*sql.DB, error) {
+// prepare returns the prepared statement of the query
+func (data *Data) prepare(query string) (*sql.Stmt, error) {
 	data.mutex.Lock()
-	dataSourceName := fmt.Sprintf("file:%sheaders-%s.db?cache=shared&mode=rwc", data.datadir, data.name)
-	log.Printf("%s", dataSourceName)
-	db, err := sql.Open("sqlite3", dataSourceName)
+	defer data.mutex.Unlock()
+	stmt, ok := data.stmts[query]
+	if ok {
+		return stmt, nil
+	}
+	stmt, err := data.db.Prepare(query)
 	if err != nil {
-		log.Printf("sql.Open Error : %+v", err)
+		log.Printf("db.Prepare Error : %+v", err)
 		return nil, err
 	}
-	return db, nil
+	data.stmts[query] = stmt
+	return stmt, nil
 }
 
-func (data *Data) closeDb(db *sql.DB) {
-	if db != nil {
-		err := db.Close()
-		if err != nil {
-			log.Printf("db.Close Error : %+v", err)
-		}
+// exec executes the prepared statement in the transaction
+func (data *Data) exec(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := data.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Stmt(stmt).Exec(args...)
+}
+
+// queryRowTx queries the row with the prepared statement in the transaction
+func (data *Data) queryRowTx(tx *sql.Tx, query string, args ...interface{}) *sql.Row {
+	stmt, err := data.prepare(query)
+	if err != nil {
+		return tx.QueryRow(query, args...)
+	}
+	return tx.Stmt(stmt).QueryRow(args...)
+}
+
+// queryRow queries the row with the prepared statement
+// if the statement cannot be prepared, the error is returned by Scan
+func (data *Data) queryRow(query string, args ...interface{}) *sql.Row {
+	stmt, err := data.prepare(query)
+	if err != nil {
+		return data.db.QueryRow(query, args...)
 	}
-	data.mutex.Unlock()
+	return stmt.QueryRow(args...)
+}
+
+// query queries the rows with the prepared statement
+func (data *Data) query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := data.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
 }
 
 // KVS
@@ -120,7 +209,7 @@ func (data *Data) PutInt(key string, i int) error {
 
 // GetInt gets number by key
 func (data *Data) GetInt(key string, defaultInt int) (int, error) {
-	bs, err := data.get(nil, key)
+	bs, err := data.get(key)
 	if err != nil {
 		log.Printf("data.get Error : %+v", err)
 		return defaultInt, err
@@ -135,13 +224,7 @@ func (data *Data) GetInt(key string, defaultInt int) (int, error) {
 
 // Del delete key
 func (data *Data) Del(key string) error {
-	db, err := data.openDb()
-	defer data.closeDb(db)
-	if err != nil {
-		log.Printf("data.openDb Error : %+v", err)
-		return err
-	}
-	bs, err := data.get(db, key)
+	bs, err := data.get(key)
 	if err != nil {
 		log.Printf("data.get Error : %+v", err)
 		return err
@@ -149,12 +232,12 @@ func (data *Data) Del(key string) error {
 	if bs == nil {
 		return nil
 	}
-	tx, err := db.Begin()
+	tx, err := data.db.Begin()
 	if err != nil {
 		log.Printf("db.Begin Error : %+v", err)
 		return err
 	}
-	_, err = tx.Exec("DELETE FROM kvs WHERE key=?", key)
+	_, err = data.exec(tx, "DELETE FROM kvs WHERE key=?", key)
 	if err != nil {
 		tx.Rollback()
 		log.Printf("tx.Exec : %+v", err)
@@ -169,18 +252,12 @@ func (data *Data) Del(key string) error {
 }
 
 func (data *Data) Put(key string, val []byte) error {
-	db, err := data.openDb()
-	defer data.closeDb(db)
-	if err != nil {
-		log.Printf("data.openDb Error : %+v", err)
-		return err
-	}
-	tx, err := db.Begin()
+	tx, err := data.db.Begin()
 	if err != nil {
 		log.Printf("db.Begin Error : %+v", err)
 		return err
 	}
-	_, err = tx.Exec("INSERT OR REPLACE INTO kvs (key,val) VALUES (?,?)", key, val)
+	_, err = data.exec(tx, "INSERT OR REPLACE INTO kvs (key,val) VALUES (?,?)", key, val)
 	if err != nil {
 		tx.Rollback()
 		log.Printf("tx.Exec : %+v", err)
@@ -195,21 +272,12 @@ func (data *Data) Put(key string, val []byte) error {
 }
 
 func (data *Data) Get(key string) ([]byte, error) {
-	return data.get(nil, key)
+	return data.get(key)
 }
 
-func (data *Data) get(db *sql.DB, key string) ([]byte, error) {
-	var err error
-	if db == nil {
-		db, err = data.openDb()
-		defer data.closeDb(db)
-		if err != nil {
-			log.Printf("data.openDb Error : %+v", err)
-			return nil, err
-		}
-	}
+func (data *Data) get(key string) ([]byte, error) {
 	var val []byte
-	err = db.QueryRow("SELECT val FROM kvs WHERE key=?", key).Scan(&val)
+	err := data.queryRow("SELECT val FROM kvs WHERE key=?", key).Scan(&val)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -233,17 +301,12 @@ func (data *Data) GetHeaderByHeight(height int) (*wire.BlockHeader, int, error)
 }
 
 func (data *Data) getHeader(hash []byte, height int) (*wire.BlockHeader, int, error) {
-	db, err := data.openDb()
-	defer data.closeDb(db)
-	if err != nil {
-		log.Printf("data.openDb Error : %+v", err)
-		return nil, -1, err
-	}
 	var bs []byte
+	var err error
 	if hash != nil {
-		err = db.QueryRow("SELECT height, data FROM headers WHERE hash=?", hash).Scan(&height, &bs)
+		err = data.queryRow("SELECT height, data FROM headers WHERE hash=?", hash).Scan(&height, &bs)
 	} else {
-		err = db.QueryRow("SELECT data FROM headers WHERE height=?", height).Scan(&bs)
+		err = data.queryRow("SELECT data FROM headers WHERE height=?", height).Scan(&bs)
 	}
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -262,21 +325,22 @@ func (data *Data) getHeader(hash []byte, height int) (*wire.BlockHeader, int, er
 
 // PutHeaders puts headers
 func (data *Data) PutHeaders(headers []*wire.BlockHeader, startHeight int) error {
-	db, err := data.openDb()
-	defer data.closeDb(db)
+	tx, err := data.db.Begin()
 	if err != nil {
-		log.Printf("data.openDb Error : %+v", err)
+		log.Printf("db.Begin Error : %+v", err)
 		return err
 	}
-	tx, err := db.Begin()
+	work, err := data.getChainWork(tx, startHeight-1)
 	if err != nil {
-		log.Printf("db.Begin Error : %+v", err)
+		tx.Rollback()
+		log.Printf("data.getChainWork Error : %+v", err)
 		return err
 	}
 	for i, header := range headers {
 		hash := header.BlockHash()
 		bs := data.serialize(header)
-		_, err := tx.Exec("INSERT INTO headers (hash,height,data) VALUES (?,?,?)", hash.CloneBytes(), startHeight+i, bs)
+		work = addWork(work, header)
+		_, err := data.exec(tx, "INSERT INTO headers (hash,height,data,chainwork) VALUES (?,?,?,?)", hash.CloneBytes(), startHeight+i, bs, work.Bytes())
 		if err != nil {
 			tx.Rollback()
 			log.Printf("tx.Exec : %+v", err)
@@ -289,35 +353,389 @@ func (data *Data) PutHeaders(headers []*wire.BlockHeader, startHeight int) error
 		log.Printf("tx.Commit Error : %+v", err)
 		return err
 	}
+	data.cache.update(headers, startHeight)
 	return nil
 }
 
-// GetMinMaxHeight gets count, max and min height
-// if count is zero, max and min is -1
-func (data *Data) GetCntMinMaxHeight() (int, int, int, error) {
-	db, err := data.openDb()
-	defer data.closeDb(db)
+// GetTip gets the header and the height of the tip
+// if there is no header, it returns nil and -1
+func (data *Data) GetTip() (*wire.BlockHeader, int, error) {
+	cnt, _, max, tip, err := data.cache.get(data.loadHeaderCache)
+	if err != nil || cnt == 0 {
+		return nil, -1, err
+	}
+	return tip, max, nil
+}
+
+// GetHeadersByHeight gets the headers from startHeight to endHeight
+// it returns the stored headers in the range and the height of the first header
+func (data *Data) GetHeadersByHeight(startHeight, endHeight int) ([]*wire.BlockHeader, int, error) {
+	rows, err := data.query("SELECT height, data FROM headers WHERE height>=? AND height<=? ORDER BY height", startHeight, endHeight)
+	if err != nil {
+		log.Printf("db.Query Error : %+v", err)
+		return nil, -1, err
+	}
+	defer rows.Close()
+	var headers []*wire.BlockHeader
+	first := -1
+	for rows.Next() {
+		var height int
+		var bs []byte
+		err = rows.Scan(&height, &bs)
+		if err != nil {
+			log.Printf("rows.Scan Error : %+v", err)
+			return nil, -1, err
+		}
+		header, err := data.deserialize(bs)
+		if err != nil {
+			log.Printf("data.deserialize Error : %+v", err)
+			return nil, -1, err
+		}
+		if first < 0 {
+			first = height
+		}
+		headers = append(headers, header)
+	}
+	return headers, first, rows.Err()
+}
+
+// GetAncestors gets the header of the hash and its previous headers from the lowest
+// at most count headers are returned, with the height of the first header
+func (data *Data) GetAncestors(hash chainhash.Hash, count int) ([]*wire.BlockHeader, int, error) {
+	return getAncestors(data, hash, count)
+}
+
+// GetChainWork gets the chain work of the header at the height
+// if the header is not found, it returns nil
+func (data *Data) GetChainWork(height int) (*big.Int, error) {
+	var bs []byte
+	err := data.queryRow("SELECT chainwork FROM headers WHERE height=?", height).Scan(&bs)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Printf("db.QueryRow Error : %+v", err)
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bs), nil
+}
+
+// getChainWork gets the chain work at the height in the transaction
+// if the header is not found, it returns zero
+func (data *Data) getChainWork(tx *sql.Tx, height int) (*big.Int, error) {
+	var bs []byte
+	err := data.queryRowTx(tx, "SELECT chainwork FROM headers WHERE height=?", height).Scan(&bs)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return big.NewInt(0), nil
+		}
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bs), nil
+}
+
+// fillChainWork fills the chain work of the headers stored before the chainwork column is added
+func (data *Data) fillChainWork() error {
+	var start sql.NullInt64
+	err := data.db.QueryRow("SELECT MIN(height) FROM headers WHERE chainwork IS NULL").Scan(&start)
+	if err != nil {
+		log.Printf("db.QueryRow Error : %+v", err)
+		return err
+	}
+	if !start.Valid {
+		return nil
+	}
+	log.Printf("fill chain work from : %d", start.Int64)
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
+		return err
+	}
+	work, err := data.getChainWork(tx, int(start.Int64)-1)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("data.getChainWork Error : %+v", err)
+		return err
+	}
+	rows, err := tx.Query("SELECT height, data FROM headers WHERE height>=? ORDER BY height", start.Int64)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Query Error : %+v", err)
+		return err
+	}
+	works := make(map[int][]byte)
+	for rows.Next() {
+		var height int
+		var bs []byte
+		err = rows.Scan(&height, &bs)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			log.Printf("rows.Scan Error : %+v", err)
+			return err
+		}
+		header, err := data.deserialize(bs)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			log.Printf("data.deserialize Error : %+v", err)
+			return err
+		}
+		work = addWork(work, header)
+		works[height] = work.Bytes()
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		tx.Rollback()
+		log.Printf("rows.Err Error : %+v", err)
+		return err
+	}
+	for height, bs := range works {
+		_, err = tx.Exec("UPDATE headers SET chainwork=? WHERE height=?", bs, height)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("tx.Exec : %+v", err)
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// GetForkHeader gets header of the side branch by hash
+func (data *Data) GetForkHeader(hash chainhash.Hash) (*wire.BlockHeader, int, error) {
+	var height int
+	var bs []byte
+	err := data.queryRow("SELECT height, data FROM forks WHERE hash=?", hash.CloneBytes()).Scan(&height, &bs)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, -1, nil
+		}
+		log.Printf("db.QueryRow Error : %+v", err)
+		return nil, -1, err
+	}
+	header, err := data.deserialize(bs)
+	if err != nil {
+		log.Printf("data.deserialize Error : %+v", err)
+		return nil, -1, err
+	}
+	return header, height, nil
+}
+
+// PutForkHeaders puts headers of the side branch
+func (data *Data) PutForkHeaders(headers []*wire.BlockHeader, startHeight int) error {
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
+		return err
+	}
+	for i, header := range headers {
+		hash := header.BlockHash()
+		bs := data.serialize(header)
+		_, err := data.exec(tx, "INSERT OR IGNORE INTO forks (hash,height,data) VALUES (?,?,?)", hash.CloneBytes(), startHeight+i, bs)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("tx.Exec : %+v", err)
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// Reorg replaces headers from startHeight with the headers of the side branch
+// the replaced headers are moved to the side branch
+func (data *Data) Reorg(headers []*wire.BlockHeader, startHeight int) error {
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
+		return err
+	}
+	work, err := data.getChainWork(tx, startHeight-1)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("data.getChainWork Error : %+v", err)
+		return err
+	}
+	_, err = data.exec(tx, "INSERT OR IGNORE INTO forks (hash,height,data) SELECT hash,height,data FROM headers WHERE height>=?", startHeight)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	_, err = data.exec(tx, "DELETE FROM headers WHERE height>=?", startHeight)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	_, err = data.exec(tx, "DELETE FROM cfheaders WHERE height>=?", startHeight)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	for i, header := range headers {
+		hash := header.BlockHash()
+		bs := data.serialize(header)
+		work = addWork(work, header)
+		_, err := data.exec(tx, "INSERT INTO headers (hash,height,data,chainwork) VALUES (?,?,?,?)", hash.CloneBytes(), startHeight+i, bs, work.Bytes())
+		if err != nil {
+			tx.Rollback()
+			log.Printf("tx.Exec : %+v", err)
+			return err
+		}
+		_, err = data.exec(tx, "DELETE FROM forks WHERE hash=?", hash.CloneBytes())
+		if err != nil {
+			tx.Rollback()
+			log.Printf("tx.Exec : %+v", err)
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	data.cache.update(headers, startHeight)
+	return nil
+}
+
+// ReorgForks moves the replaced headers to the side branch, and removes the headers of the new branch from it
+// and the filter headers from startHeight, it is used by FlatData which stores the main chain headers by itself
+func (data *Data) ReorgForks(replaced, headers []*wire.BlockHeader, startHeight int) error {
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
+		return err
+	}
+	_, err = data.exec(tx, "DELETE FROM cfheaders WHERE height>=?", startHeight)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	for i, header := range replaced {
+		hash := header.BlockHash()
+		bs := data.serialize(header)
+		_, err := data.exec(tx, "INSERT OR IGNORE INTO forks (hash,height,data) VALUES (?,?,?)", hash.CloneBytes(), startHeight+i, bs)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("tx.Exec : %+v", err)
+			return err
+		}
+	}
+	for _, header := range headers {
+		hash := header.BlockHash()
+		_, err := data.exec(tx, "DELETE FROM forks WHERE hash=?", hash.CloneBytes())
+		if err != nil {
+			tx.Rollback()
+			log.Printf("tx.Exec : %+v", err)
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// Filter header
+
+// PutCFHeaders puts filter headers
+func (data *Data) PutCFHeaders(cfheaders []chainhash.Hash, startHeight int) error {
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
+		return err
+	}
+	for i, cfheader := range cfheaders {
+		_, err := data.exec(tx, "INSERT OR REPLACE INTO cfheaders (height,header) VALUES (?,?)", startHeight+i, cfheader.CloneBytes())
+		if err != nil {
+			tx.Rollback()
+			log.Printf("tx.Exec : %+v", err)
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// GetCFHeader gets filter header by height
+func (data *Data) GetCFHeader(height int) (*chainhash.Hash, error) {
+	var bs []byte
+	err := data.queryRow("SELECT header FROM cfheaders WHERE height=?", height).Scan(&bs)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Printf("db.QueryRow Error : %+v", err)
+		return nil, err
+	}
+	return chainhash.NewHash(bs)
+}
+
+// GetCFHeaderTip gets the max height of filter headers
+// if there is no filter header, it returns -1
+func (data *Data) GetCFHeaderTip() (int, error) {
+	var max sql.NullInt64
+	err := data.queryRow("SELECT MAX(height) FROM cfheaders").Scan(&max)
 	if err != nil {
-		log.Printf("data.openDb Error : %+v", err)
-		return -1, -1, -1, err
+		log.Printf("db.QueryRow Error : %+v", err)
+		return -1, err
+	}
+	if !max.Valid {
+		return -1, nil
 	}
+	return int(max.Int64), nil
+}
+
+// GetCntMinMaxHeight gets count, max and min height
+// if count is zero, max and min is -1
+func (data *Data) GetCntMinMaxHeight() (int, int, int, error) {
+	cnt, min, max, _, err := data.cache.get(data.loadHeaderCache)
+	return cnt, min, max, err
+}
+
+// loadHeaderCache queries count, min height, max height and the tip
+func (data *Data) loadHeaderCache() (int, int, int, *wire.BlockHeader, error) {
 	var cnt int
-	err = db.QueryRow("SELECT COUNT(hash) FROM headers").Scan(&cnt)
+	err := data.queryRow("SELECT COUNT(hash) FROM headers").Scan(&cnt)
 	if err != nil {
 		log.Printf("db.QueryRow Error : %+v", err)
-		return -1, -1, -1, err
+		return -1, -1, -1, nil, err
 	}
 	if cnt == 0 {
-		return cnt, -1, -1, nil
+		return cnt, -1, -1, nil, nil
 	}
 	var max int
 	var min int
-	err = db.QueryRow("SELECT MIN(height), MAX(height) FROM headers").Scan(&min, &max)
+	err = data.queryRow("SELECT MIN(height), MAX(height) FROM headers").Scan(&min, &max)
 	if err != nil {
 		log.Printf("db.QueryRow Error : %+v", err)
-		return -1, -1, -1, err
+		return -1, -1, -1, nil, err
 	}
-	return cnt, min, max, nil
+	tip, _, err := data.GetHeaderByHeight(max)
+	if err != nil {
+		log.Printf("data.GetHeaderByHeight Error : %+v", err)
+		return -1, -1, -1, nil, err
+	}
+	return cnt, min, max, tip, nil
 }
 
 func (data *Data) serialize(header *wire.BlockHeader) []byte {
@@ -349,24 +767,18 @@ func (data *Data) deserialize(bs []byte) (*wire.BlockHeader, error) {
 
 // PutTx puts MsgTx
 func (data *Data) PutTx(msgTx *wire.MsgTx) error {
-	db, err := data.openDb()
-	defer data.closeDb(db)
-	if err != nil {
-		log.Printf("data.openDb Error : %+v", err)
-		return err
-	}
 	hash := msgTx.TxHash()
 	bs, err := data.msgTxToBs(msgTx)
 	if err != nil {
 		log.Printf("data.msgTxToBs Error : %+v", err)
 		return err
 	}
-	tx, err := db.Begin()
+	tx, err := data.db.Begin()
 	if err != nil {
 		log.Printf("db.Begin Error : %+v", err)
 		return err
 	}
-	_, err = tx.Exec("INSERT INTO tx (hash,data) VALUES (?,?)", hash.CloneBytes(), bs)
+	_, err = data.exec(tx, "INSERT OR REPLACE INTO tx (hash,data) VALUES (?,?)", hash.CloneBytes(), bs)
 	if err != nil {
 		tx.Rollback()
 		log.Printf("tx.Exec : %+v", err)
@@ -382,14 +794,8 @@ func (data *Data) PutTx(msgTx *wire.MsgTx) error {
 
 // GetTx gets MsgTx by hash
 func (data *Data) GetTx(hash chainhash.Hash) (*wire.MsgTx, error) {
-	db, err := data.openDb()
-	defer data.closeDb(db)
-	if err != nil {
-		log.Printf("data.openDb Error : %+v", err)
-		return nil, err
-	}
 	var bs []byte
-	err = db.QueryRow("SELECT data FROM tx WHERE hash=?", hash.CloneBytes()).Scan(&bs)
+	err := data.queryRow("SELECT data FROM tx WHERE hash=?", hash.CloneBytes()).Scan(&bs)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -407,40 +813,296 @@ func (data *Data) GetTx(hash chainhash.Hash) (*wire.MsgTx, error) {
 
 // ListTxHash gets transaction hashes
 func (data *Data) ListTxHash() ([]chainhash.Hash, error) {
-	db, err := data.openDb()
-	defer data.closeDb(db)
-	if err != nil {
-		log.Printf("data.openDb Error : %+v", err)
-		return nil, err
-	}
-	rows, err := db.Query("SELECT hash FROM tx")
+	rows, err := data.query("SELECT hash FROM tx")
 	if err != nil {
 		log.Printf("db.Query Error : %+v", err)
 		return nil, err
 	}
+	defer rows.Close()
 	var list []chainhash.Hash
 	for rows.Next() {
-		var hash chainhash.Hash
-		rows.Scan(&hash)
-		list = append(list, hash)
+		var bs []byte
+		err = rows.Scan(&bs)
+		if err != nil {
+			log.Printf("rows.Scan Error : %+v", err)
+			return nil, err
+		}
+		hash, err := chainhash.NewHash(bs)
+		if err != nil {
+			log.Printf("chainhash.NewHash Error : %+v", err)
+			return nil, err
+		}
+		list = append(list, *hash)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("rows.Err Error : %+v", err)
+		return nil, err
 	}
 	return list, nil
 }
 
 // DelTx delete MsgTx by hash
 func (data *Data) DelTx(hash chainhash.Hash) error {
-	db, err := data.openDb()
-	defer data.closeDb(db)
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
+		return err
+	}
+	_, err = data.exec(tx, "DELETE FROM tx WHERE hash=?", hash.CloneBytes())
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// Addr
+
+// AddrInfo is address book entry type
+type AddrInfo struct {
+	Addr        string
+	Services    uint64
+	LastSeen    int64
+	LastAttempt int64
+	Success     int
+	Failure     int
+}
+
+// PutAddr puts address, if the address exists, it updates services and last seen
+func (data *Data) PutAddr(addr string, services uint64, lastSeen int64) error {
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
+		return err
+	}
+	_, err = data.exec(tx, "INSERT OR IGNORE INTO addrs (addr,services,lastseen,lastattempt,success,failure) VALUES (?,?,?,0,0,0)", addr, int64(services), lastSeen)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	_, err = data.exec(tx, "UPDATE addrs SET services=?, lastseen=? WHERE addr=? AND lastseen<?", int64(services), lastSeen, addr, lastSeen)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	err = tx.Commit()
 	if err != nil {
-		log.Printf("data.openDb Error : %+v", err)
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// MarkAddr records the result of the connection attempt to the address
+func (data *Data) MarkAddr(addr string, success bool, attempt int64) error {
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
 		return err
 	}
-	tx, err := db.Begin()
+	_, err = data.exec(tx, "INSERT OR IGNORE INTO addrs (addr,services,lastseen,lastattempt,success,failure) VALUES (?,0,0,0,0,0)", addr)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	if success {
+		_, err = data.exec(tx, "UPDATE addrs SET success=success+1, lastattempt=?, lastseen=? WHERE addr=?", attempt, attempt, addr)
+	} else {
+		_, err = data.exec(tx, "UPDATE addrs SET failure=failure+1, lastattempt=? WHERE addr=?", attempt, addr)
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// ListAddrs gets addresses ordered by score (success - failure) and last seen
+// addresses attempted after lastAttempt are excluded
+func (data *Data) ListAddrs(lastAttempt int64, limit int) ([]*AddrInfo, error) {
+	rows, err := data.query("SELECT addr, services, lastseen, lastattempt, success, failure FROM addrs WHERE lastattempt<=? ORDER BY success-failure DESC, lastseen DESC LIMIT ?", lastAttempt, limit)
+	if err != nil {
+		log.Printf("db.Query Error : %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*AddrInfo
+	for rows.Next() {
+		info := &AddrInfo{}
+		var services int64
+		err = rows.Scan(&info.Addr, &services, &info.LastSeen, &info.LastAttempt, &info.Success, &info.Failure)
+		if err != nil {
+			log.Printf("rows.Scan Error : %+v", err)
+			return nil, err
+		}
+		info.Services = uint64(services)
+		list = append(list, info)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("rows.Err Error : %+v", err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// CountAddrs gets the number of addresses
+func (data *Data) CountAddrs() (int, error) {
+	var cnt int
+	err := data.queryRow("SELECT COUNT(addr) FROM addrs").Scan(&cnt)
+	if err != nil {
+		log.Printf("db.QueryRow Error : %+v", err)
+		return -1, err
+	}
+	return cnt, nil
+}
+
+// TrimAddrs deletes the addresses with the lowest score and the oldest last seen over max
+func (data *Data) TrimAddrs(max int) error {
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
+		return err
+	}
+	_, err = data.exec(tx, "DELETE FROM addrs WHERE addr NOT IN (SELECT addr FROM addrs ORDER BY success-failure DESC, lastseen DESC LIMIT ?)", max)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// PutTxStatus puts the broadcast status of MsgTx
+func (data *Data) PutTxStatus(hash chainhash.Hash, status int, updated int64, reason string) error {
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
+		return err
+	}
+	_, err = data.exec(tx, "INSERT OR REPLACE INTO txstatus (hash,status,updated,reason) VALUES (?,?,?,?)", hash.CloneBytes(), status, updated, reason)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// GetTxStatus gets the broadcast status of MsgTx by hash
+// if the status is not found, status is -1
+func (data *Data) GetTxStatus(hash chainhash.Hash) (int, int64, string, error) {
+	var status int
+	var updated int64
+	var reason string
+	err := data.queryRow("SELECT status, updated, reason FROM txstatus WHERE hash=?", hash.CloneBytes()).Scan(&status, &updated, &reason)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return -1, 0, "", nil
+		}
+		log.Printf("db.QueryRow Error : %+v", err)
+		return -1, 0, "", err
+	}
+	return status, updated, reason, nil
+}
+
+// Mempool
+
+// PutMempoolTx puts unconfirmed MsgTx with the received time
+func (data *Data) PutMempoolTx(msgTx *wire.MsgTx, t int64) error {
+	hash := msgTx.TxHash()
+	bs, err := data.msgTxToBs(msgTx)
+	if err != nil {
+		log.Printf("data.msgTxToBs Error : %+v", err)
+		return err
+	}
+	tx, err := data.db.Begin()
+	if err != nil {
+		log.Printf("db.Begin Error : %+v", err)
+		return err
+	}
+	_, err = data.exec(tx, "INSERT OR REPLACE INTO mempool (hash,data,time) VALUES (?,?,?)", hash.CloneBytes(), bs, t)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("tx.Exec : %+v", err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("tx.Commit Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// ListMempoolTx gets unconfirmed MsgTxs and the received times
+func (data *Data) ListMempoolTx() ([]*wire.MsgTx, []int64, error) {
+	rows, err := data.query("SELECT data, time FROM mempool ORDER BY time")
+	if err != nil {
+		log.Printf("db.Query Error : %+v", err)
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var txs []*wire.MsgTx
+	var times []int64
+	for rows.Next() {
+		var bs []byte
+		var t int64
+		err = rows.Scan(&bs, &t)
+		if err != nil {
+			log.Printf("rows.Scan Error : %+v", err)
+			return nil, nil, err
+		}
+		tx, err := data.bsToMsgTx(bs)
+		if err != nil {
+			log.Printf("data.bsToMsgTx Error : %+v", err)
+			return nil, nil, err
+		}
+		txs = append(txs, tx)
+		times = append(times, t)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("rows.Err Error : %+v", err)
+		return nil, nil, err
+	}
+	return txs, times, nil
+}
+
+// DelMempoolTx delete unconfirmed MsgTx by hash
+func (data *Data) DelMempoolTx(hash chainhash.Hash) error {
+	tx, err := data.db.Begin()
 	if err != nil {
 		log.Printf("db.Begin Error : %+v", err)
 		return err
 	}
-	_, err = tx.Exec("DELETE FROM tx WHERE hash=?", hash.CloneBytes())
+	_, err = data.exec(tx, "DELETE FROM mempool WHERE hash=?", hash.CloneBytes())
 	if err != nil {
 		tx.Rollback()
 		log.Printf("tx.Exec : %+v", err)
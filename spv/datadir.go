@@ -0,0 +1,126 @@
+// Package spv project datadir.go
+package spv
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// LockFileName is the name of the lock file in the chain directory
+const LockFileName = "spv.lock"
+
+// ErrDataDirLocked is returned by NewSpv when the chain directory is used by another process
+var ErrDataDirLocked = errors.New("data directory is used by another process")
+
+// DefaultDataDir returns $XDG_DATA_HOME/sbc, or ~/.local/share/sbc if XDG_DATA_HOME is not set
+func DefaultDataDir() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Printf("os.UserHomeDir Error : %+v", err)
+			home = "."
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "sbc")
+}
+
+// LegacyDataDir returns the data directory of the old versions, the "data" directory next to the binary
+// the chain data of all networks was stored in it directly
+func LegacyDataDir() string {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		log.Printf("filepath.Abs Error : %+v", err)
+		return ""
+	}
+	return filepath.Join(dir, "data")
+}
+
+// migrateLegacyData moves the chain data of the network in the legacy data directory to the chain directory
+// it is done only if the chain directory has no chain data of the network,
+// if the files can not be moved, it logs a warning to move them manually
+func migrateLegacyData(legacy, dir, name string) {
+	if legacy == "" || legacy == dir {
+		return
+	}
+	pattern := "headers-" + name + ".*"
+	files, err := filepath.Glob(filepath.Join(legacy, pattern))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	current, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		log.Printf("filepath.Glob Error : %+v", err)
+		return
+	}
+	if len(current) > 0 {
+		log.Printf("WARNING : the legacy data directory %s is ignored, %s already has the chain data", legacy, dir)
+		return
+	}
+	err = moveFiles(files, dir)
+	if err != nil {
+		log.Printf("moveFiles Error : %+v", err)
+		log.Printf("WARNING : the chain data in the legacy data directory %s is not used, "+
+			"move %s to %s, or pass -datadir to use another data directory", legacy, pattern, dir)
+		return
+	}
+	log.Printf("moved the chain data from the legacy data directory %s to %s", legacy, dir)
+}
+
+// moveFiles moves the files to the directory as a group
+// the database must be moved with its -wal and -shm files, so if a file can not be moved, the moved files are moved back
+func moveFiles(files []string, dir string) error {
+	for i, file := range files {
+		err := os.Rename(file, filepath.Join(dir, filepath.Base(file)))
+		if err == nil {
+			continue
+		}
+		for _, moved := range files[:i] {
+			rerr := os.Rename(filepath.Join(dir, filepath.Base(moved)), moved)
+			if rerr != nil {
+				log.Printf("os.Rename Error : %+v", rerr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// NetworkDir returns the directory of the network in the data directory
+// chain data is stored in its "chain" subdirectory, other data such as the wallet should use its own subdirectory
+func NetworkDir(dataDir, network string) string {
+	return filepath.Join(dataDir, network)
+}
+
+// chainDir returns the directory of the chain data
+func chainDir(dataDir, network string) string {
+	return filepath.Join(NetworkDir(dataDir, network), "chain")
+}
+
+// dirLock is the lock of the directory
+type dirLock struct {
+	path string
+	file *os.File
+}
+
+// lockDir locks the directory with the lock file
+// if the directory is locked by another process, it returns ErrDataDirLocked
+func lockDir(dir string) (*dirLock, error) {
+	lock := &dirLock{}
+	lock.path = filepath.Join(dir, LockFileName)
+	file, err := lockFile(lock.path)
+	if err != nil {
+		log.Printf("lockFile Error : %+v", err)
+		return nil, err
+	}
+	lock.file = file
+	return lock, nil
+}
+
+// unlock unlocks the directory
+func (lock *dirLock) unlock() error {
+	return unlockFile(lock.file, lock.path)
+}
@@ -0,0 +1,118 @@
+// Package spv project datadir_test.go
+package spv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func TestLockDir(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := lockDir(dir)
+	if err != nil {
+		t.Fatalf("lockDir Error : %+v", err)
+	}
+	_, err = lockDir(dir)
+	if err != ErrDataDirLocked {
+		t.Fatalf("locked directory is locked again : %+v", err)
+	}
+	err = lock.unlock()
+	if err != nil {
+		t.Fatalf("lock.unlock Error : %+v", err)
+	}
+	lock, err = lockDir(dir)
+	if err != nil {
+		t.Fatalf("lockDir after unlock Error : %+v", err)
+	}
+	lock.unlock()
+}
+
+func TestMigrateLegacyData(t *testing.T) {
+	legacy := t.TempDir()
+	dir := t.TempDir()
+	for _, name := range []string{"headers-regtest.db", "headers-regtest.db-wal", "headers-testnet3.db"} {
+		err := ioutil.WriteFile(filepath.Join(legacy, name), []byte(name), 0600)
+		if err != nil {
+			t.Fatalf("ioutil.WriteFile Error : %+v", err)
+		}
+	}
+	migrateLegacyData(legacy, dir, "regtest")
+	for _, name := range []string{"headers-regtest.db", "headers-regtest.db-wal"} {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(bs) != name {
+			t.Fatalf("%s is not moved : %+v", name, err)
+		}
+		if _, err = os.Stat(filepath.Join(legacy, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s is left in the legacy directory", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(legacy, "headers-testnet3.db")); err != nil {
+		t.Fatalf("the data of another network is moved : %+v", err)
+	}
+	// the chain data is not overwritten
+	err := ioutil.WriteFile(filepath.Join(legacy, "headers-regtest.db"), []byte("old"), 0600)
+	if err != nil {
+		t.Fatalf("ioutil.WriteFile Error : %+v", err)
+	}
+	migrateLegacyData(legacy, dir, "regtest")
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "headers-regtest.db"))
+	if err != nil || string(bs) != "headers-regtest.db" {
+		t.Fatalf("chain data is overwritten : %s %+v", bs, err)
+	}
+}
+
+func TestMoveFilesRollback(t *testing.T) {
+	legacy := t.TempDir()
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"headers-regtest.db", "headers-regtest.db-shm", "headers-regtest.db-wal"} {
+		file := filepath.Join(legacy, name)
+		files = append(files, file)
+		if name == "headers-regtest.db-shm" {
+			continue
+		}
+		err := ioutil.WriteFile(file, []byte(name), 0600)
+		if err != nil {
+			t.Fatalf("ioutil.WriteFile Error : %+v", err)
+		}
+	}
+	// the -shm file is not found, so the moved database is moved back
+	err := moveFiles(files, dir)
+	if err == nil {
+		t.Fatalf("missing file is moved")
+	}
+	for _, name := range []string{"headers-regtest.db", "headers-regtest.db-wal"} {
+		bs, err := ioutil.ReadFile(filepath.Join(legacy, name))
+		if err != nil || string(bs) != name {
+			t.Fatalf("%s is not in the legacy directory : %+v", name, err)
+		}
+	}
+	moved, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil || len(moved) != 0 {
+		t.Fatalf("files are left in the chain directory : %v %+v", moved, err)
+	}
+}
+
+func TestNewSpvMemoryBackend(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "data")
+	for i := 0; i < 2; i++ {
+		config := NewConfig()
+		config.Backend = BackendMemory
+		config.DataDir = dataDir
+		spv, err := NewSpv(chaincfg.RegressionNetParams, config)
+		if err != nil {
+			t.Fatalf("NewSpv Error : %+v", err)
+		}
+		defer spv.Stop()
+		if spv.lock != nil {
+			t.Fatalf("data directory is locked")
+		}
+	}
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		t.Fatalf("data directory is created : %+v", err)
+	}
+}
@@ -0,0 +1,153 @@
+// Package spv project download.go
+package spv
+
+import (
+	"log"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// block download settings, the blocks are downloaded in parallel only in SyncModeBlock
+const (
+	BlockDownloadWindow  = 16
+	BlockDownloadTimeout = 30 * time.Second
+)
+
+// blockRequest is in-flight block request type
+type blockRequest struct {
+	hash    chainhash.Hash
+	height  int
+	peer    *Peer
+	time    time.Time
+	block   *wire.MsgBlock
+	merkles []*chainhash.Hash
+}
+
+// fillDownloads requests blocks from the check height up to the window
+func (spv *Spv) fillDownloads() {
+	spv.downloadMutex.Lock()
+	defer spv.downloadMutex.Unlock()
+	for height := spv.checkHeight; height < spv.checkHeight+BlockDownloadWindow; height++ {
+		if _, ok := spv.downloads[height]; ok {
+			continue
+		}
+		header, _, err := spv.data.GetHeaderByHeight(height)
+		if err != nil {
+			log.Printf("spv.data.GetHeaderByHeight Error : %+v", err)
+			spv.errBlock = true
+			return
+		}
+		if header == nil {
+			return
+		}
+		req := &blockRequest{}
+		req.hash = header.BlockHash()
+		req.height = height
+		if !spv.sendBlockRequest(req, nil) {
+			spv.errBlock = true
+			return
+		}
+		spv.downloads[height] = req
+	}
+}
+
+// sendBlockRequest sends getdata to the peer with the fewest in-flight requests
+// downloadMutex must be locked
+func (spv *Spv) sendBlockRequest(req *blockRequest, except *Peer) bool {
+	peer := spv.downloadPeer(req.height, except)
+	if peer == nil {
+		log.Printf("no peer to request block %d", req.height)
+		return false
+	}
+	msg := wire.NewMsgGetData()
+	inv := wire.NewInvVect(spv.blockInvType(peer), &req.hash)
+	msg.AddInvVect(inv)
+	peer.sendMsg(msg)
+	req.peer = peer
+	req.time = time.Now()
+	return true
+}
+
+// downloadPeer returns the ready peer which has the block and the fewest in-flight requests
+// downloadMutex must be locked
+func (spv *Spv) downloadPeer(height int, except *Peer) *Peer {
+	inflight := make(map[*Peer]int)
+	for _, req := range spv.downloads {
+		if req.block == nil {
+			inflight[req.peer]++
+		}
+	}
+	var best *Peer
+	for _, peer := range spv.Peers() {
+		if !peer.IsReady() || peer == except || int(peer.BestHeight()) < height {
+			continue
+		}
+		if best == nil || inflight[peer] < inflight[best] {
+			best = peer
+		}
+	}
+	if best == nil && except != nil {
+		return spv.downloadPeer(height, nil)
+	}
+	return best
+}
+
+// recvDownloadedBlock buffers the block and delivers the blocks in height order
+func (spv *Spv) recvDownloadedBlock(peer *Peer, block *wire.MsgBlock, header *wire.BlockHeader, height int) {
+	spv.downloadMutex.Lock()
+	req, ok := spv.downloads[height]
+	if !ok || req.block != nil || req.hash != block.BlockHash() {
+		spv.downloadMutex.Unlock()
+		log.Printf("unrequested block : %d %v", height, block.BlockHash())
+		return
+	}
+	merkles, err := spv.checkBlock(peer, block, header)
+	if err != nil {
+		log.Printf("spv.checkBlock Error : %+v", err)
+		spv.sendBlockRequest(req, peer)
+		spv.downloadMutex.Unlock()
+		peer.penalize(PeerBanScore, "invalid block")
+		return
+	}
+	req.block = block
+	req.merkles = merkles
+	var blocks []*blockRequest
+	for {
+		req, ok := spv.downloads[spv.checkHeight+len(blocks)]
+		if !ok || req.block == nil {
+			break
+		}
+		blocks = append(blocks, req)
+		delete(spv.downloads, req.height)
+	}
+	spv.downloadMutex.Unlock()
+	for _, req := range blocks {
+		spv.deliverTxs(req.height, blockTxInfos(req.block, req.height, req.merkles))
+	}
+	spv.updateBlock()
+}
+
+// checkDownloads re-requests the stalled blocks from another peer
+func (spv *Spv) checkDownloads() {
+	spv.downloadMutex.Lock()
+	defer spv.downloadMutex.Unlock()
+	for _, req := range spv.downloads {
+		if req.block != nil {
+			continue
+		}
+		if !req.peer.isClosed() && time.Since(req.time) < BlockDownloadTimeout {
+			continue
+		}
+		log.Printf("block request timeout : %d %s", req.height, req.peer.addr)
+		spv.sendBlockRequest(req, req.peer)
+	}
+}
+
+// resetDownloads cancels all block requests
+func (spv *Spv) resetDownloads() {
+	spv.downloadMutex.Lock()
+	defer spv.downloadMutex.Unlock()
+	spv.downloads = make(map[int]*blockRequest)
+}
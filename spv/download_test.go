@@ -0,0 +1,236 @@
+// Package spv project download_test.go
+package spv
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// downloadTest is the spv in SyncModeBlock with the blocks to height 20 and two peers
+type downloadTest struct {
+	spv       *Spv
+	peer1     *Peer
+	peer2     *Peer
+	blocks    []*wire.MsgBlock
+	connected []int
+}
+
+func newDownloadTest(t *testing.T) *downloadTest {
+	dt := &downloadTest{}
+	dt.spv = newTestSpv(t, nil)
+	dt.spv.syncMode = SyncModeBlock
+	dt.peer1 = newTestPeer(t, dt.spv, "peer1", wire.SFNodeNetwork, 20)
+	dt.peer2 = newTestPeer(t, dt.spv, "peer2", wire.SFNodeNetwork, 20)
+	var headers []*wire.BlockHeader
+	for i := 0; i <= 20; i++ {
+		block := testCoinbaseBlock(i%5 + 1)
+		block.Header.Nonce = uint32(i)
+		if i > 0 {
+			block.Header.PrevBlock = dt.blocks[i-1].BlockHash()
+		}
+		dt.blocks = append(dt.blocks, block)
+		headers = append(headers, &block.Header)
+	}
+	putTestHeaders(t, dt.spv, headers, 0)
+	dt.spv.checkHeight = 1
+	_, err := dt.spv.AddNotifyBlockConnected(func(header *wire.BlockHeader, height int, txs []*wire.MsgTx) {
+		dt.connected = append(dt.connected, height)
+	})
+	if err != nil {
+		t.Fatalf("spv.AddNotifyBlockConnected Error : %+v", err)
+	}
+	return dt
+}
+
+// requestedHeights returns the heights of the blocks requested to the peer
+func (dt *downloadTest) requestedHeights(t *testing.T, peer *Peer) []int {
+	var heights []int
+	for _, msg := range queuedMsgs(peer) {
+		getdata, ok := msg.(*wire.MsgGetData)
+		if !ok {
+			continue
+		}
+		for _, inv := range getdata.InvList {
+			_, height, err := dt.spv.data.GetHeaderByHash(inv.Hash)
+			if err != nil {
+				t.Fatalf("spv.data.GetHeaderByHash Error : %+v", err)
+			}
+			heights = append(heights, height)
+		}
+	}
+	return heights
+}
+
+func TestFillDownloads(t *testing.T) {
+	dt := newDownloadTest(t)
+	dt.spv.fillDownloads()
+	if dt.spv.errBlock {
+		t.Fatalf("fillDownloads failed")
+	}
+	if len(dt.spv.downloads) != BlockDownloadWindow {
+		t.Fatalf("unmatch downloads : %d", len(dt.spv.downloads))
+	}
+	heights1 := dt.requestedHeights(t, dt.peer1)
+	heights2 := dt.requestedHeights(t, dt.peer2)
+	if len(heights1) != BlockDownloadWindow/2 || len(heights2) != BlockDownloadWindow/2 {
+		t.Fatalf("requests are not balanced : %v %v", heights1, heights2)
+	}
+	for _, height := range append(heights1, heights2...) {
+		req := dt.spv.downloads[height]
+		if req == nil || req.hash != dt.blocks[height].BlockHash() {
+			t.Fatalf("unmatch request : %d", height)
+		}
+	}
+	// the window does not exceed the header tip
+	dt.spv.resetDownloads()
+	dt.spv.checkHeight = 15
+	dt.spv.fillDownloads()
+	if len(dt.spv.downloads) != 6 || dt.spv.errBlock {
+		t.Fatalf("unmatch downloads at the tip : %d", len(dt.spv.downloads))
+	}
+}
+
+func TestRecvDownloadedBlockOutOfOrder(t *testing.T) {
+	dt := newDownloadTest(t)
+	spv := dt.spv
+	spv.fillDownloads()
+	recv := func(height int) {
+		req := spv.downloads[height]
+		if req == nil {
+			t.Fatalf("block is not requested : %d", height)
+		}
+		block := dt.blocks[height]
+		spv.recvDownloadedBlock(req.peer, block, &block.Header, height)
+	}
+	recv(3)
+	recv(2)
+	if spv.checkHeight != 1 || len(dt.connected) != 0 {
+		t.Fatalf("blocks are delivered before the check height : %d %v", spv.checkHeight, dt.connected)
+	}
+	if spv.downloads[2].block == nil || spv.downloads[3].block == nil {
+		t.Fatalf("blocks are not buffered")
+	}
+	// the unrequested and the duplicate blocks are ignored
+	spv.recvDownloadedBlock(dt.peer1, dt.blocks[18], &dt.blocks[18].Header, 18)
+	recv(3)
+	if _, ok := spv.downloads[18]; ok || spv.checkHeight != 1 {
+		t.Fatalf("unrequested block is accepted")
+	}
+	queuedMsgs(dt.peer1)
+	queuedMsgs(dt.peer2)
+	recv(1)
+	if !reflect.DeepEqual(dt.connected, []int{1, 2, 3}) || spv.checkHeight != 4 {
+		t.Fatalf("blocks are not delivered in height order : %d %v", spv.checkHeight, dt.connected)
+	}
+	// the window moves and the blocks over the old window are requested
+	heights := append(dt.requestedHeights(t, dt.peer1), dt.requestedHeights(t, dt.peer2)...)
+	if len(heights) != 3 || len(spv.downloads) != BlockDownloadWindow {
+		t.Fatalf("window is not filled : %v %d", heights, len(spv.downloads))
+	}
+	for _, height := range heights {
+		if height < 17 || height > 19 {
+			t.Fatalf("unmatch requested height : %v", heights)
+		}
+	}
+}
+
+func TestRecvDownloadedInvalidBlock(t *testing.T) {
+	dt := newDownloadTest(t)
+	spv := dt.spv
+	spv.fillDownloads()
+	req := spv.downloads[1]
+	peer, other := req.peer, dt.peer1
+	if peer == dt.peer1 {
+		other = dt.peer2
+	}
+	queuedMsgs(other)
+	// the block whose transactions do not match the header
+	block := testCoinbaseBlock(3)
+	block.Header = dt.blocks[1].Header
+	spv.recvDownloadedBlock(peer, block, &block.Header, 1)
+	if req.block != nil || req.peer != other || spv.checkHeight != 1 {
+		t.Fatalf("invalid block is not re-requested from the other peer")
+	}
+	if heights := dt.requestedHeights(t, other); !reflect.DeepEqual(heights, []int{1}) {
+		t.Fatalf("unmatch requested heights : %v", heights)
+	}
+}
+
+func TestCheckDownloads(t *testing.T) {
+	dt := newDownloadTest(t)
+	spv := dt.spv
+	spv.fillDownloads()
+	queuedMsgs(dt.peer1)
+	queuedMsgs(dt.peer2)
+	var stalled []int
+	for height, req := range spv.downloads {
+		if req.peer == dt.peer1 {
+			stalled = append(stalled, height)
+		}
+	}
+	// the requests within the timeout are kept
+	spv.checkDownloads()
+	if heights := append(dt.requestedHeights(t, dt.peer1), dt.requestedHeights(t, dt.peer2)...); len(heights) != 0 {
+		t.Fatalf("requests are re-sent before the timeout : %v", heights)
+	}
+	// the stalled request is re-sent to the other peer
+	req := spv.downloads[stalled[0]]
+	req.time = time.Now().Add(-BlockDownloadTimeout - time.Second)
+	spv.checkDownloads()
+	if req.peer != dt.peer2 {
+		t.Fatalf("stalled request is not reassigned")
+	}
+	if heights := dt.requestedHeights(t, dt.peer2); !reflect.DeepEqual(heights, []int{stalled[0]}) {
+		t.Fatalf("unmatch re-requested heights : %v", heights)
+	}
+	// all requests of the closed peer are re-sent
+	dt.peer1.Close()
+	spv.checkDownloads()
+	for height, req := range spv.downloads {
+		if req.peer != dt.peer2 {
+			t.Fatalf("request of the closed peer is not reassigned : %d", height)
+		}
+	}
+	if heights := dt.requestedHeights(t, dt.peer2); len(heights) != len(stalled)-1 {
+		t.Fatalf("unmatch re-requested heights : %v %v", heights, stalled)
+	}
+}
+
+func TestDownloadPeer(t *testing.T) {
+	dt := newDownloadTest(t)
+	spv := dt.spv
+	peer3 := newTestPeer(t, spv, "peer3", wire.SFNodeNetwork, 10)
+	peer4 := newTestPeer(t, spv, "peer4", wire.SFNodeNetwork, 20)
+	peer4.verAck = false
+	spv.downloads[1] = &blockRequest{height: 1, peer: dt.peer1}
+	spv.downloads[2] = &blockRequest{height: 2, peer: dt.peer1}
+	spv.downloads[3] = &blockRequest{height: 3, peer: dt.peer2}
+	spv.downloads[5] = &blockRequest{height: 5, peer: peer3, block: dt.blocks[5]}
+	cases := []struct {
+		height int
+		except *Peer
+		want   *Peer
+	}{
+		{10, nil, peer3},
+		{10, peer3, dt.peer2},
+		{11, nil, dt.peer2},
+		{11, dt.peer2, dt.peer1},
+		{21, nil, nil},
+	}
+	for i, c := range cases {
+		if peer := spv.downloadPeer(c.height, c.except); peer != c.want {
+			t.Errorf("case %d : unmatch peer : %v %v", i, peer, c.want)
+		}
+	}
+	// the peer which is failed is used if it is the only peer
+	dt.peer1.Close()
+	dt.peer2.Close()
+	peer3.Close()
+	peer4.verAck = true
+	if peer := spv.downloadPeer(11, peer4); peer != peer4 {
+		t.Fatalf("only peer is not used : %v", peer)
+	}
+}
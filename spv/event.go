@@ -0,0 +1,152 @@
+// Package spv project event.go
+package spv
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// EventBufferSize is the buffer size of the subscription channel
+const EventBufferSize = 100
+
+// Event is sync progress and chain event type
+// it is one of PeerConnected, PeerDisconnected, HeaderTipChanged, BlockProcessed,
+// SyncedToTip, Reorg and TxBroadcastStatus
+type Event interface {
+	event()
+}
+
+// PeerConnected is emitted when the handshake with the peer is done
+type PeerConnected struct {
+	Addr       string
+	BestHeight int32
+}
+
+// PeerDisconnected is emitted when the peer is disconnected
+type PeerDisconnected struct {
+	Addr string
+}
+
+// HeaderTipChanged is emitted when the tip of the header chain is changed
+type HeaderTipChanged struct {
+	Hash   chainhash.Hash
+	Height int
+}
+
+// BlockProcessed is emitted when the transactions in the block are delivered to the callbacks
+type BlockProcessed struct {
+	Height int
+}
+
+// SyncedToTip is emitted when all blocks to the header tip are processed
+type SyncedToTip struct {
+	Height int
+}
+
+// Reorg is emitted when the side branch becomes the main chain
+type Reorg struct {
+	ForkHeight   int
+	OldTipHeight int
+	NewTipHeight int
+}
+
+// TxBroadcastStatus is emitted when the broadcast status of the transaction is changed
+type TxBroadcastStatus struct {
+	Hash   chainhash.Hash
+	Status int
+	Reason string
+}
+
+func (PeerConnected) event()     {}
+func (PeerDisconnected) event()  {}
+func (HeaderTipChanged) event()  {}
+func (BlockProcessed) event()    {}
+func (SyncedToTip) event()       {}
+func (Reorg) event()             {}
+func (TxBroadcastStatus) event() {}
+
+// Subscription is event subscription type
+// the events are buffered up to EventBufferSize, and the events which overflow the buffer are dropped
+// the channel of the events is closed when the subscription is closed or spv is stopped
+type Subscription struct {
+	spv       *Spv
+	events    chan Event
+	closeOnce *sync.Once
+	dropped   *uint64
+}
+
+// Subscribe returns a new subscription of the events
+// if spv is already stopped, the returned subscription is closed
+func (spv *Spv) Subscribe() *Subscription {
+	sub := &Subscription{}
+	sub.spv = spv
+	sub.events = make(chan Event, EventBufferSize)
+	sub.closeOnce = new(sync.Once)
+	sub.dropped = new(uint64)
+	spv.eventMutex.Lock()
+	closed := spv.eventsClosed
+	if !closed {
+		spv.subscriptions = append(spv.subscriptions, sub)
+	}
+	spv.eventMutex.Unlock()
+	if closed {
+		sub.Close()
+	}
+	return sub
+}
+
+// Events returns the channel of the events
+func (sub *Subscription) Events() <-chan Event {
+	return sub.events
+}
+
+// Dropped returns the number of the events dropped because the subscriber lagged
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(sub.dropped)
+}
+
+// Close cancels the subscription and closes the channel of the events
+func (sub *Subscription) Close() {
+	sub.closeOnce.Do(func() {
+		spv := sub.spv
+		spv.eventMutex.Lock()
+		defer spv.eventMutex.Unlock()
+		for i, s := range spv.subscriptions {
+			if s == sub {
+				spv.subscriptions = append(spv.subscriptions[:i], spv.subscriptions[i+1:]...)
+				break
+			}
+		}
+		close(sub.events)
+	})
+}
+
+// closeSubscriptions closes all subscriptions when spv is stopped
+func (spv *Spv) closeSubscriptions() {
+	spv.eventMutex.Lock()
+	subs := spv.subscriptions
+	spv.eventsClosed = true
+	spv.eventMutex.Unlock()
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+// publish sends the event to all subscriptions without blocking
+// if the buffer of the subscription is full, the event is dropped and counted
+// the lock is held while sending, so the channel is not closed during it
+func (spv *Spv) publish(event Event) {
+	spv.eventMutex.Lock()
+	defer spv.eventMutex.Unlock()
+	for _, sub := range spv.subscriptions {
+		select {
+		case sub.events <- event:
+		default:
+			dropped := atomic.AddUint64(sub.dropped, 1)
+			log.Printf("drop event : %T %d", event, dropped)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Package spv project event_test.go
+package spv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishDropsLaggedEvents(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	lagged := spv.Subscribe()
+	defer lagged.Close()
+	closed := spv.Subscribe()
+	closed.Close()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < EventBufferSize+10; i++ {
+			spv.publish(BlockProcessed{Height: i})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publish blocks on the lagged subscriber")
+	}
+	if dropped := lagged.Dropped(); dropped != 10 {
+		t.Fatalf("unmatch dropped events : %d", dropped)
+	}
+	for i := 0; i < EventBufferSize; i++ {
+		event := (<-lagged.Events()).(BlockProcessed)
+		if event.Height != i {
+			t.Fatalf("unmatch event : %d %d", event.Height, i)
+		}
+	}
+	spv.publish(BlockProcessed{Height: EventBufferSize})
+	event := (<-lagged.Events()).(BlockProcessed)
+	if event.Height != EventBufferSize {
+		t.Fatalf("event is not delivered after the buffer is drained : %d", event.Height)
+	}
+	if closed.Dropped() != 0 {
+		t.Fatalf("events are sent to the closed subscription")
+	}
+}
+
+// rangeEvents ranges over the events in a goroutine and returns the channel closed when the range ends
+func rangeEvents(sub *Subscription) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for range sub.Events() {
+		}
+		close(done)
+	}()
+	return done
+}
+
+func TestSubscriptionRangeEnds(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	closed := spv.Subscribe()
+	stopped := spv.Subscribe()
+	closedDone := rangeEvents(closed)
+	stoppedDone := rangeEvents(stopped)
+	spv.publish(BlockProcessed{Height: 1})
+	closed.Close()
+	closed.Close()
+	select {
+	case <-closedDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("range does not end after Close")
+	}
+	spv.publish(BlockProcessed{Height: 2})
+	spv.Stop()
+	select {
+	case <-stoppedDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("range does not end after Stop")
+	}
+	spv.publish(BlockProcessed{Height: 3})
+	stopped.Close()
+	late := spv.Subscribe()
+	if _, ok := <-late.Events(); ok {
+		t.Fatalf("subscription after Stop is not closed")
+	}
+}
@@ -0,0 +1,374 @@
+// Package spv project flatdata.go
+package spv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// flat file format : magic (4 bytes), start height (4 bytes, big endian) and serialized headers
+const (
+	flatMagic          = "SBCH"
+	flatFileHeaderSize = 8
+	flatHeaderSize     = wire.MaxBlockHeaderPayload
+)
+
+// FlatData is the Store which stores the main chain headers in a flat file
+// the headers are appended to the file in height order and indexed by hash in memory,
+// the side branch headers and the other data are stored in the underlying store
+type FlatData struct {
+	Store
+	file   *os.File
+	start  int
+	hashes map[chainhash.Hash]int
+	works  []*big.Int
+	tip    *wire.BlockHeader
+	mutex  *sync.Mutex
+}
+
+// NewFlatData returns a new FlatData stored in the data directory
+// the hash index is rebuilt from the file, and the broken tail of the file is truncated
+func NewFlatData(store Store, name, datadir string) (*FlatData, error) {
+	path := fmt.Sprintf("%sheaders-%s.dat", datadir, name)
+	log.Printf("%s", path)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("os.OpenFile Error : %+v", err)
+		return nil, err
+	}
+	data := &FlatData{}
+	data.Store = store
+	data.file = file
+	data.start = -1
+	data.hashes = make(map[chainhash.Hash]int)
+	data.mutex = new(sync.Mutex)
+	err = data.load()
+	if err != nil {
+		log.Printf("data.load Error : %+v", err)
+		file.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// Close closes the file and the underlying store
+func (data *FlatData) Close() error {
+	err := data.file.Close()
+	if err != nil {
+		log.Printf("file.Close Error : %+v", err)
+	}
+	return data.Store.Close()
+}
+
+// load reads all headers in the file and rebuilds the hash index and the chain works
+// the partial record and the headers which do not connect are truncated
+func (data *FlatData) load() error {
+	bs := make([]byte, flatFileHeaderSize)
+	_, err := io.ReadFull(data.file, bs)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return data.truncate(0)
+	}
+	if err != nil {
+		log.Printf("io.ReadFull Error : %+v", err)
+		return err
+	}
+	if string(bs[:4]) != flatMagic {
+		return fmt.Errorf("invalid header file")
+	}
+	data.start = int(binary.BigEndian.Uint32(bs[4:]))
+	reader := bufio.NewReader(data.file)
+	record := make([]byte, flatHeaderSize)
+	for {
+		_, err = io.ReadFull(reader, record)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("truncate partial header : %d", data.start+len(data.works))
+			return data.truncate(data.start + len(data.works))
+		}
+		if err != nil {
+			log.Printf("io.ReadFull Error : %+v", err)
+			return err
+		}
+		header := new(wire.BlockHeader)
+		err = header.Deserialize(bytes.NewReader(record))
+		if err != nil {
+			log.Printf("header.Deserialize Error : %+v", err)
+			return err
+		}
+		if data.tip != nil && header.PrevBlock != data.tip.BlockHash() {
+			log.Printf("truncate unconnected header : %d", data.start+len(data.works))
+			return data.truncate(data.start + len(data.works))
+		}
+		data.index(header)
+	}
+}
+
+// index adds the header to the tip of the hash index and the chain works
+func (data *FlatData) index(header *wire.BlockHeader) {
+	work := big.NewInt(0)
+	if len(data.works) > 0 {
+		work = data.works[len(data.works)-1]
+	}
+	data.hashes[header.BlockHash()] = data.start + len(data.works)
+	data.works = append(data.works, addWork(work, header))
+	data.tip = header
+}
+
+// offset returns the file offset of the header at the height
+func (data *FlatData) offset(height int) int64 {
+	return int64(flatFileHeaderSize + (height-data.start)*flatHeaderSize)
+}
+
+// truncate removes the headers from the height and syncs the file
+// if the height is the start height or 0, all headers are removed
+func (data *FlatData) truncate(height int) error {
+	size := int64(0)
+	if data.start >= 0 && height > data.start {
+		size = data.offset(height)
+	}
+	var removed []chainhash.Hash
+	for i := height - data.start; data.start >= 0 && i < len(data.works); i++ {
+		header, err := data.read(data.start + i)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, header.BlockHash())
+	}
+	err := data.file.Truncate(size)
+	if err != nil {
+		log.Printf("file.Truncate Error : %+v", err)
+		return err
+	}
+	err = data.file.Sync()
+	if err != nil {
+		log.Printf("file.Sync Error : %+v", err)
+		return err
+	}
+	if size == 0 {
+		data.start = -1
+		data.hashes = make(map[chainhash.Hash]int)
+		data.works = nil
+		data.tip = nil
+		return nil
+	}
+	for _, hash := range removed {
+		delete(data.hashes, hash)
+	}
+	data.works = data.works[:height-data.start]
+	data.tip, err = data.read(height - 1)
+	return err
+}
+
+// read reads the header at the height from the file
+func (data *FlatData) read(height int) (*wire.BlockHeader, error) {
+	record := make([]byte, flatHeaderSize)
+	_, err := data.file.ReadAt(record, data.offset(height))
+	if err != nil {
+		log.Printf("file.ReadAt Error : %+v", err)
+		return nil, err
+	}
+	header := new(wire.BlockHeader)
+	err = header.Deserialize(bytes.NewReader(record))
+	if err != nil {
+		log.Printf("header.Deserialize Error : %+v", err)
+		return nil, err
+	}
+	return header, nil
+}
+
+// write appends the headers to the file and syncs it
+// startHeight must be the next height of the tip
+func (data *FlatData) write(headers []*wire.BlockHeader, startHeight int) error {
+	buf := &bytes.Buffer{}
+	if data.start < 0 {
+		buf.WriteString(flatMagic)
+		binary.Write(buf, binary.BigEndian, uint32(startHeight))
+	} else if startHeight != data.start+len(data.works) {
+		return fmt.Errorf("header does not connect to the tip : %d %d", startHeight, data.start+len(data.works)-1)
+	}
+	for i, header := range headers {
+		if _, ok := data.hashes[header.BlockHash()]; ok {
+			return fmt.Errorf("header already exists : %d %v", startHeight+i, header.BlockHash())
+		}
+		header.Serialize(buf)
+	}
+	offset := int64(0)
+	if data.start >= 0 {
+		offset = data.offset(startHeight)
+	}
+	_, err := data.file.WriteAt(buf.Bytes(), offset)
+	if err != nil {
+		log.Printf("file.WriteAt Error : %+v", err)
+		return err
+	}
+	err = data.file.Sync()
+	if err != nil {
+		log.Printf("file.Sync Error : %+v", err)
+		return err
+	}
+	if data.start < 0 {
+		data.start = startHeight
+	}
+	for _, header := range headers {
+		data.index(header)
+	}
+	return nil
+}
+
+// Header
+
+// GetHeaderByHash gets header by hash
+func (data *FlatData) GetHeaderByHash(hash chainhash.Hash) (*wire.BlockHeader, int, error) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	height, ok := data.hashes[hash]
+	if !ok {
+		return nil, -1, nil
+	}
+	header, err := data.read(height)
+	if err != nil {
+		return nil, -1, err
+	}
+	return header, height, nil
+}
+
+// GetHeaderByHeight gets header by height
+func (data *FlatData) GetHeaderByHeight(height int) (*wire.BlockHeader, int, error) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	if data.start < 0 || height < data.start || height >= data.start+len(data.works) {
+		return nil, -1, nil
+	}
+	header, err := data.read(height)
+	if err != nil {
+		return nil, -1, err
+	}
+	return header, height, nil
+}
+
+// PutHeaders puts headers
+// the headers must be connected to the tip
+func (data *FlatData) PutHeaders(headers []*wire.BlockHeader, startHeight int) error {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	return data.write(headers, startHeight)
+}
+
+// GetCntMinMaxHeight gets count, max and min height
+// if count is zero, max and min is -1
+func (data *FlatData) GetCntMinMaxHeight() (int, int, int, error) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	if len(data.works) == 0 {
+		return 0, -1, -1, nil
+	}
+	return len(data.works), data.start, data.start + len(data.works) - 1, nil
+}
+
+// GetTip gets the header and the height of the tip
+// if there is no header, it returns nil and -1
+func (data *FlatData) GetTip() (*wire.BlockHeader, int, error) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	if data.tip == nil {
+		return nil, -1, nil
+	}
+	return data.tip, data.start + len(data.works) - 1, nil
+}
+
+// GetHeadersByHeight gets the headers from startHeight to endHeight
+// it returns the stored headers in the range and the height of the first header
+func (data *FlatData) GetHeadersByHeight(startHeight, endHeight int) ([]*wire.BlockHeader, int, error) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	if data.start < 0 {
+		return nil, -1, nil
+	}
+	if startHeight < data.start {
+		startHeight = data.start
+	}
+	if endHeight > data.start+len(data.works)-1 {
+		endHeight = data.start + len(data.works) - 1
+	}
+	if endHeight < startHeight {
+		return nil, -1, nil
+	}
+	bs := make([]byte, (endHeight-startHeight+1)*flatHeaderSize)
+	_, err := data.file.ReadAt(bs, data.offset(startHeight))
+	if err != nil {
+		log.Printf("file.ReadAt Error : %+v", err)
+		return nil, -1, err
+	}
+	reader := bytes.NewReader(bs)
+	var headers []*wire.BlockHeader
+	for height := startHeight; height <= endHeight; height++ {
+		header := new(wire.BlockHeader)
+		err = header.Deserialize(reader)
+		if err != nil {
+			log.Printf("header.Deserialize Error : %+v", err)
+			return nil, -1, err
+		}
+		headers = append(headers, header)
+	}
+	return headers, startHeight, nil
+}
+
+// GetAncestors gets the header of the hash and its previous headers from the lowest
+// at most count headers are returned, with the height of the first header
+func (data *FlatData) GetAncestors(hash chainhash.Hash, count int) ([]*wire.BlockHeader, int, error) {
+	return getAncestors(data, hash, count)
+}
+
+// GetChainWork gets the chain work of the header at the height
+// if the header is not found, it returns nil
+func (data *FlatData) GetChainWork(height int) (*big.Int, error) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	if data.start < 0 || height < data.start || height >= data.start+len(data.works) {
+		return nil, nil
+	}
+	return new(big.Int).Set(data.works[height-data.start]), nil
+}
+
+// Reorg replaces headers from startHeight with the headers of the side branch
+// the replaced headers are moved to the side branch of the underlying store before the file is truncated,
+// so the headers are not lost if the process crashes during the reorg,
+// and the headers of the new branch are removed from the side branch in the same transaction
+func (data *FlatData) Reorg(headers []*wire.BlockHeader, startHeight int) error {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	if data.start < 0 || startHeight <= data.start {
+		return fmt.Errorf("reorg height is out of range : %d", startHeight)
+	}
+	var replaced []*wire.BlockHeader
+	for height := startHeight; height < data.start+len(data.works); height++ {
+		header, err := data.read(height)
+		if err != nil {
+			return err
+		}
+		replaced = append(replaced, header)
+	}
+	err := data.Store.ReorgForks(replaced, headers, startHeight)
+	if err != nil {
+		log.Printf("data.Store.ReorgForks Error : %+v", err)
+		return err
+	}
+	err = data.truncate(startHeight)
+	if err != nil {
+		log.Printf("data.truncate Error : %+v", err)
+		return err
+	}
+	return data.write(headers, startHeight)
+}
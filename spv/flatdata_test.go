@@ -0,0 +1,254 @@
+// Package spv project flatdata_test.go
+package spv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testHeaders returns the connected headers from the previous hash
+// they are not valid for proof of work, but the stores do not check it
+func testHeaders(prev chainhash.Hash, count int, nonce uint32) []*wire.BlockHeader {
+	var headers []*wire.BlockHeader
+	for i := 0; i < count; i++ {
+		header := &wire.BlockHeader{}
+		header.Version = 1
+		header.PrevBlock = prev
+		header.Bits = 0x207fffff
+		header.Nonce = nonce + uint32(i)
+		headers = append(headers, header)
+		prev = header.BlockHash()
+	}
+	return headers
+}
+
+// newTestFlatData returns a new FlatData in the directory
+func newTestFlatData(t testing.TB, dir string) *FlatData {
+	under, err := NewData("test", dir)
+	if err != nil {
+		t.Fatalf("NewData Error : %+v", err)
+	}
+	data, err := NewFlatData(under, "test", dir)
+	if err != nil {
+		t.Fatalf("NewFlatData Error : %+v", err)
+	}
+	return data
+}
+
+func flatPath(dir string) string {
+	return filepath.Join(dir, "headers-test.dat")
+}
+
+func TestFlatDataTruncatePartialRecord(t *testing.T) {
+	dir := t.TempDir() + string(os.PathSeparator)
+	data := newTestFlatData(t, dir)
+	headers := testHeaders(chainhash.Hash{}, 5, 0)
+	err := data.PutHeaders(headers, 100)
+	if err != nil {
+		t.Fatalf("data.PutHeaders Error : %+v", err)
+	}
+	data.Close()
+	// a crash while writing leaves a partial record
+	file, err := os.OpenFile(flatPath(dir), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("os.OpenFile Error : %+v", err)
+	}
+	file.Write(make([]byte, flatHeaderSize/2))
+	file.Close()
+	data = newTestFlatData(t, dir)
+	defer data.Close()
+	cnt, min, max, err := data.GetCntMinMaxHeight()
+	if err != nil || cnt != 5 || min != 100 || max != 104 {
+		t.Fatalf("data.GetCntMinMaxHeight : %d %d %d %+v", cnt, min, max, err)
+	}
+	info, err := os.Stat(flatPath(dir))
+	if err != nil || info.Size() != data.offset(105) {
+		t.Fatalf("partial record is not truncated : %v %+v", info, err)
+	}
+	tip, height, err := data.GetTip()
+	if err != nil || height != 104 || tip.BlockHash() != headers[4].BlockHash() {
+		t.Fatalf("data.GetTip : %d %+v", height, err)
+	}
+	err = data.PutHeaders(testHeaders(headers[4].BlockHash(), 1, 10), 105)
+	if err != nil {
+		t.Fatalf("data.PutHeaders after truncate Error : %+v", err)
+	}
+}
+
+func TestFlatDataTruncateUnconnectedRecord(t *testing.T) {
+	dir := t.TempDir() + string(os.PathSeparator)
+	data := newTestFlatData(t, dir)
+	headers := testHeaders(chainhash.Hash{}, 5, 0)
+	err := data.PutHeaders(headers, 100)
+	if err != nil {
+		t.Fatalf("data.PutHeaders Error : %+v", err)
+	}
+	data.Close()
+	// a header which does not connect to the previous one, and the following headers are removed
+	file, err := os.OpenFile(flatPath(dir), os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("os.OpenFile Error : %+v", err)
+	}
+	unconnected := testHeaders(chainhash.Hash{1}, 1, 0)[0]
+	err = unconnected.Serialize(&offsetWriter{file, data.offset(103)})
+	if err != nil {
+		t.Fatalf("header.Serialize Error : %+v", err)
+	}
+	file.Close()
+	data = newTestFlatData(t, dir)
+	defer data.Close()
+	cnt, _, max, err := data.GetCntMinMaxHeight()
+	if err != nil || cnt != 3 || max != 102 {
+		t.Fatalf("data.GetCntMinMaxHeight : %d %d %+v", cnt, max, err)
+	}
+	for i, header := range headers {
+		_, height, err := data.GetHeaderByHash(header.BlockHash())
+		want := 100 + i
+		if i >= 3 {
+			want = -1
+		}
+		if err != nil || height != want {
+			t.Fatalf("data.GetHeaderByHash : %d %d %+v", height, want, err)
+		}
+	}
+	info, err := os.Stat(flatPath(dir))
+	if err != nil || info.Size() != data.offset(103) {
+		t.Fatalf("unconnected record is not truncated : %v %+v", info, err)
+	}
+}
+
+// offsetWriter writes to the file at the offset
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(bs []byte) (int, error) {
+	n, err := w.file.WriteAt(bs, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+func TestFlatDataReorg(t *testing.T) {
+	dir := t.TempDir() + string(os.PathSeparator)
+	data := newTestFlatData(t, dir)
+	defer data.Close()
+	headers := testHeaders(chainhash.Hash{}, 5, 0)
+	err := data.PutHeaders(headers, 100)
+	if err != nil {
+		t.Fatalf("data.PutHeaders Error : %+v", err)
+	}
+	branch := testHeaders(headers[2].BlockHash(), 3, 100)
+	err = data.Reorg(branch, 103)
+	if err != nil {
+		t.Fatalf("data.Reorg Error : %+v", err)
+	}
+	// the replaced headers are moved to the side branch of the underlying store
+	for i, header := range headers[3:] {
+		fork, height, err := data.GetForkHeader(header.BlockHash())
+		if err != nil || fork == nil || height != 103+i {
+			t.Fatalf("replaced header is not in the side branch : %d %+v", height, err)
+		}
+		_, height, err = data.GetHeaderByHash(header.BlockHash())
+		if err != nil || height != -1 {
+			t.Fatalf("replaced header is in the main chain : %d %+v", height, err)
+		}
+	}
+	for i, header := range branch {
+		stored, height, err := data.GetHeaderByHeight(103 + i)
+		if err != nil || height != 103+i || stored.BlockHash() != header.BlockHash() {
+			t.Fatalf("branch header is not in the main chain : %d %+v", height, err)
+		}
+	}
+	tip, height, err := data.GetTip()
+	if err != nil || height != 105 || tip.BlockHash() != branch[2].BlockHash() {
+		t.Fatalf("data.GetTip : %d %+v", height, err)
+	}
+	work, err := data.GetChainWork(105)
+	if err != nil || work == nil {
+		t.Fatalf("data.GetChainWork : %v %+v", work, err)
+	}
+}
+
+// benchStores returns FlatData and Data to compare them
+func benchStores(b *testing.B) map[string]Store {
+	dir := b.TempDir() + string(os.PathSeparator)
+	data, err := NewData("bench", dir)
+	if err != nil {
+		b.Fatalf("NewData Error : %+v", err)
+	}
+	flat := newTestFlatData(b, dir)
+	b.Cleanup(func() {
+		data.Close()
+		flat.Close()
+	})
+	return map[string]Store{"flat": flat, "sqlite": data}
+}
+
+// benchmark settings
+// benchPutBatch headers are put in each operation, and benchHeaderCount headers are stored before the lookups
+const (
+	benchPutBatch    = 100
+	benchHeaderCount = 10000
+)
+
+func BenchmarkPutHeaders(b *testing.B) {
+	for _, name := range []string{"flat", "sqlite"} {
+		b.Run(name, func(b *testing.B) {
+			store := benchStores(b)[name]
+			headers := testHeaders(chainhash.Hash{}, b.N*benchPutBatch, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := i * benchPutBatch
+				err := store.PutHeaders(headers[start:start+benchPutBatch], start)
+				if err != nil {
+					b.Fatalf("store.PutHeaders Error : %+v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetHeaderByHash(b *testing.B) {
+	for _, name := range []string{"flat", "sqlite"} {
+		b.Run(name, func(b *testing.B) {
+			store := benchStores(b)[name]
+			headers := testHeaders(chainhash.Hash{}, benchHeaderCount, 0)
+			err := store.PutHeaders(headers, 0)
+			if err != nil {
+				b.Fatalf("store.PutHeaders Error : %+v", err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				header, _, err := store.GetHeaderByHash(headers[i%benchHeaderCount].BlockHash())
+				if err != nil || header == nil {
+					b.Fatalf("store.GetHeaderByHash : %v %+v", header, err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetHeaderByHeight(b *testing.B) {
+	for _, name := range []string{"flat", "sqlite"} {
+		b.Run(name, func(b *testing.B) {
+			store := benchStores(b)[name]
+			headers := testHeaders(chainhash.Hash{}, benchHeaderCount, 0)
+			err := store.PutHeaders(headers, 0)
+			if err != nil {
+				b.Fatalf("store.PutHeaders Error : %+v", err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				header, _, err := store.GetHeaderByHeight(i % benchHeaderCount)
+				if err != nil || header == nil {
+					b.Fatalf("store.GetHeaderByHeight : %v %+v", header, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// Package spv project fork.go
+package spv
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// hasHeader returns whether the header is stored in the main chain or the side branch
+func (spv *Spv) hasHeader(hash chainhash.Hash) (bool, error) {
+	header, _, err := spv.data.GetHeaderByHash(hash)
+	if err != nil {
+		return false, err
+	}
+	if header != nil {
+		return true, nil
+	}
+	header, _, err = spv.data.GetForkHeader(hash)
+	if err != nil {
+		return false, err
+	}
+	return header != nil, nil
+}
+
+// getBranch returns the side branch headers to the hash and the fork height
+// if the hash is not connected to the main chain, the fork height is -1
+func (spv *Spv) getBranch(hash chainhash.Hash) ([]*wire.BlockHeader, int, error) {
+	var branch []*wire.BlockHeader
+	for {
+		_, height, err := spv.data.GetHeaderByHash(hash)
+		if err != nil {
+			return nil, -1, err
+		}
+		if height >= 0 {
+			for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+				branch[i], branch[j] = branch[j], branch[i]
+			}
+			return branch, height, nil
+		}
+		header, _, err := spv.data.GetForkHeader(hash)
+		if err != nil {
+			return nil, -1, err
+		}
+		if header == nil {
+			return nil, -1, nil
+		}
+		branch = append(branch, header)
+		hash = header.PrevBlock
+	}
+}
+
+// calcWork returns the total work of the main chain headers from startHeight to endHeight
+func (spv *Spv) calcWork(startHeight, endHeight int) (*big.Int, error) {
+	if endHeight < startHeight {
+		return big.NewInt(0), nil
+	}
+	endWork, err := spv.data.GetChainWork(endHeight)
+	if err != nil {
+		return nil, err
+	}
+	if endWork == nil {
+		return nil, fmt.Errorf("chain work not found : %d", endHeight)
+	}
+	prevWork, err := spv.data.GetChainWork(startHeight - 1)
+	if err != nil {
+		return nil, err
+	}
+	if prevWork == nil {
+		prevWork = big.NewInt(0)
+	}
+	return new(big.Int).Sub(endWork, prevWork), nil
+}
+
+// recvForkHeaders stores the headers of the side branch
+// if the side branch has more work than the main chain, it becomes the main chain
+func (spv *Spv) recvForkHeaders(peer *Peer, headers []*wire.BlockHeader, lastHeight int) bool {
+	branch, forkHeight, err := spv.getBranch(headers[0].PrevBlock)
+	if err != nil {
+		log.Printf("spv.getBranch Error : %+v", err)
+		spv.errHeaders = true
+		return false
+	}
+	if forkHeight < 0 {
+		log.Printf("orphan header : %v", headers[0].PrevBlock)
+		spv.errHeaders = true
+		return false
+	}
+	checkpointHeight := spv.lastCheckpointHeight(lastHeight)
+	if forkHeight < checkpointHeight {
+		log.Printf("fork before checkpoint : %d %d", forkHeight, checkpointHeight)
+		peer.penalize(PeerBanScore, "fork before checkpoint")
+		spv.errHeaders = true
+		return false
+	}
+	prevHash := headers[0].PrevBlock
+	if len(branch) > 0 {
+		prevHash = branch[0].PrevBlock
+	}
+	chain, err := spv.newValidationChain(prevHash, forkHeight+1)
+	if err != nil {
+		log.Printf("spv.newValidationChain Error : %+v", err)
+		spv.errHeaders = true
+		return false
+	}
+	for i, header := range branch {
+		chain.add(header, forkHeight+1+i)
+	}
+	startHeight := forkHeight + 1 + len(branch)
+	for i, header := range headers {
+		err = spv.validateHeader(chain, header, startHeight+i)
+		if err != nil {
+			log.Printf("spv.validateHeader Error : %+v", err)
+			peer.penalize(PeerBanScore, "invalid fork header")
+			spv.errHeaders = true
+			return false
+		}
+		chain.add(header, startHeight+i)
+	}
+	branch = append(branch, headers...)
+	mainWork, err := spv.calcWork(forkHeight+1, lastHeight)
+	if err != nil {
+		log.Printf("spv.calcWork Error : %+v", err)
+		spv.errHeaders = true
+		return false
+	}
+	sideWork := big.NewInt(0)
+	for _, header := range branch {
+		sideWork.Add(sideWork, blockchain.CalcWork(header.Bits))
+	}
+	if sideWork.Cmp(mainWork) <= 0 {
+		log.Printf("side branch : fork %d tip %d", forkHeight, forkHeight+len(branch))
+		err = spv.data.PutForkHeaders(headers, startHeight)
+		if err != nil {
+			log.Printf("spv.data.PutForkHeaders Error : %+v", err)
+			spv.errHeaders = true
+			return false
+		}
+		return true
+	}
+	tipHeight := forkHeight + len(branch)
+	log.Printf("Reorg! fork %d tip %d -> %d", forkHeight, lastHeight, tipHeight)
+	endHeight := lastHeight
+	if endHeight > spv.checkHeight-1 {
+		endHeight = spv.checkHeight - 1
+	}
+	disconnected, _, err := spv.data.GetHeadersByHeight(forkHeight+1, endHeight)
+	if err != nil {
+		log.Printf("spv.data.GetHeadersByHeight Error : %+v", err)
+		spv.errHeaders = true
+		return false
+	}
+	var disconnectedTxs [][]*wire.MsgTx
+	for i := range disconnected {
+		txs, err := spv.getBlockTxs(forkHeight + 1 + i)
+		if err != nil {
+			log.Printf("spv.getBlockTxs Error : %+v", err)
+			spv.errHeaders = true
+			return false
+		}
+		disconnectedTxs = append(disconnectedTxs, txs)
+	}
+	err = spv.data.Reorg(branch, forkHeight+1)
+	if err != nil {
+		log.Printf("spv.data.Reorg Error : %+v", err)
+		spv.errHeaders = true
+		return false
+	}
+	peer.setBestHeight(int32(tipHeight))
+	spv.resetDownloads()
+	if spv.checkHeight > forkHeight+1 {
+		spv.checkHeight = forkHeight + 1
+		err = spv.data.PutInt(KeyCheckHeight, spv.checkHeight)
+		if err != nil {
+			log.Printf("spv.data.PutInt Error : %+v", err)
+		}
+	}
+	for i, txs := range disconnectedTxs {
+		spv.unconfirmTxs(txs)
+		err = spv.data.Del(blockTxsKey(forkHeight + 1 + i))
+		if err != nil {
+			log.Printf("spv.data.Del Error : %+v", err)
+		}
+	}
+	spv.callBlockDisconnected(disconnected, disconnectedTxs, forkHeight+1)
+	for _, c := range spv.getCallbacks() {
+		if notifyFork, ok := c.fn.(func(int, int)); ok {
+			notifyFork(forkHeight, tipHeight)
+		}
+	}
+	spv.publish(Reorg{ForkHeight: forkHeight, OldTipHeight: lastHeight, NewTipHeight: tipHeight})
+	spv.headerTipChanged(branch[len(branch)-1].BlockHash(), tipHeight)
+	return true
+}
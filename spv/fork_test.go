@@ -0,0 +1,186 @@
+// Package spv project fork_test.go
+package spv
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// mineChain returns count regtest headers from the previous header, offset changes the timestamps of the branch
+func mineChain(prev *wire.BlockHeader, count int, offset time.Duration) []*wire.BlockHeader {
+	var headers []*wire.BlockHeader
+	for i := 0; i < count; i++ {
+		header := mineHeader(prev.BlockHash(), prev.Timestamp.Add(10*time.Minute+offset))
+		headers = append(headers, header)
+		prev = header
+	}
+	return headers
+}
+
+// forkTest is the main chain from the regtest genesis to height 5 and the recorded callbacks
+type forkTest struct {
+	spv          *Spv
+	peer         *Peer
+	main         []*wire.BlockHeader
+	disconnected []int
+	disconnTxs   [][]*TxInfo
+	forks        [][2]int
+}
+
+func newForkTest(t *testing.T) *forkTest {
+	ft := &forkTest{}
+	ft.spv = newTestSpv(t, nil)
+	ft.peer = newTestPeer(t, ft.spv, "peer", wire.SFNodeNetwork, 5)
+	genesis := chaincfg.RegressionNetParams.GenesisBlock.Header
+	ft.main = append([]*wire.BlockHeader{&genesis}, mineChain(&genesis, 5, 0)...)
+	putTestHeaders(t, ft.spv, ft.main, 0)
+	ft.spv.checkHeight = 6
+	_, err := ft.spv.AddNotifyBlockDisconnected(func(header *wire.BlockHeader, height int, txs []*TxInfo) {
+		ft.disconnected = append(ft.disconnected, height)
+		ft.disconnTxs = append(ft.disconnTxs, txs)
+	})
+	if err != nil {
+		t.Fatalf("spv.AddNotifyBlockDisconnected Error : %+v", err)
+	}
+	_, err = ft.spv.AddNotifyFork(func(forkHeight, tipHeight int) {
+		ft.forks = append(ft.forks, [2]int{forkHeight, tipHeight})
+	})
+	if err != nil {
+		t.Fatalf("spv.AddNotifyFork Error : %+v", err)
+	}
+	return ft
+}
+
+func TestCalcWork(t *testing.T) {
+	ft := newForkTest(t)
+	work, err := ft.spv.calcWork(4, 5)
+	want := new(big.Int).Mul(blockchain.CalcWork(chaincfg.RegressionNetParams.PowLimitBits), big.NewInt(2))
+	if err != nil || work.Cmp(want) != 0 {
+		t.Fatalf("unmatch work : %v %v %+v", work, want, err)
+	}
+	work, err = ft.spv.calcWork(6, 5)
+	if err != nil || work.Sign() != 0 {
+		t.Fatalf("work of no headers is not zero : %v %+v", work, err)
+	}
+	_, err = ft.spv.calcWork(4, 6)
+	if err == nil {
+		t.Fatalf("work over the tip is calculated")
+	}
+}
+
+func TestRecvForkHeaders(t *testing.T) {
+	ft := newForkTest(t)
+	spv := ft.spv
+	sub := spv.Subscribe()
+	defer sub.Close()
+	// the transaction confirmed at height 5 is delivered to the disconnect callback
+	tx := testBlock(1).Transactions[0]
+	err := spv.setTxStatus(tx.TxHash(), TxStatusConfirmed, "")
+	if err != nil {
+		t.Fatalf("spv.setTxStatus Error : %+v", err)
+	}
+	err = spv.putBlockTxs(5, []*wire.MsgTx{tx})
+	if err != nil {
+		t.Fatalf("spv.putBlockTxs Error : %+v", err)
+	}
+	// the side branch from height 3 has the same work as the main chain
+	side := mineChain(ft.main[3], 3, time.Minute)
+	if !spv.recvForkHeaders(ft.peer, side[:2], 5) {
+		t.Fatalf("side branch is not stored")
+	}
+	tip, height, err := spv.data.GetTip()
+	if err != nil || height != 5 || tip.BlockHash() != ft.main[5].BlockHash() {
+		t.Fatalf("tip is changed by the lighter branch : %d %+v", height, err)
+	}
+	for _, header := range side[:2] {
+		fork, _, err := spv.data.GetForkHeader(header.BlockHash())
+		if err != nil || fork == nil {
+			t.Fatalf("side branch header is not in the forks : %+v", err)
+		}
+	}
+	if len(ft.disconnected) != 0 || len(ft.forks) != 0 {
+		t.Fatalf("callbacks are called without reorg : %v %v", ft.disconnected, ft.forks)
+	}
+	// the next header makes the side branch heavier
+	if !spv.recvForkHeaders(ft.peer, side[2:], 5) {
+		t.Fatalf("heavier branch is not accepted")
+	}
+	tip, height, err = spv.data.GetTip()
+	if err != nil || height != 6 || tip.BlockHash() != side[2].BlockHash() {
+		t.Fatalf("tip is not the heavier branch : %d %+v", height, err)
+	}
+	for i, header := range side {
+		stored, _, err := spv.data.GetHeaderByHeight(4 + i)
+		if err != nil || stored == nil || stored.BlockHash() != header.BlockHash() {
+			t.Fatalf("branch header is not in the main chain : %d %+v", 4+i, err)
+		}
+		fork, _, err := spv.data.GetForkHeader(header.BlockHash())
+		if err != nil || fork != nil {
+			t.Fatalf("promoted header is left in the forks : %d %+v", 4+i, err)
+		}
+	}
+	for _, header := range ft.main[4:] {
+		fork, _, err := spv.data.GetForkHeader(header.BlockHash())
+		if err != nil || fork == nil {
+			t.Fatalf("disconnected header is not in the forks : %+v", err)
+		}
+	}
+	if len(ft.disconnected) != 2 || ft.disconnected[0] != 5 || ft.disconnected[1] != 4 {
+		t.Fatalf("blocks are not disconnected from the tip : %v", ft.disconnected)
+	}
+	if len(ft.disconnTxs[0]) != 1 || ft.disconnTxs[0][0].Hash != tx.TxHash() || len(ft.disconnTxs[1]) != 0 {
+		t.Fatalf("unmatch disconnected transactions : %v", ft.disconnTxs)
+	}
+	if len(ft.forks) != 1 || ft.forks[0] != [2]int{3, 6} {
+		t.Fatalf("unmatch fork notification : %v", ft.forks)
+	}
+	if spv.checkHeight != 4 {
+		t.Fatalf("check height is not rewound : %d", spv.checkHeight)
+	}
+	if status := spv.getTxStatus(tx.TxHash()); status != TxStatusAnnounced {
+		t.Fatalf("disconnected transaction is not unconfirmed : %d", status)
+	}
+	var reorg *Reorg
+	for len(sub.Events()) > 0 {
+		if event, ok := (<-sub.Events()).(Reorg); ok {
+			reorg = &event
+		}
+	}
+	if reorg == nil || *reorg != (Reorg{ForkHeight: 3, OldTipHeight: 5, NewTipHeight: 6}) {
+		t.Fatalf("unmatch reorg event : %+v", reorg)
+	}
+}
+
+func TestRecvForkHeadersRejected(t *testing.T) {
+	ft := newForkTest(t)
+	spv := ft.spv
+	// the headers which do not connect to any stored header
+	orphan := mineChain(&wire.BlockHeader{PrevBlock: chainhash.Hash{1}, Timestamp: ft.main[5].Timestamp}, 1, 0)
+	if spv.recvForkHeaders(ft.peer, orphan, 5) || !spv.errHeaders {
+		t.Fatalf("orphan header is accepted")
+	}
+	// the branch forks before the checkpoint at height 4
+	spv.errHeaders = false
+	spv.params.Checkpoints = []chaincfg.Checkpoint{{Height: 4, Hash: newHash(ft.main[4].BlockHash())}}
+	side := mineChain(ft.main[3], 3, time.Minute)
+	if spv.recvForkHeaders(ft.peer, side, 5) || !spv.errHeaders || !ft.peer.isClosed() {
+		t.Fatalf("branch before the checkpoint is accepted")
+	}
+	tip, height, err := spv.data.GetTip()
+	if err != nil || height != 5 || tip.BlockHash() != ft.main[5].BlockHash() {
+		t.Fatalf("tip is changed : %d %+v", height, err)
+	}
+	if len(ft.disconnected) != 0 || len(ft.forks) != 0 {
+		t.Fatalf("callbacks are called : %v %v", ft.disconnected, ft.forks)
+	}
+}
+
+func newHash(hash chainhash.Hash) *chainhash.Hash {
+	return &hash
+}
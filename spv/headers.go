@@ -2,6 +2,7 @@
 package spv
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -40,85 +41,161 @@ func (spv *Spv) getInitHashHeight() (*chainhash.Hash, int) {
 }
 
 func (spv *Spv) updateHeaders() {
+	peer := spv.bestPeer()
+	if peer == nil {
+		log.Printf("no peer to update headers")
+		spv.errHeaders = true
+		return
+	}
 	msg := wire.NewMsgGetHeaders()
-	msg.ProtocolVersion = spv.pver
-	height := spv.checkHeight
-	cnt, min, max, err := spv.data.GetCntMinMaxHeight()
+	msg.ProtocolVersion = peer.protocolVersion()
+	tip, max, err := spv.data.GetTip()
 	if err != nil {
-		log.Printf("spv.data.GetCntMinMaxHeight Error : %+v", err)
+		log.Printf("spv.data.GetTip Error : %+v", err)
 		spv.errHeaders = true
 		return
 	}
-	if cnt == 0 {
+	if tip == nil {
 		hash, height := spv.getInitHashHeight()
 		log.Printf("get first header : %d , %v", height, hash)
 		msg := wire.NewMsgGetData()
 		inv := wire.NewInvVect(wire.InvTypeBlock, hash)
 		msg.AddInvVect(inv)
-		spv.sendMsg(msg)
+		peer.sendMsg(msg)
 		return
 	}
-	if max-min > 6 {
-		height = max - 6
-	}
-	header, _, err := spv.data.GetHeaderByHeight(height)
+	locator, err := spv.blockLocator(tip, max)
 	if err != nil {
-		log.Printf("spv.data.GetMaxHeight Error : %+v", err)
+		log.Printf("spv.blockLocator Error : %+v", err)
 		spv.errHeaders = true
 		return
 	}
-	blockHash := header.BlockHash()
-	msg.AddBlockLocatorHash(&blockHash)
-	spv.sendMsg(msg)
+	for _, hash := range locator {
+		msg.AddBlockLocatorHash(hash)
+	}
+	peer.sendMsg(msg)
+}
+
+// blockLocator returns the block locator from the tip at the max height to the first stored header
+// the last 10 hashes are included, and then the step is doubled
+func (spv *Spv) blockLocator(tip *wire.BlockHeader, max int) ([]*chainhash.Hash, error) {
+	_, min, _, err := spv.data.GetCntMinMaxHeight()
+	if err != nil {
+		return nil, err
+	}
+	recent, start, err := spv.data.GetAncestors(tip.BlockHash(), 10)
+	if err != nil {
+		return nil, err
+	}
+	if len(recent) == 0 || start+len(recent)-1 != max {
+		return nil, fmt.Errorf("header not found : %d", max)
+	}
+	var locator []*chainhash.Hash
+	for i := len(recent) - 1; i >= 0; i-- {
+		hash := recent[i].BlockHash()
+		locator = append(locator, &hash)
+	}
+	if start <= min {
+		return locator, nil
+	}
+	step := 2
+	for height := start - step; ; height -= step {
+		if height < min {
+			height = min
+		}
+		header, _, err := spv.data.GetHeaderByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		if header == nil {
+			return nil, fmt.Errorf("header not found : %d", height)
+		}
+		hash := header.BlockHash()
+		locator = append(locator, &hash)
+		if height == min || len(locator) >= wire.MaxBlockLocatorsPerMsg {
+			break
+		}
+		step *= 2
+	}
+	return locator, nil
 }
 
-func (spv *Spv) recvHeaders(msg *wire.MsgHeaders) {
+func (spv *Spv) recvHeaders(peer *Peer, msg *wire.MsgHeaders) {
 	if len(msg.Headers) == 0 {
 		spv.updateBlock()
 		return
 	}
-	cnt, _, lastHeight, err := spv.data.GetCntMinMaxHeight()
+	tip, lastHeight, err := spv.data.GetTip()
 	if err != nil {
-		log.Printf("spv.data.GetCntMinMaxHeight Error : %+v", err)
+		log.Printf("spv.data.GetTip Error : %+v", err)
 		spv.errHeaders = true
 		return
 	}
-	if cnt == 0 {
+	if tip == nil {
 		log.Printf("headers count is zero")
 		spv.errHeaders = true
 		return
 	}
+	tipHash := tip.BlockHash()
 	for i, header := range msg.Headers {
 		hash := header.BlockHash()
-		gheader, _, err := spv.data.GetHeaderByHash(hash)
+		exist, err := spv.hasHeader(hash)
 		if err != nil {
-			log.Printf("spv.data.GetHeaderByHash Error : %+v", err)
+			log.Printf("spv.hasHeader Error : %+v", err)
 			spv.errHeaders = true
 			return
 		}
-		if gheader != nil {
+		if exist {
 			continue
 		}
-		_, height, err := spv.data.GetHeaderByHash(header.PrevBlock)
+		height := lastHeight
+		if !header.PrevBlock.IsEqual(&tipHash) {
+			_, height, err = spv.data.GetHeaderByHash(header.PrevBlock)
+			if err != nil {
+				log.Printf("spv.data.GetHeaderByHash Error : %+v", err)
+				spv.errHeaders = true
+				return
+			}
+		}
 		if lastHeight != height {
-			// TODO Fork
-			log.Printf("Fork!")
+			log.Printf("Fork! %v", header.PrevBlock)
+			if !spv.recvForkHeaders(peer, msg.Headers[i:], lastHeight) {
+				return
+			}
+			break
+		}
+		chain, err := spv.newValidationChain(header.PrevBlock, height+1)
+		if err != nil {
+			log.Printf("spv.newValidationChain Error : %+v", err)
+			spv.errHeaders = true
 			return
 		}
+		for j, h := range msg.Headers[i:] {
+			err = spv.validateHeader(chain, h, height+1+j)
+			if err != nil {
+				log.Printf("spv.validateHeader Error : %+v", err)
+				peer.penalize(PeerBanScore, "invalid header")
+				spv.errHeaders = true
+				return
+			}
+			chain.add(h, height+1+j)
+		}
 		err = spv.data.PutHeaders(msg.Headers[i:], height+1)
 		if err != nil {
 			log.Printf("spv.data.PutHeader Error : %+v", err)
 			spv.errHeaders = true
 			return
 		}
+		peer.setBestHeight(int32(height + len(msg.Headers) - i))
+		spv.headerTipChanged(msg.Headers[len(msg.Headers)-1].BlockHash(), height+len(msg.Headers)-i)
 		break
 	}
 	if len(msg.Headers) == 2000 {
 		smsg := wire.NewMsgGetHeaders()
-		smsg.ProtocolVersion = spv.pver
+		smsg.ProtocolVersion = peer.protocolVersion()
 		blockhash := msg.Headers[len(msg.Headers)-1].BlockHash()
 		smsg.AddBlockLocatorHash(&blockhash)
-		spv.sendMsg(smsg)
+		peer.sendMsg(smsg)
 	} else {
 		spv.updateBlock()
 	}
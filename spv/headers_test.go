@@ -0,0 +1,59 @@
+// Package spv project headers_test.go
+package spv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestBlockLocator(t *testing.T) {
+	cases := []struct {
+		min  int
+		max  int
+		want []int
+	}{
+		{0, 0, []int{0}},
+		{0, 5, []int{5, 4, 3, 2, 1, 0}},
+		{0, 9, []int{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		{0, 10, []int{10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		{0, 11, []int{11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 0}},
+		{0, 100, []int{100, 99, 98, 97, 96, 95, 94, 93, 92, 91, 89, 85, 77, 61, 29, 0}},
+		{50, 59, []int{59, 58, 57, 56, 55, 54, 53, 52, 51, 50}},
+		{50, 61, []int{61, 60, 59, 58, 57, 56, 55, 54, 53, 52, 50}},
+		{50, 100, []int{100, 99, 98, 97, 96, 95, 94, 93, 92, 91, 89, 85, 77, 61, 50}},
+		{61, 100, []int{100, 99, 98, 97, 96, 95, 94, 93, 92, 91, 89, 85, 77, 61}},
+	}
+	for i, c := range cases {
+		spv := newTestSpv(t, nil)
+		headers := testHeaders(chainhash.Hash{byte(i + 1)}, c.max-c.min+1, 0)
+		putTestHeaders(t, spv, headers, c.min)
+		locator, err := spv.blockLocator(headers[len(headers)-1], c.max)
+		if err != nil {
+			t.Errorf("case %d : spv.blockLocator Error : %+v", i, err)
+			continue
+		}
+		var heights []int
+		for _, hash := range locator {
+			_, height, err := spv.data.GetHeaderByHash(*hash)
+			if err != nil {
+				t.Fatalf("spv.data.GetHeaderByHash Error : %+v", err)
+			}
+			heights = append(heights, height)
+		}
+		if !reflect.DeepEqual(heights, c.want) {
+			t.Errorf("case %d : unmatch locator : %v %v", i, heights, c.want)
+		}
+	}
+}
+
+func TestBlockLocatorNotTip(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	headers := testHeaders(chainhash.Hash{1}, 20, 0)
+	putTestHeaders(t, spv, headers, 0)
+	_, err := spv.blockLocator(headers[10], 19)
+	if err == nil {
+		t.Fatalf("locator of the header which is not at the height is returned")
+	}
+}
@@ -0,0 +1,775 @@
+// Package spv project leveldata.go
+package spv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/goleveldb/leveldb"
+	"github.com/btcsuite/goleveldb/leveldb/storage"
+	"github.com/btcsuite/goleveldb/leveldb/util"
+)
+
+// key prefixes of LevelData
+var (
+	prefixKvs      = []byte("k")
+	prefixHeader   = []byte("h")
+	prefixHeight   = []byte("n")
+	prefixFork     = []byte("f")
+	prefixCFHeader = []byte("c")
+	prefixTx       = []byte("t")
+	prefixTxStatus = []byte("s")
+	prefixMempool  = []byte("m")
+	prefixAddr     = []byte("a")
+	prefixWork     = []byte("w")
+)
+
+// LevelData is the pure-Go Store with leveldb
+type LevelData struct {
+	db    *leveldb.DB
+	mutex *sync.Mutex
+	cache *headerCache
+}
+
+// NewLevelData returns a new LevelData stored in the data directory
+func NewLevelData(name, datadir string) (*LevelData, error) {
+	path := fmt.Sprintf("%sheaders-%s.ldb", datadir, name)
+	log.Printf("%s", path)
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		log.Printf("leveldb.OpenFile Error : %+v", err)
+		return nil, err
+	}
+	data := newLevelData(db)
+	err = data.fillChainWork()
+	if err != nil {
+		log.Printf("data.fillChainWork Error : %+v", err)
+		db.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// NewMemData returns a new LevelData stored in memory
+// the data is lost when it is closed, so it is for tests
+func NewMemData() (*LevelData, error) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		log.Printf("leveldb.Open Error : %+v", err)
+		return nil, err
+	}
+	return newLevelData(db), nil
+}
+
+func newLevelData(db *leveldb.DB) *LevelData {
+	data := &LevelData{}
+	data.db = db
+	data.mutex = new(sync.Mutex)
+	data.cache = newHeaderCache()
+	return data
+}
+
+// Close closes the database
+func (data *LevelData) Close() error {
+	return data.db.Close()
+}
+
+func levelKey(prefix []byte, key []byte) []byte {
+	bs := make([]byte, 0, len(prefix)+len(key))
+	bs = append(bs, prefix...)
+	return append(bs, key...)
+}
+
+func heightKey(prefix []byte, height int) []byte {
+	bs := make([]byte, 4)
+	binary.BigEndian.PutUint32(bs, uint32(height))
+	return levelKey(prefix, bs)
+}
+
+// get returns nil if the key is not found
+func (data *LevelData) get(key []byte) ([]byte, error) {
+	val, err := data.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("db.Get Error : %+v", err)
+		return nil, err
+	}
+	return val, nil
+}
+
+// KVS
+
+// PutInt puts key and number
+func (data *LevelData) PutInt(key string, i int) error {
+	if i == 0 {
+		return data.Put(key, []byte{0x00})
+	}
+	bi := big.NewInt(int64(i))
+	return data.Put(key, bi.Bytes())
+}
+
+// GetInt gets number by key
+func (data *LevelData) GetInt(key string, defaultInt int) (int, error) {
+	bs, err := data.Get(key)
+	if err != nil {
+		return defaultInt, err
+	}
+	if bs == nil {
+		return defaultInt, nil
+	}
+	bi := new(big.Int)
+	bi.SetBytes(bs)
+	return int(bi.Int64()), nil
+}
+
+// Put puts key and value
+func (data *LevelData) Put(key string, val []byte) error {
+	return data.db.Put(levelKey(prefixKvs, []byte(key)), val, nil)
+}
+
+// Get gets value by key
+func (data *LevelData) Get(key string) ([]byte, error) {
+	return data.get(levelKey(prefixKvs, []byte(key)))
+}
+
+// Del delete key
+func (data *LevelData) Del(key string) error {
+	return data.db.Delete(levelKey(prefixKvs, []byte(key)), nil)
+}
+
+// Header
+
+// encodeHeader returns height and serialized header
+func encodeHeader(header *wire.BlockHeader, height int) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint32(height))
+	header.Serialize(buf)
+	return buf.Bytes()
+}
+
+func decodeHeader(bs []byte) (*wire.BlockHeader, int, error) {
+	if len(bs) < 4 {
+		return nil, -1, fmt.Errorf("invalid header data")
+	}
+	header := new(wire.BlockHeader)
+	err := header.Deserialize(bytes.NewReader(bs[4:]))
+	if err != nil {
+		log.Printf("header.Deserialize Error : %+v", err)
+		return nil, -1, err
+	}
+	return header, int(binary.BigEndian.Uint32(bs[:4])), nil
+}
+
+// GetHeaderByHash gets header by hash
+func (data *LevelData) GetHeaderByHash(hash chainhash.Hash) (*wire.BlockHeader, int, error) {
+	bs, err := data.get(levelKey(prefixHeader, hash[:]))
+	if err != nil || bs == nil {
+		return nil, -1, err
+	}
+	return decodeHeader(bs)
+}
+
+// GetHeaderByHeight gets header by height
+func (data *LevelData) GetHeaderByHeight(height int) (*wire.BlockHeader, int, error) {
+	if height < 0 {
+		return nil, -1, nil
+	}
+	hash, err := data.get(heightKey(prefixHeight, height))
+	if err != nil || hash == nil {
+		return nil, -1, err
+	}
+	bs, err := data.get(levelKey(prefixHeader, hash))
+	if err != nil || bs == nil {
+		return nil, -1, err
+	}
+	return decodeHeader(bs)
+}
+
+// PutHeaders puts headers
+func (data *LevelData) PutHeaders(headers []*wire.BlockHeader, startHeight int) error {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	batch := new(leveldb.Batch)
+	work, err := data.getChainWork(startHeight - 1)
+	if err != nil {
+		return err
+	}
+	for i, header := range headers {
+		height := startHeight + i
+		hash := header.BlockHash()
+		exist, err := data.db.Has(heightKey(prefixHeight, height), nil)
+		if err != nil {
+			log.Printf("db.Has Error : %+v", err)
+			return err
+		}
+		if !exist {
+			exist, err = data.db.Has(levelKey(prefixHeader, hash[:]), nil)
+			if err != nil {
+				log.Printf("db.Has Error : %+v", err)
+				return err
+			}
+		}
+		if exist {
+			return fmt.Errorf("header already exists : %d %v", height, hash)
+		}
+		work = addWork(work, header)
+		batch.Put(levelKey(prefixHeader, hash[:]), encodeHeader(header, height))
+		batch.Put(heightKey(prefixHeight, height), hash[:])
+		batch.Put(heightKey(prefixWork, height), work.Bytes())
+	}
+	err = data.db.Write(batch, nil)
+	if err != nil {
+		log.Printf("db.Write Error : %+v", err)
+		return err
+	}
+	data.cache.update(headers, startHeight)
+	return nil
+}
+
+// GetCntMinMaxHeight gets count, max and min height
+// if count is zero, max and min is -1
+func (data *LevelData) GetCntMinMaxHeight() (int, int, int, error) {
+	cnt, min, max, _, err := data.cache.get(data.loadHeaderCache)
+	return cnt, min, max, err
+}
+
+// loadHeaderCache reads count, min height, max height and the tip
+func (data *LevelData) loadHeaderCache() (int, int, int, *wire.BlockHeader, error) {
+	iter := data.db.NewIterator(util.BytesPrefix(prefixHeight), nil)
+	defer iter.Release()
+	if !iter.First() {
+		return 0, -1, -1, nil, iter.Error()
+	}
+	min := int(binary.BigEndian.Uint32(iter.Key()[len(prefixHeight):]))
+	iter.Last()
+	max := int(binary.BigEndian.Uint32(iter.Key()[len(prefixHeight):]))
+	if iter.Error() != nil {
+		return -1, -1, -1, nil, iter.Error()
+	}
+	tip, _, err := data.GetHeaderByHeight(max)
+	if err != nil {
+		return -1, -1, -1, nil, err
+	}
+	return max - min + 1, min, max, tip, nil
+}
+
+// GetTip gets the header and the height of the tip
+// if there is no header, it returns nil and -1
+func (data *LevelData) GetTip() (*wire.BlockHeader, int, error) {
+	cnt, _, max, tip, err := data.cache.get(data.loadHeaderCache)
+	if err != nil || cnt == 0 {
+		return nil, -1, err
+	}
+	return tip, max, nil
+}
+
+// GetHeadersByHeight gets the headers from startHeight to endHeight
+// it returns the stored headers in the range and the height of the first header
+func (data *LevelData) GetHeadersByHeight(startHeight, endHeight int) ([]*wire.BlockHeader, int, error) {
+	if startHeight < 0 {
+		startHeight = 0
+	}
+	if endHeight < startHeight {
+		return nil, -1, nil
+	}
+	iter := data.db.NewIterator(&util.Range{Start: heightKey(prefixHeight, startHeight), Limit: heightKey(prefixHeight, endHeight+1)}, nil)
+	defer iter.Release()
+	var headers []*wire.BlockHeader
+	first := -1
+	for iter.Next() {
+		bs, err := data.get(levelKey(prefixHeader, iter.Value()))
+		if err != nil {
+			return nil, -1, err
+		}
+		if bs == nil {
+			return nil, -1, fmt.Errorf("header not found : %x", iter.Value())
+		}
+		header, height, err := decodeHeader(bs)
+		if err != nil {
+			return nil, -1, err
+		}
+		if first < 0 {
+			first = height
+		}
+		headers = append(headers, header)
+	}
+	return headers, first, iter.Error()
+}
+
+// GetAncestors gets the header of the hash and its previous headers from the lowest
+// at most count headers are returned, with the height of the first header
+func (data *LevelData) GetAncestors(hash chainhash.Hash, count int) ([]*wire.BlockHeader, int, error) {
+	return getAncestors(data, hash, count)
+}
+
+// GetChainWork gets the chain work of the header at the height
+// if the header is not found, it returns nil
+func (data *LevelData) GetChainWork(height int) (*big.Int, error) {
+	if height < 0 {
+		return nil, nil
+	}
+	bs, err := data.get(heightKey(prefixWork, height))
+	if err != nil || bs == nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bs), nil
+}
+
+// getChainWork gets the chain work at the height, if it is not found, it returns zero
+func (data *LevelData) getChainWork(height int) (*big.Int, error) {
+	work, err := data.GetChainWork(height)
+	if err != nil {
+		return nil, err
+	}
+	if work == nil {
+		return big.NewInt(0), nil
+	}
+	return work, nil
+}
+
+// fillChainWork fills the chain work of the headers stored without it
+func (data *LevelData) fillChainWork() error {
+	_, min, max, err := data.GetCntMinMaxHeight()
+	if err != nil || max < 0 {
+		return err
+	}
+	exist, err := data.db.Has(heightKey(prefixWork, max), nil)
+	if err != nil || exist {
+		return err
+	}
+	log.Printf("fill chain work from : %d", min)
+	headers, start, err := data.GetHeadersByHeight(min, max)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	work := big.NewInt(0)
+	for i, header := range headers {
+		work = addWork(work, header)
+		batch.Put(heightKey(prefixWork, start+i), work.Bytes())
+	}
+	return data.db.Write(batch, nil)
+}
+
+// GetForkHeader gets header of the side branch by hash
+func (data *LevelData) GetForkHeader(hash chainhash.Hash) (*wire.BlockHeader, int, error) {
+	bs, err := data.get(levelKey(prefixFork, hash[:]))
+	if err != nil || bs == nil {
+		return nil, -1, err
+	}
+	return decodeHeader(bs)
+}
+
+// PutForkHeaders puts headers of the side branch
+func (data *LevelData) PutForkHeaders(headers []*wire.BlockHeader, startHeight int) error {
+	batch := new(leveldb.Batch)
+	for i, header := range headers {
+		hash := header.BlockHash()
+		batch.Put(levelKey(prefixFork, hash[:]), encodeHeader(header, startHeight+i))
+	}
+	return data.db.Write(batch, nil)
+}
+
+// Reorg replaces headers from startHeight with the headers of the side branch
+// the replaced headers are moved to the side branch
+func (data *LevelData) Reorg(headers []*wire.BlockHeader, startHeight int) error {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	batch := new(leveldb.Batch)
+	work, err := data.getChainWork(startHeight - 1)
+	if err != nil {
+		return err
+	}
+	iter := data.db.NewIterator(&util.Range{Start: heightKey(prefixHeight, startHeight), Limit: util.BytesPrefix(prefixHeight).Limit}, nil)
+	for iter.Next() {
+		hash := append([]byte{}, iter.Value()...)
+		bs, err := data.get(levelKey(prefixHeader, hash))
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		batch.Put(levelKey(prefixFork, hash), bs)
+		batch.Delete(levelKey(prefixHeader, hash))
+		batch.Delete(append([]byte{}, iter.Key()...))
+		batch.Delete(levelKey(prefixWork, iter.Key()[len(prefixHeight):]))
+	}
+	iter.Release()
+	if iter.Error() != nil {
+		return iter.Error()
+	}
+	iter = data.db.NewIterator(&util.Range{Start: heightKey(prefixCFHeader, startHeight), Limit: util.BytesPrefix(prefixCFHeader).Limit}, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if iter.Error() != nil {
+		return iter.Error()
+	}
+	for i, header := range headers {
+		height := startHeight + i
+		hash := header.BlockHash()
+		batch.Put(levelKey(prefixHeader, hash[:]), encodeHeader(header, height))
+		work = addWork(work, header)
+		batch.Put(heightKey(prefixHeight, height), hash[:])
+		batch.Put(heightKey(prefixWork, height), work.Bytes())
+		batch.Delete(levelKey(prefixFork, hash[:]))
+	}
+	err = data.db.Write(batch, nil)
+	if err != nil {
+		log.Printf("db.Write Error : %+v", err)
+		return err
+	}
+	data.cache.update(headers, startHeight)
+	return nil
+}
+
+// ReorgForks moves the replaced headers to the side branch, and removes the headers of the new branch from it
+// and the filter headers from startHeight, it is used by FlatData which stores the main chain headers by itself
+func (data *LevelData) ReorgForks(replaced, headers []*wire.BlockHeader, startHeight int) error {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	batch := new(leveldb.Batch)
+	iter := data.db.NewIterator(&util.Range{Start: heightKey(prefixCFHeader, startHeight), Limit: util.BytesPrefix(prefixCFHeader).Limit}, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if iter.Error() != nil {
+		return iter.Error()
+	}
+	for i, header := range replaced {
+		hash := header.BlockHash()
+		batch.Put(levelKey(prefixFork, hash[:]), encodeHeader(header, startHeight+i))
+	}
+	for _, header := range headers {
+		hash := header.BlockHash()
+		batch.Delete(levelKey(prefixFork, hash[:]))
+	}
+	err := data.db.Write(batch, nil)
+	if err != nil {
+		log.Printf("db.Write Error : %+v", err)
+		return err
+	}
+	return nil
+}
+
+// Filter header
+
+// PutCFHeaders puts filter headers
+func (data *LevelData) PutCFHeaders(cfheaders []chainhash.Hash, startHeight int) error {
+	batch := new(leveldb.Batch)
+	for i, cfheader := range cfheaders {
+		batch.Put(heightKey(prefixCFHeader, startHeight+i), cfheader.CloneBytes())
+	}
+	return data.db.Write(batch, nil)
+}
+
+// GetCFHeader gets filter header by height
+func (data *LevelData) GetCFHeader(height int) (*chainhash.Hash, error) {
+	bs, err := data.get(heightKey(prefixCFHeader, height))
+	if err != nil || bs == nil {
+		return nil, err
+	}
+	return chainhash.NewHash(bs)
+}
+
+// GetCFHeaderTip gets the max height of filter headers
+// if there is no filter header, it returns -1
+func (data *LevelData) GetCFHeaderTip() (int, error) {
+	iter := data.db.NewIterator(util.BytesPrefix(prefixCFHeader), nil)
+	defer iter.Release()
+	if !iter.Last() {
+		return -1, iter.Error()
+	}
+	return int(binary.BigEndian.Uint32(iter.Key()[len(prefixCFHeader):])), nil
+}
+
+// Tx
+
+func encodeTx(msgTx *wire.MsgTx) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := msgTx.Serialize(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeTx(bs []byte) (*wire.MsgTx, error) {
+	tx := &wire.MsgTx{}
+	err := tx.Deserialize(bytes.NewReader(bs))
+	if err != nil {
+		tx = &wire.MsgTx{}
+		err = tx.DeserializeNoWitness(bytes.NewReader(bs))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// PutTx puts MsgTx
+func (data *LevelData) PutTx(msgTx *wire.MsgTx) error {
+	bs, err := encodeTx(msgTx)
+	if err != nil {
+		log.Printf("encodeTx Error : %+v", err)
+		return err
+	}
+	hash := msgTx.TxHash()
+	return data.db.Put(levelKey(prefixTx, hash[:]), bs, nil)
+}
+
+// GetTx gets MsgTx by hash
+func (data *LevelData) GetTx(hash chainhash.Hash) (*wire.MsgTx, error) {
+	bs, err := data.get(levelKey(prefixTx, hash[:]))
+	if err != nil || bs == nil {
+		return nil, err
+	}
+	return decodeTx(bs)
+}
+
+// ListTxHash gets transaction hashes
+func (data *LevelData) ListTxHash() ([]chainhash.Hash, error) {
+	iter := data.db.NewIterator(util.BytesPrefix(prefixTx), nil)
+	defer iter.Release()
+	var list []chainhash.Hash
+	for iter.Next() {
+		hash, err := chainhash.NewHash(iter.Key()[len(prefixTx):])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *hash)
+	}
+	return list, iter.Error()
+}
+
+// DelTx delete MsgTx by hash
+func (data *LevelData) DelTx(hash chainhash.Hash) error {
+	return data.db.Delete(levelKey(prefixTx, hash[:]), nil)
+}
+
+// PutTxStatus puts the broadcast status of MsgTx
+func (data *LevelData) PutTxStatus(hash chainhash.Hash, status int, updated int64, reason string) error {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, int32(status))
+	binary.Write(buf, binary.BigEndian, updated)
+	buf.WriteString(reason)
+	return data.db.Put(levelKey(prefixTxStatus, hash[:]), buf.Bytes(), nil)
+}
+
+// GetTxStatus gets the broadcast status of MsgTx by hash
+// if the status is not found, status is -1
+func (data *LevelData) GetTxStatus(hash chainhash.Hash) (int, int64, string, error) {
+	bs, err := data.get(levelKey(prefixTxStatus, hash[:]))
+	if err != nil || bs == nil {
+		return -1, 0, "", err
+	}
+	if len(bs) < 12 {
+		return -1, 0, "", fmt.Errorf("invalid tx status data")
+	}
+	status := int(int32(binary.BigEndian.Uint32(bs[:4])))
+	updated := int64(binary.BigEndian.Uint64(bs[4:12]))
+	return status, updated, string(bs[12:]), nil
+}
+
+// Mempool
+
+// PutMempoolTx puts unconfirmed MsgTx with the received time
+func (data *LevelData) PutMempoolTx(msgTx *wire.MsgTx, t int64) error {
+	bs, err := encodeTx(msgTx)
+	if err != nil {
+		log.Printf("encodeTx Error : %+v", err)
+		return err
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, t)
+	buf.Write(bs)
+	hash := msgTx.TxHash()
+	return data.db.Put(levelKey(prefixMempool, hash[:]), buf.Bytes(), nil)
+}
+
+// ListMempoolTx gets unconfirmed MsgTxs and the received times
+func (data *LevelData) ListMempoolTx() ([]*wire.MsgTx, []int64, error) {
+	iter := data.db.NewIterator(util.BytesPrefix(prefixMempool), nil)
+	defer iter.Release()
+	var mtxs []*mempoolTx
+	for iter.Next() {
+		bs := iter.Value()
+		if len(bs) < 8 {
+			return nil, nil, fmt.Errorf("invalid mempool data")
+		}
+		tx, err := decodeTx(bs[8:])
+		if err != nil {
+			log.Printf("decodeTx Error : %+v", err)
+			return nil, nil, err
+		}
+		mtxs = append(mtxs, &mempoolTx{tx: tx, time: time.Unix(int64(binary.BigEndian.Uint64(bs[:8])), 0)})
+	}
+	if iter.Error() != nil {
+		return nil, nil, iter.Error()
+	}
+	sort.SliceStable(mtxs, func(i, j int) bool {
+		return mtxs[i].time.Before(mtxs[j].time)
+	})
+	var txs []*wire.MsgTx
+	var times []int64
+	for _, mtx := range mtxs {
+		txs = append(txs, mtx.tx)
+		times = append(times, mtx.time.Unix())
+	}
+	return txs, times, nil
+}
+
+// DelMempoolTx delete unconfirmed MsgTx by hash
+func (data *LevelData) DelMempoolTx(hash chainhash.Hash) error {
+	return data.db.Delete(levelKey(prefixMempool, hash[:]), nil)
+}
+
+// Addr
+
+func encodeAddrInfo(info *AddrInfo) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, info.Services)
+	binary.Write(buf, binary.BigEndian, info.LastSeen)
+	binary.Write(buf, binary.BigEndian, info.LastAttempt)
+	binary.Write(buf, binary.BigEndian, int64(info.Success))
+	binary.Write(buf, binary.BigEndian, int64(info.Failure))
+	return buf.Bytes()
+}
+
+func decodeAddrInfo(addr string, bs []byte) (*AddrInfo, error) {
+	if len(bs) != 40 {
+		return nil, fmt.Errorf("invalid addr data : %s", addr)
+	}
+	info := &AddrInfo{}
+	info.Addr = addr
+	info.Services = binary.BigEndian.Uint64(bs[0:8])
+	info.LastSeen = int64(binary.BigEndian.Uint64(bs[8:16]))
+	info.LastAttempt = int64(binary.BigEndian.Uint64(bs[16:24]))
+	info.Success = int(int64(binary.BigEndian.Uint64(bs[24:32])))
+	info.Failure = int(int64(binary.BigEndian.Uint64(bs[32:40])))
+	return info, nil
+}
+
+// getAddr returns the address book entry and whether it exists
+// if it is not found, it returns a new entry
+func (data *LevelData) getAddr(addr string) (*AddrInfo, bool, error) {
+	bs, err := data.get(levelKey(prefixAddr, []byte(addr)))
+	if err != nil {
+		return nil, false, err
+	}
+	if bs == nil {
+		info := &AddrInfo{}
+		info.Addr = addr
+		return info, false, nil
+	}
+	info, err := decodeAddrInfo(addr, bs)
+	return info, true, err
+}
+
+// PutAddr puts address, if the address exists, it updates services and last seen
+func (data *LevelData) PutAddr(addr string, services uint64, lastSeen int64) error {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	info, exist, err := data.getAddr(addr)
+	if err != nil {
+		return err
+	}
+	if exist && info.LastSeen >= lastSeen {
+		return nil
+	}
+	info.Services = services
+	info.LastSeen = lastSeen
+	return data.db.Put(levelKey(prefixAddr, []byte(addr)), encodeAddrInfo(info), nil)
+}
+
+// MarkAddr records the result of the connection attempt to the address
+func (data *LevelData) MarkAddr(addr string, success bool, attempt int64) error {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	info, _, err := data.getAddr(addr)
+	if err != nil {
+		return err
+	}
+	info.LastAttempt = attempt
+	if success {
+		info.Success++
+		info.LastSeen = attempt
+	} else {
+		info.Failure++
+	}
+	return data.db.Put(levelKey(prefixAddr, []byte(addr)), encodeAddrInfo(info), nil)
+}
+
+// ListAddrs gets addresses ordered by score (success - failure) and last seen
+// addresses attempted after lastAttempt are excluded
+func (data *LevelData) ListAddrs(lastAttempt int64, limit int) ([]*AddrInfo, error) {
+	iter := data.db.NewIterator(util.BytesPrefix(prefixAddr), nil)
+	defer iter.Release()
+	var list []*AddrInfo
+	for iter.Next() {
+		info, err := decodeAddrInfo(string(iter.Key()[len(prefixAddr):]), iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		if info.LastAttempt > lastAttempt {
+			continue
+		}
+		list = append(list, info)
+	}
+	if iter.Error() != nil {
+		return nil, iter.Error()
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		si := list[i].Success - list[i].Failure
+		sj := list[j].Success - list[j].Failure
+		if si != sj {
+			return si > sj
+		}
+		return list[i].LastSeen > list[j].LastSeen
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// CountAddrs gets the number of addresses
+func (data *LevelData) CountAddrs() (int, error) {
+	iter := data.db.NewIterator(util.BytesPrefix(prefixAddr), nil)
+	defer iter.Release()
+	cnt := 0
+	for iter.Next() {
+		cnt++
+	}
+	return cnt, iter.Error()
+}
+
+// TrimAddrs deletes the addresses with the lowest score and the oldest last seen over max
+func (data *LevelData) TrimAddrs(max int) error {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	list, err := data.ListAddrs(math.MaxInt64, math.MaxInt32)
+	if err != nil {
+		return err
+	}
+	if len(list) <= max {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	for _, info := range list[max:] {
+		batch.Delete(levelKey(prefixAddr, []byte(info.Addr)))
+	}
+	return data.db.Write(batch, nil)
+}
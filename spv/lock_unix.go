@@ -0,0 +1,38 @@
+// Package spv project lock_unix.go
+
+//go:build !windows
+// +build !windows
+
+package spv
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens the lock file and locks it with flock
+// the lock is released by the OS when the process exits
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrDataDirLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func unlockFile(file *os.File, path string) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
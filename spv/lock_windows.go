@@ -0,0 +1,31 @@
+// Package spv project lock_windows.go
+
+//go:build windows
+// +build windows
+
+package spv
+
+import (
+	"os"
+)
+
+// lockFile creates the lock file exclusively
+// if the process crashed, the lock file must be removed manually
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, ErrDataDirLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func unlockFile(file *os.File, path string) error {
+	err := file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,273 @@
+// Package spv project mempool.go
+package spv
+
+import (
+	"bytes"
+	"container/list"
+	"log"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// mempool settings
+const (
+	MempoolMaxTxs    = 5000
+	MempoolExpiry    = 14 * 24 * time.Hour
+	MempoolRecentTxs = 50000
+)
+
+// HeightUnconfirmed is the height passed to the callbacks for unconfirmed transactions
+const HeightUnconfirmed = -1
+
+// mempoolTx is unconfirmed transaction type
+type mempoolTx struct {
+	tx   *wire.MsgTx
+	time time.Time
+}
+
+// recentTxs is the bounded set of the recently received or rejected transaction hashes
+// the oldest hash is removed when the set is full
+type recentTxs struct {
+	list  *list.List
+	index map[chainhash.Hash]*list.Element
+	max   int
+}
+
+func newRecentTxs(max int) *recentTxs {
+	recent := &recentTxs{}
+	recent.list = list.New()
+	recent.index = make(map[chainhash.Hash]*list.Element)
+	recent.max = max
+	return recent
+}
+
+// add adds the hash as the most recent one
+func (recent *recentTxs) add(hash chainhash.Hash) {
+	if elem, ok := recent.index[hash]; ok {
+		recent.list.MoveToFront(elem)
+		return
+	}
+	recent.index[hash] = recent.list.PushFront(hash)
+	if recent.list.Len() > recent.max {
+		oldest := recent.list.Back()
+		recent.list.Remove(oldest)
+		delete(recent.index, oldest.Value.(chainhash.Hash))
+	}
+}
+
+// has returns true if the hash is in the set
+func (recent *recentTxs) has(hash chainhash.Hash) bool {
+	_, ok := recent.index[hash]
+	return ok
+}
+
+// AddNotifyRemoveTx adds notifyRemoveTx function
+// notifyRemoveTx is called with the hash when the unconfirmed transaction is evicted by conflict or expiry
+func (spv *Spv) AddNotifyRemoveTx(notifyRemoveTx func(chainhash.Hash)) (*Registration, error) {
+	return spv.addCallback("notifyRemoveTx", notifyRemoveTx, nil)
+}
+
+// loadMempool loads the persisted unconfirmed transactions and calls the callbacks
+func (spv *Spv) loadMempool() error {
+	txs, times, err := spv.data.ListMempoolTx()
+	if err != nil {
+		log.Printf("spv.data.ListMempoolTx Error : %+v", err)
+		return err
+	}
+	for i, tx := range txs {
+		spv.addMempoolTx(tx, time.Unix(times[i], 0))
+		spv.callCheckTx(unconfirmedTxInfo(tx))
+	}
+	return nil
+}
+
+// requestTxs requests the announced transactions which are not known and not received recently
+// in block and cfilter mode, nothing is requested if no script or outpoint is watched
+func (spv *Spv) requestTxs(peer *Peer, invList []*wire.InvVect) {
+	if spv.filter == nil && !spv.watching() {
+		return
+	}
+	msg := wire.NewMsgGetData()
+	for _, inv := range invList {
+		if inv.Type != wire.InvTypeTx {
+			continue
+		}
+		if spv.recentTxs.has(inv.Hash) || spv.hasMempoolTx(&inv.Hash) || spv.getTxStatus(inv.Hash) >= 0 {
+			continue
+		}
+		if spv.mempoolSize() >= MempoolMaxTxs {
+			log.Printf("mempool is full")
+			break
+		}
+		invType := wire.InvTypeTx
+		if peer.hasService(wire.SFNodeWitness) {
+			invType = wire.InvTypeWitnessTx
+		}
+		msg.AddInvVect(wire.NewInvVect(invType, &inv.Hash))
+	}
+	if len(msg.InvList) > 0 {
+		peer.sendMsg(msg)
+	}
+}
+
+// recvMempoolTx persists the relevant unconfirmed transaction and calls the callbacks
+// the hash is added to the recent transactions, so the transaction is not requested again
+func (spv *Spv) recvMempoolTx(tx *wire.MsgTx) {
+	hash := tx.TxHash()
+	spv.recentTxs.add(hash)
+	if spv.hasMempoolTx(&hash) {
+		return
+	}
+	if !spv.isRelevantTx(tx) {
+		return
+	}
+	now := time.Now()
+	err := spv.data.PutMempoolTx(tx, now.Unix())
+	if err != nil {
+		log.Printf("spv.data.PutMempoolTx Error : %+v", err)
+		return
+	}
+	spv.addMempoolTx(tx, now)
+	log.Printf("unconfirmed tx : %v", hash)
+	spv.callCheckTx(unconfirmedTxInfo(tx))
+}
+
+// isRelevantTx returns whether the transaction matches the bloom filter or the watched scripts and outpoints
+// if nothing is registered, no transaction is relevant
+func (spv *Spv) isRelevantTx(tx *wire.MsgTx) bool {
+	if spv.filter != nil {
+		return spv.filter.MatchTxAndUpdate(btcutil.NewTx(tx))
+	}
+	spv.watchMutex.Lock()
+	defer spv.watchMutex.Unlock()
+	relevant := false
+	for _, txin := range tx.TxIn {
+		if spv.watchOutPoints[txin.PreviousOutPoint] {
+			relevant = true
+		}
+	}
+	hash := tx.TxHash()
+	for idx, txout := range tx.TxOut {
+		for _, script := range spv.watchScripts {
+			if bytes.Equal(txout.PkScript, script) {
+				spv.watchOutPoints[*wire.NewOutPoint(&hash, uint32(idx))] = true
+				relevant = true
+			}
+		}
+	}
+	return relevant
+}
+
+// watching returns whether any script or outpoint is watched
+func (spv *Spv) watching() bool {
+	spv.watchMutex.Lock()
+	defer spv.watchMutex.Unlock()
+	return len(spv.watchScripts) > 0 || len(spv.watchOutPoints) > 0
+}
+
+// relayTxs returns whether the peer should relay the transactions, it is sent in the version message
+// in bloom mode, the peer relays the matched transactions after filterload (BIP37),
+// and in the other modes, the transactions are relayed only if something is watched when the peer connects
+func (spv *Spv) relayTxs() bool {
+	return spv.filter == nil && spv.watching()
+}
+
+func (spv *Spv) hasMempoolTx(hash *chainhash.Hash) bool {
+	spv.mempoolMutex.Lock()
+	defer spv.mempoolMutex.Unlock()
+	_, ok := spv.mempool[*hash]
+	return ok
+}
+
+func (spv *Spv) mempoolSize() int {
+	spv.mempoolMutex.Lock()
+	defer spv.mempoolMutex.Unlock()
+	return len(spv.mempool)
+}
+
+func (spv *Spv) addMempoolTx(tx *wire.MsgTx, t time.Time) {
+	spv.mempoolMutex.Lock()
+	defer spv.mempoolMutex.Unlock()
+	hash := tx.TxHash()
+	spv.mempool[hash] = &mempoolTx{tx: tx, time: t}
+	for _, txin := range tx.TxIn {
+		spv.mempoolSpends[txin.PreviousOutPoint] = hash
+	}
+}
+
+// removeMempoolTx removes the unconfirmed transaction
+// if notify is true, notifyRemoveTx callbacks are called
+func (spv *Spv) removeMempoolTx(hash chainhash.Hash, notify bool) {
+	spv.mempoolMutex.Lock()
+	mtx, ok := spv.mempool[hash]
+	if ok {
+		delete(spv.mempool, hash)
+		for _, txin := range mtx.tx.TxIn {
+			if spv.mempoolSpends[txin.PreviousOutPoint] == hash {
+				delete(spv.mempoolSpends, txin.PreviousOutPoint)
+			}
+		}
+	}
+	spv.mempoolMutex.Unlock()
+	if !ok {
+		return
+	}
+	err := spv.data.DelMempoolTx(hash)
+	if err != nil {
+		log.Printf("spv.data.DelMempoolTx Error : %+v", err)
+	}
+	if !notify {
+		return
+	}
+	log.Printf("evict unconfirmed tx : %v", hash)
+	for _, c := range spv.getCallbacks() {
+		if notifyRemoveTx, ok := c.fn.(func(chainhash.Hash)); ok {
+			notifyRemoveTx(hash)
+		}
+	}
+}
+
+// confirmMempoolTxs removes the transactions confirmed in the block
+// and evicts the unconfirmed transactions which conflict with the block
+func (spv *Spv) confirmMempoolTxs(txs []*wire.MsgTx) {
+	var confirmed []chainhash.Hash
+	var conflicted []chainhash.Hash
+	spv.mempoolMutex.Lock()
+	for _, tx := range txs {
+		hash := tx.TxHash()
+		if _, ok := spv.mempool[hash]; ok {
+			confirmed = append(confirmed, hash)
+		}
+		for _, txin := range tx.TxIn {
+			spender, ok := spv.mempoolSpends[txin.PreviousOutPoint]
+			if ok && spender != hash {
+				conflicted = append(conflicted, spender)
+			}
+		}
+	}
+	spv.mempoolMutex.Unlock()
+	for _, hash := range confirmed {
+		spv.removeMempoolTx(hash, false)
+	}
+	for _, hash := range conflicted {
+		spv.removeMempoolTx(hash, true)
+	}
+}
+
+// expireMempoolTxs evicts the unconfirmed transactions older than MempoolExpiry
+func (spv *Spv) expireMempoolTxs() {
+	var expired []chainhash.Hash
+	spv.mempoolMutex.Lock()
+	for hash, mtx := range spv.mempool {
+		if time.Since(mtx.time) > MempoolExpiry {
+			expired = append(expired, hash)
+		}
+	}
+	spv.mempoolMutex.Unlock()
+	for _, hash := range expired {
+		spv.removeMempoolTx(hash, true)
+	}
+}
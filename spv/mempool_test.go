@@ -0,0 +1,87 @@
+// Package spv project mempool_test.go
+package spv
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestRecentTxs(t *testing.T) {
+	recent := newRecentTxs(2)
+	h1 := chainhash.Hash{1}
+	h2 := chainhash.Hash{2}
+	h3 := chainhash.Hash{3}
+	recent.add(h1)
+	recent.add(h2)
+	recent.add(h1)
+	recent.add(h3)
+	if !recent.has(h1) || !recent.has(h3) {
+		t.Fatalf("recent hashes are removed")
+	}
+	if recent.has(h2) {
+		t.Fatalf("oldest hash is not removed")
+	}
+	if recent.list.Len() != 2 || len(recent.index) != 2 {
+		t.Fatalf("unmatch size : %d %d", recent.list.Len(), len(recent.index))
+	}
+}
+
+func TestIsRelevantTx(t *testing.T) {
+	spv := &Spv{}
+	spv.watchMutex = new(sync.Mutex)
+	spv.watchOutPoints = make(map[wire.OutPoint]bool)
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{0x00, 0x14, 0x01}))
+	if spv.isRelevantTx(tx) {
+		t.Fatalf("transaction is relevant without watched scripts")
+	}
+	spv.AddWatchScript([]byte{0x00, 0x14, 0x01})
+	if !spv.isRelevantTx(tx) {
+		t.Fatalf("transaction paying to the watched script is not relevant")
+	}
+	spend := wire.NewMsgTx(wire.TxVersion)
+	hash := tx.TxHash()
+	spend.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&hash, 0), nil, nil))
+	if !spv.isRelevantTx(spend) {
+		t.Fatalf("transaction spending the watched output is not relevant")
+	}
+}
+
+func TestRequestTxs(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	peer := newTestPeer(t, spv, "peer", wire.SFNodeNetwork, 0)
+	hash := chainhash.Hash{1}
+	invList := []*wire.InvVect{wire.NewInvVect(wire.InvTypeTx, &hash)}
+	if spv.relayTxs() {
+		t.Fatalf("transactions are relayed without watched scripts")
+	}
+	spv.requestTxs(peer, invList)
+	if msgs := queuedMsgs(peer); len(msgs) != 0 {
+		t.Fatalf("transactions are requested without watched scripts : %v", msgs)
+	}
+	spv.AddWatchScript([]byte{0x00, 0x14, 0x01})
+	if !spv.relayTxs() {
+		t.Fatalf("transactions are not relayed with watched scripts")
+	}
+	spv.requestTxs(peer, invList)
+	msgs := queuedMsgs(peer)
+	if len(msgs) != 1 {
+		t.Fatalf("transactions are not requested with watched scripts : %v", msgs)
+	}
+	if getData, ok := msgs[0].(*wire.MsgGetData); !ok || getData.InvList[0].Hash != hash {
+		t.Fatalf("unmatch request : %v", msgs[0])
+	}
+}
+
+func TestRelayTxsBloom(t *testing.T) {
+	config := NewConfig()
+	config.SyncMode = SyncModeBloom
+	spv := newTestSpv(t, config)
+	spv.AddWatchScript([]byte{0x00, 0x14, 0x01})
+	if spv.relayTxs() {
+		t.Fatalf("transactions are relayed before filterload in bloom mode")
+	}
+}
@@ -0,0 +1,295 @@
+// Package spv project peer.go
+package spv
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// peer timeouts
+const (
+	PeerHandshakeTimeout = 30 * time.Second
+	PeerPingInterval     = 60 * time.Second
+	PeerPingTimeout      = 30 * time.Second
+)
+
+// PeerBanScore is the misbehavior score to disconnect the peer
+const PeerBanScore = 100
+
+// Peer is connected node type
+type Peer struct {
+	spv        *Spv
+	addr       string
+	con        net.Conn
+	msgQueue   chan wire.Message
+	quit       chan struct{}
+	closeOnce  *sync.Once
+	mutex      *sync.Mutex
+	pver       uint32
+	version    int32
+	userAgent  string
+	services   wire.ServiceFlag
+	bestHeight int32
+	latency    time.Duration
+	verAck     bool
+	connTime   time.Time
+	pingNonce  uint64
+	pingTime   time.Time
+	banScore   int
+}
+
+// peerMsg is a message received from the peer
+type peerMsg struct {
+	peer *Peer
+	msg  wire.Message
+}
+
+// newPeer returns a new Peer
+func newPeer(spv *Spv, addr string, con net.Conn) *Peer {
+	peer := &Peer{}
+	peer.spv = spv
+	peer.addr = addr
+	peer.con = con
+	peer.msgQueue = make(chan wire.Message, 50)
+	peer.quit = make(chan struct{})
+	peer.closeOnce = new(sync.Once)
+	peer.mutex = new(sync.Mutex)
+	peer.pver = wire.ProtocolVersion
+	peer.connTime = time.Now()
+	return peer
+}
+
+// Addr returns the address of the peer
+func (peer *Peer) Addr() string {
+	return peer.addr
+}
+
+// BestHeight returns the best height of the peer
+func (peer *Peer) BestHeight() int32 {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	return peer.bestHeight
+}
+
+// Latency returns the latency measured by ping and pong
+func (peer *Peer) Latency() time.Duration {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	return peer.latency
+}
+
+// IsReady returns whether the handshake is done
+func (peer *Peer) IsReady() bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	return peer.verAck
+}
+
+func (peer *Peer) hasService(service wire.ServiceFlag) bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	return peer.services&service == service
+}
+
+func (peer *Peer) protocolVersion() uint32 {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	return peer.pver
+}
+
+func (peer *Peer) setBestHeight(height int32) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	if height > peer.bestHeight {
+		peer.bestHeight = height
+	}
+}
+
+// start starts handlers and sends version message
+// the handlers are counted in the wait group of spv by addPeer
+func (peer *Peer) start() error {
+	go peer.recvHandler()
+	go peer.sendHandler()
+
+	localAddr, err := net.ResolveTCPAddr("tcp", peer.con.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	remoteAddr, err := net.ResolveTCPAddr("tcp", peer.con.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	me := wire.NewNetAddress(localAddr, 0)
+	you := wire.NewNetAddress(remoteAddr, 0)
+	msg := wire.NewMsgVersion(me, you, rand.Uint64(), 0)
+	msg.AddService(wire.SFNodeBloom)
+	msg.AddService(wire.SFNodeWitness)
+	msg.AddUserAgent("samplespv", "0.0.1")
+	msg.DisableRelayTx = !peer.spv.relayTxs()
+	peer.mutex.Lock()
+	peer.pver = uint32(msg.ProtocolVersion)
+	peer.mutex.Unlock()
+
+	peer.sendMsg(msg)
+	return nil
+}
+
+// Close closes the connection
+func (peer *Peer) Close() {
+	peer.closeOnce.Do(func() {
+		close(peer.quit)
+		err := peer.con.Close()
+		if err != nil {
+			log.Printf("peer.con.Close error : %v", err)
+		}
+		peer.spv.removePeer(peer)
+	})
+}
+
+func (peer *Peer) isClosed() bool {
+	select {
+	case <-peer.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (peer *Peer) sendMsg(msg wire.Message) {
+	select {
+	case peer.msgQueue <- msg:
+	case <-peer.quit:
+	}
+}
+
+// ping sends ping message to measure latency
+// if the previous ping is not answered within PeerPingTimeout, it returns error
+func (peer *Peer) ping() error {
+	peer.mutex.Lock()
+	if !peer.verAck {
+		defer peer.mutex.Unlock()
+		if time.Since(peer.connTime) > PeerHandshakeTimeout {
+			return fmt.Errorf("handshake timeout : %s", peer.addr)
+		}
+		return nil
+	}
+	if peer.pingNonce != 0 {
+		defer peer.mutex.Unlock()
+		if time.Since(peer.pingTime) > PeerPingTimeout {
+			return fmt.Errorf("ping timeout : %s", peer.addr)
+		}
+		return nil
+	}
+	if time.Since(peer.pingTime) < PeerPingInterval {
+		peer.mutex.Unlock()
+		return nil
+	}
+	peer.pingNonce = rand.Uint64()
+	peer.pingTime = time.Now()
+	msg := wire.NewMsgPing(peer.pingNonce)
+	peer.mutex.Unlock()
+	peer.sendMsg(msg)
+	return nil
+}
+
+// penalize adds the misbehavior score, if it reaches PeerBanScore, the peer is disconnected
+func (peer *Peer) penalize(score int, reason string) {
+	peer.mutex.Lock()
+	peer.banScore += score
+	banScore := peer.banScore
+	peer.mutex.Unlock()
+	log.Printf("peer %s misbehaving (%d) : %s", peer.addr, banScore, reason)
+	if banScore >= PeerBanScore {
+		peer.spv.addrMgr.Bad(peer.addr)
+		peer.Close()
+	}
+}
+
+func (peer *Peer) recvPong(msg *wire.MsgPong) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	if peer.pingNonce == 0 || peer.pingNonce != msg.Nonce {
+		return
+	}
+	peer.latency = time.Since(peer.pingTime)
+	peer.pingNonce = 0
+}
+
+func (peer *Peer) recvVersion(msg *wire.MsgVersion) {
+	peer.mutex.Lock()
+	peer.version = msg.ProtocolVersion
+	peer.userAgent = msg.UserAgent
+	peer.services = msg.Services
+	peer.bestHeight = msg.LastBlock
+	if uint32(msg.ProtocolVersion) < peer.pver {
+		peer.pver = uint32(msg.ProtocolVersion)
+	}
+	peer.mutex.Unlock()
+	log.Printf("peer %s version:%d agent:%s height:%d", peer.addr, msg.ProtocolVersion, msg.UserAgent, msg.LastBlock)
+}
+
+func (peer *Peer) recvVerAck() {
+	peer.mutex.Lock()
+	peer.verAck = true
+	peer.mutex.Unlock()
+}
+
+func (peer *Peer) recvHandler() {
+	defer peer.spv.wg.Done()
+	defer peer.Close()
+	for {
+		size, rmsg, _, err := wire.ReadMessageWithEncodingN(peer.con, peer.protocolVersion(), peer.spv.params.Net, wire.LatestEncoding)
+		if err != nil {
+			if !peer.isClosed() {
+				log.Printf("wire.ReadMessageWithEncodingN error : %s %v", peer.addr, err)
+			}
+			return
+		}
+		switch msg := rmsg.(type) {
+		case *wire.MsgPing:
+			log.Printf("<<< %s MsgPing:%x", peer.addr, msg.Nonce)
+			peer.sendMsg(wire.NewMsgPong(msg.Nonce))
+		case *wire.MsgPong:
+			log.Printf("<<< %s MsgPong:%x", peer.addr, msg.Nonce)
+			peer.recvPong(msg)
+		case *wire.MsgVersion:
+			log.Printf("<<< %s MsgVersion", peer.addr)
+			peer.recvVersion(msg)
+			peer.sendMsg(wire.NewMsgVerAck())
+		case *wire.MsgVerAck:
+			log.Printf("<<< %s MsgVerAck", peer.addr)
+			peer.recvVerAck()
+			peer.spv.queueMsg(peer, msg)
+		default:
+			log.Printf("<<< %s %v:%v", peer.addr, msg.Command(), size)
+			peer.spv.queueMsg(peer, msg)
+		}
+	}
+}
+
+func (peer *Peer) sendHandler() {
+	defer peer.spv.wg.Done()
+	defer peer.Close()
+	for {
+		select {
+		case msg := <-peer.msgQueue:
+			size, err := wire.WriteMessageWithEncodingN(peer.con, msg, peer.protocolVersion(), peer.spv.params.Net, wire.LatestEncoding)
+			if err != nil {
+				log.Printf("wire.WriteMessageWithEncodingN error : %s %v", peer.addr, err)
+				return
+			}
+			buf := &bytes.Buffer{}
+			msg.BtcEncode(buf, 0, wire.LatestEncoding)
+			log.Printf(">>> %s %v:%v %x", peer.addr, msg.Command(), size, buf)
+		case <-peer.quit:
+			return
+		}
+	}
+}
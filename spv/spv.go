@@ -2,308 +2,602 @@
 package spv
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
-	"path/filepath"
-	"reflect"
+	"sync"
 	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/bloom"
 )
 
+// CyclicInterval is the interval of the periodic work
+const CyclicInterval = 3 * time.Second
+
+// MaxConnectFailures is the number of consecutive connection failures without any peer
+// after which spv stops with ErrNoPeers
+const MaxConnectFailures = 100
+
+// ErrNoPeers is returned by Wait when spv stopped because no peer could be connected
+var ErrNoPeers = errors.New("no peer is available")
+
 // Spv is main type
+//
+// the sync state (inv, errHeaders, errBlock, checkHeight, synced, birthdayHeight, request, merkleBlock, cfCheck,
+// recentTxs, rebroadcastTime) is owned by the msgHandler goroutine, the other fields are guarded by their mutex
 type Spv struct {
-	msgQueue    chan wire.Message
-	status      int
-	con         net.Conn
-	pver        uint32
-	params      chaincfg.Params
-	errHeaders  bool
-	errBlock    bool
-	data        *Data
-	ticker      *time.Ticker
-	inv         bool
-	checkHeight int
-	checkTxIns  []func(*wire.TxIn)
-	checkTxOuts []func(int, chainhash.Hash, int, *wire.TxOut)
-	notifyFork  []func(int, int)
+	status          int
+	params          chaincfg.Params
+	interval        time.Duration
+	maxFailures     int
+	errHeaders      bool
+	errBlock        bool
+	data            Store
+	lock            *dirLock
+	releaseOnce     *sync.Once
+	quit            <-chan struct{}
+	cancel          context.CancelFunc
+	done            chan struct{}
+	err             error
+	stateMutex      *sync.Mutex
+	wg              *sync.WaitGroup
+	inv             bool
+	checkHeight     int
+	birthday        Birthday
+	birthdayHeight  int
+	synced          bool
+	callbacks       []*callback
+	callbackID      uint64
+	callbackMutex   *sync.Mutex
+	addrs           []string
+	addrIndex       int
+	addrMgr         *AddrManager
+	maxPeers        int
+	peers           map[string]*Peer
+	peerMutex       *sync.Mutex
+	recvQueue       chan *peerMsg
+	syncMode        int
+	filter          *bloom.Filter
+	request         *syncRequest
+	merkleBlock     *merkleBlock
+	cfCheck         *cfHeadersCheck
+	watchScripts    [][]byte
+	watchMutex      *sync.Mutex
+	downloads       map[int]*blockRequest
+	downloadMutex   *sync.Mutex
+	mempool         map[chainhash.Hash]*mempoolTx
+	mempoolSpends   map[wire.OutPoint]chainhash.Hash
+	mempoolMutex    *sync.Mutex
+	recentTxs       *recentTxs
+	watchOutPoints  map[wire.OutPoint]bool
+	txStatus        map[chainhash.Hash]int
+	txStatusMutex   *sync.Mutex
+	rebroadcastTime time.Time
+	subscriptions   []*Subscription
+	eventMutex      *sync.Mutex
+	eventsClosed    bool
 }
 
 // NewSpv returns a new Spv
-func NewSpv(params chaincfg.Params) (*Spv, error) {
+// if config is nil, default config is used
+func NewSpv(params chaincfg.Params, config *Config) (*Spv, error) {
+	if config == nil {
+		config = NewConfig()
+	}
 	spv := &Spv{}
 	spv.params = params
+	spv.params.Checkpoints = mergeCheckpoints(params.Checkpoints, config.Checkpoints)
+	spv.interval = CyclicInterval
+	spv.maxFailures = MaxConnectFailures
+	spv.stateMutex = new(sync.Mutex)
+	spv.releaseOnce = new(sync.Once)
+	spv.wg = new(sync.WaitGroup)
+	spv.callbackMutex = new(sync.Mutex)
+	spv.watchMutex = new(sync.Mutex)
+	spv.eventMutex = new(sync.Mutex)
+	spv.addrs = config.peerAddrs(params.DefaultPort, len(params.DNSSeeds) > 0)
+	spv.maxPeers = config.maxPeers()
+	spv.peers = make(map[string]*Peer)
+	spv.peerMutex = new(sync.Mutex)
+	spv.recvQueue = make(chan *peerMsg, 100)
+	spv.syncMode = config.SyncMode
+	spv.downloads = make(map[int]*blockRequest)
+	spv.downloadMutex = new(sync.Mutex)
+	spv.mempool = make(map[chainhash.Hash]*mempoolTx)
+	spv.mempoolSpends = make(map[wire.OutPoint]chainhash.Hash)
+	spv.mempoolMutex = new(sync.Mutex)
+	spv.recentTxs = newRecentTxs(MempoolRecentTxs)
+	spv.watchOutPoints = make(map[wire.OutPoint]bool)
+	spv.txStatus = make(map[chainhash.Hash]int)
+	spv.txStatusMutex = new(sync.Mutex)
+	if spv.syncMode == SyncModeBloom {
+		spv.filter = newBloomFilter()
+	}
+	spv.birthday = config.Birthday
+	spv.birthdayHeight = -1
+	if spv.birthday.IsZero() {
+		spv.birthdayHeight = 0
+	} else if spv.birthday.Height > 0 {
+		spv.birthdayHeight = spv.birthday.Height
+	}
 	spv.inv = false
 	spv.errHeaders = false
 	spv.errBlock = false
-	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-	dir = dir + "/data/"
-	err := os.MkdirAll(dir, 0777)
-	if err != nil {
-		log.Printf("os.MkdirAll Error : %+v", err)
-		return nil, err
+	data := config.Store
+	if data == nil && config.Backend == BackendMemory {
+		// the in-memory store does not use the data directory, so it is neither locked nor migrated
+		var err error
+		data, err = NewMemData()
+		if err != nil {
+			log.Printf("NewMemData Error : %+v", err)
+			return nil, err
+		}
+	}
+	if data == nil {
+		dir := chainDir(config.dataDir(), params.Name)
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			log.Printf("os.MkdirAll Error : %+v", err)
+			return nil, err
+		}
+		lock, err := lockDir(dir)
+		if err != nil {
+			log.Printf("lockDir Error : %+v", err)
+			return nil, err
+		}
+		migrateLegacyData(LegacyDataDir(), dir, params.Name)
+		data, err = openStore(config.Backend, params.Name, dir+string(os.PathSeparator))
+		if err != nil {
+			log.Printf("openStore Error : %+v", err)
+			lock.unlock()
+			return nil, err
+		}
+		spv.lock = lock
 	}
-	data, err := NewData(params.Name, dir)
+	spv.data = data
+	spv.addrMgr = NewAddrManager(data, params, config.Resolver)
+	err := spv.loadTxStatus()
 	if err != nil {
-		log.Printf("NewData Error : %+v", err)
+		log.Printf("spv.loadTxStatus Error : %+v", err)
+		spv.release()
 		return nil, err
 	}
-	spv.data = data
 	err = spv.initHeaders()
 	if err != nil {
 		log.Printf("spv.initHeaders Error : %+v", err)
+		spv.release()
+		return nil, err
+	}
+	err = spv.checkStoredCheckpoints()
+	if err != nil {
+		log.Printf("spv.checkStoredCheckpoints Error : %+v", err)
+		spv.release()
 		return nil, err
 	}
 	return spv, nil
 }
 
-// AddCheckTxIn adds checkTxIn function
-func (spv *Spv) AddCheckTxIn(checkTxIn func(*wire.TxIn)) error {
-	exist := false
-	f1 := reflect.ValueOf(checkTxIn)
-	for _, f := range spv.checkTxIns {
-		f2 := reflect.ValueOf(f)
-		if f1.Pointer() == f2.Pointer() {
-			exist = true
-			break
-		}
+// Start starts spv in the background and returns immediately
+// spv runs until ctx is done or Stop is called, and it cannot be restarted
+func (spv *Spv) Start(ctx context.Context) error {
+	spv.stateMutex.Lock()
+	defer spv.stateMutex.Unlock()
+	if spv.done != nil {
+		return fmt.Errorf("spv is already started or stopped")
 	}
-	if exist {
-		return fmt.Errorf("checkTxIn is already exist")
+	err := spv.loadMempool()
+	if err != nil {
+		log.Printf("spv.loadMempool Error : %+v", err)
+		return err
 	}
-	spv.checkTxIns = append(spv.checkTxIns, checkTxIn)
+	ctx, cancel := context.WithCancel(ctx)
+	spv.cancel = cancel
+	spv.done = make(chan struct{})
+	spv.peerMutex.Lock()
+	spv.quit = ctx.Done()
+	spv.peerMutex.Unlock()
+	spv.wg.Add(2)
+	go spv.msgHandler(ctx)
+	go spv.peerHandler(ctx)
+	go spv.supervise(ctx)
 	return nil
 }
 
-// AddCheckTxOut adds checkTxOut function
-func (spv *Spv) AddCheckTxOut(checkTxOut func(int, chainhash.Hash, int, *wire.TxOut)) error {
-	exist := false
-	f1 := reflect.ValueOf(checkTxOut)
-	for _, f := range spv.checkTxOuts {
-		f2 := reflect.ValueOf(f)
-		if f1.Pointer() == f2.Pointer() {
-			exist = true
-			break
-		}
+// Stop stops spv and waits until all goroutines are finished
+// the data is closed and the data directory is unlocked after all goroutines are finished
+// if spv is not started, they are released immediately
+func (spv *Spv) Stop() {
+	spv.stateMutex.Lock()
+	cancel := spv.cancel
+	done := spv.done
+	if cancel == nil && done == nil {
+		spv.done = make(chan struct{})
+		close(spv.done)
 	}
-	if exist {
-		return fmt.Errorf("checkTxOut is already exist")
+	spv.stateMutex.Unlock()
+	if cancel == nil {
+		spv.release()
+		return
 	}
-	spv.checkTxOuts = append(spv.checkTxOuts, checkTxOut)
-	return nil
+	cancel()
+	<-done
 }
 
-// Start is start spv
-func (spv *Spv) Start() {
-	if spv.ticker == nil {
-		spv.ticker = time.NewTicker(time.Duration(3) * time.Second)
-		err := spv.Connect()
-		if err != nil {
-			log.Printf("spv.Connect Error : %+v", err)
-		}
-		go spv.cyclic()
+// Wait waits until spv is stopped
+// it returns ErrNoPeers if spv failed permanently, or nil if spv was stopped by Stop or ctx
+func (spv *Spv) Wait() error {
+	spv.stateMutex.Lock()
+	done := spv.done
+	spv.stateMutex.Unlock()
+	if done == nil {
+		return fmt.Errorf("spv is not started")
 	}
+	<-done
+	spv.stateMutex.Lock()
+	defer spv.stateMutex.Unlock()
+	return spv.err
 }
 
-// Stop is stop spv
-func (spv *Spv) Stop() {
-	if spv.ticker != nil {
-		spv.ticker.Stop()
-		spv.ticker = nil
+// fail stops spv with the permanent error
+func (spv *Spv) fail(err error) {
+	spv.stateMutex.Lock()
+	defer spv.stateMutex.Unlock()
+	log.Printf("spv failed : %v", err)
+	if spv.err == nil {
+		spv.err = err
 	}
+	spv.cancel()
+}
+
+// supervise closes the connections when ctx is done, waits for all goroutines and saves the check height
+func (spv *Spv) supervise(ctx context.Context) {
+	<-ctx.Done()
 	spv.Close()
+	spv.wg.Wait()
+	err := spv.data.PutInt(KeyCheckHeight, spv.checkHeight)
+	if err != nil {
+		log.Printf("spv.data.PutInt error : %v", err)
+	}
+	spv.release()
+	close(spv.done)
+}
+
+// release closes the subscriptions and the data, and unlocks the data directory
+func (spv *Spv) release() {
+	spv.releaseOnce.Do(func() {
+		spv.closeSubscriptions()
+		err := spv.data.Close()
+		if err != nil {
+			log.Printf("spv.data.Close error : %v", err)
+		}
+		if spv.lock != nil {
+			err = spv.lock.unlock()
+			if err != nil {
+				log.Printf("spv.lock.unlock error : %v", err)
+			}
+		}
+	})
 }
 
-// IsConnect returns whether it is connected
+// IsConnect returns whether it is connected to at least one peer
 func (spv *Spv) IsConnect() bool {
-	if spv.con == nil {
-		return false
+	return spv.PeerCount() > 0
+}
+
+// PeerCount returns the number of connected peers
+func (spv *Spv) PeerCount() int {
+	spv.peerMutex.Lock()
+	defer spv.peerMutex.Unlock()
+	return len(spv.peers)
+}
+
+// Peers returns connected peers
+func (spv *Spv) Peers() []*Peer {
+	spv.peerMutex.Lock()
+	defer spv.peerMutex.Unlock()
+	var peers []*Peer
+	for _, peer := range spv.peers {
+		peers = append(peers, peer)
 	}
-	return true
+	return peers
 }
 
-// Connect connects to the node
+// Connect connects to the next node which is not connected
 func (spv *Spv) Connect() error {
-	if spv.IsConnect() {
+	if spv.PeerCount() >= spv.maxPeers {
 		return fmt.Errorf("already connect")
 	}
-	// TODO
-	con, err := net.Dial("tcp", "127.0.0.1:18444")
+	addr := spv.nextAddr()
+	if addr == "" {
+		return fmt.Errorf("no peer address to connect")
+	}
+	con, err := net.DialTimeout("tcp", addr, PeerHandshakeTimeout)
 	if err != nil {
+		spv.addrMgr.Bad(addr)
 		return err
 	}
-	localAddr, err := net.ResolveTCPAddr("tcp", con.LocalAddr().String())
+	peer := newPeer(spv, addr, con)
+	err = spv.addPeer(peer)
 	if err != nil {
-		defer spv.Close()
+		con.Close()
 		return err
 	}
-	remoteAddr, err := net.ResolveTCPAddr("tcp", con.RemoteAddr().String())
+	log.Printf("connected : %s", addr)
+	err = peer.start()
 	if err != nil {
-		defer spv.Close()
+		defer peer.Close()
 		return err
 	}
-	me := wire.NewNetAddress(localAddr, 0)
-	you := wire.NewNetAddress(remoteAddr, 0)
-	msg := wire.NewMsgVersion(me, you, 0, 0)
-	msg.AddService(wire.SFNodeBloom)
-	msg.AddService(wire.SFNodeWitness)
-	msg.AddUserAgent("samplespv", "0.0.1")
-
-	spv.pver = uint32(msg.ProtocolVersion)
-	spv.con = con
-
-	go spv.recvHandler()
+	return nil
+}
 
-	spv.msgQueue = make(chan wire.Message)
-	go spv.sendHandler()
+// nextAddr returns the next address which is not connected
+// configured addresses are rotated so that a failed peer is not retried first,
+// and then the address book is used
+func (spv *Spv) nextAddr() string {
+	addr := spv.nextConfigAddr()
+	if addr != "" {
+		return addr
+	}
+	addrs, err := spv.addrMgr.Candidates()
+	if err != nil {
+		log.Printf("spv.addrMgr.Candidates Error : %+v", err)
+		return ""
+	}
+	spv.peerMutex.Lock()
+	defer spv.peerMutex.Unlock()
+	for _, addr := range addrs {
+		if _, ok := spv.peers[addr]; !ok {
+			return addr
+		}
+	}
+	return ""
+}
 
-	spv.msgQueue <- msg
+func (spv *Spv) nextConfigAddr() string {
+	spv.peerMutex.Lock()
+	defer spv.peerMutex.Unlock()
+	for i := 0; i < len(spv.addrs); i++ {
+		addr := spv.addrs[spv.addrIndex]
+		spv.addrIndex = (spv.addrIndex + 1) % len(spv.addrs)
+		if _, ok := spv.peers[addr]; !ok {
+			return addr
+		}
+	}
+	return ""
+}
 
+// addPeer registers the peer, its handlers are counted in the wait group
+// so that Stop waits for them
+func (spv *Spv) addPeer(peer *Peer) error {
+	spv.peerMutex.Lock()
+	defer spv.peerMutex.Unlock()
+	if spv.quit == nil {
+		return fmt.Errorf("spv is not started")
+	}
+	select {
+	case <-spv.quit:
+		return fmt.Errorf("spv is stopped")
+	default:
+	}
+	spv.peers[peer.addr] = peer
+	spv.wg.Add(2)
 	return nil
 }
 
-// Close close the connection
-func (spv *Spv) Close() {
-	if spv.msgQueue != nil {
-		close(spv.msgQueue)
-		spv.msgQueue = nil
+func (spv *Spv) removePeer(peer *Peer) {
+	spv.peerMutex.Lock()
+	removed := spv.peers[peer.addr] == peer
+	if removed {
+		delete(spv.peers, peer.addr)
 	}
-	if spv.con != nil {
-		err := spv.con.Close()
-		if err != nil {
-			log.Printf("spv.con.Close error : %v", err)
+	spv.peerMutex.Unlock()
+	if removed {
+		log.Printf("disconnected : %s", peer.addr)
+		spv.publish(PeerDisconnected{Addr: peer.addr})
+	}
+}
+
+// bestPeer returns the ready peer with the highest best height
+// if heights are same, the peer with lower latency is selected
+func (spv *Spv) bestPeer() *Peer {
+	return spv.bestPeerExcept(nil)
+}
+
+// bestPeerExcept returns the best peer except the peer
+func (spv *Spv) bestPeerExcept(except *Peer) *Peer {
+	var best *Peer
+	for _, peer := range spv.Peers() {
+		if !peer.IsReady() || peer == except {
+			continue
+		}
+		if best == nil {
+			best = peer
+			continue
+		}
+		if peer.BestHeight() > best.BestHeight() ||
+			(peer.BestHeight() == best.BestHeight() && peer.Latency() < best.Latency()) {
+			best = peer
 		}
-		spv.con = nil
 	}
-	err := spv.data.PutInt(KeyCheckHeight, spv.checkHeight)
-	if err != nil {
-		log.Printf("spv.data.PutInt error : %v", err)
+	return best
+}
+
+// Close close the connections
+func (spv *Spv) Close() {
+	for _, peer := range spv.Peers() {
+		peer.Close()
 	}
 }
 
-// SendMsgTx sends MsgTx
-func (spv *Spv) SendMsgTx(tx *wire.MsgTx) error {
-	err := spv.data.PutTx(tx)
-	if err != nil {
-		log.Printf("spv.data.PutTx Error : %+v", err)
-		return err
+// sendMsg sends the message to the best peer
+func (spv *Spv) sendMsg(msg wire.Message) bool {
+	peer := spv.bestPeer()
+	if peer == nil {
+		log.Printf("no peer to send %v", msg.Command())
+		return false
+	}
+	peer.sendMsg(msg)
+	return true
+}
+
+// broadcastMsg sends the message to all ready peers
+func (spv *Spv) broadcastMsg(msg wire.Message) {
+	for _, peer := range spv.Peers() {
+		if peer.IsReady() {
+			peer.sendMsg(msg)
+		}
 	}
-	hash := tx.TxHash()
-	msg := wire.NewMsgInv()
-	inv := wire.NewInvVect(wire.InvTypeTx, &hash)
-	msg.AddInvVect(inv)
-	spv.sendMsg(msg)
-	return nil
 }
 
-func (spv *Spv) sendMsg(msg wire.Message) {
-	spv.msgQueue <- msg
+func (spv *Spv) queueMsg(peer *Peer, msg wire.Message) {
+	select {
+	case spv.recvQueue <- &peerMsg{peer: peer, msg: msg}:
+	case <-peer.quit:
+	case <-spv.quit:
+	}
 }
 
-func (spv *Spv) recvHandler() {
+// msgHandler handles the messages from all peers and the periodic work in one goroutine
+// when ctx is done, the queued messages are drained before it returns
+func (spv *Spv) msgHandler(ctx context.Context) {
+	defer spv.wg.Done()
+	ticker := time.NewTicker(spv.interval)
+	defer ticker.Stop()
 	for {
-		size, rmsg, _, err := wire.ReadMessageWithEncodingN(spv.con, spv.pver, spv.params.Net, wire.LatestEncoding)
-		if err != nil {
-			log.Printf("wire.ReadMessageWithEncodingN error : %v", err)
-			if err == io.EOF {
-				spv.con = nil
+		select {
+		case pm := <-spv.recvQueue:
+			spv.handleMsg(pm.peer, pm.msg)
+		case <-ticker.C:
+			spv.cyclic()
+		case <-ctx.Done():
+			for {
+				select {
+				case pm := <-spv.recvQueue:
+					spv.handleMsg(pm.peer, pm.msg)
+				default:
+					return
+				}
 			}
+		}
+	}
+}
+
+// peerHandler checks the peers periodically
+// if no peer can be connected MaxConnectFailures times in a row, spv fails with ErrNoPeers
+func (spv *Spv) peerHandler(ctx context.Context) {
+	defer spv.wg.Done()
+	ticker := time.NewTicker(spv.interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		if spv.checkPeers() || spv.PeerCount() > 0 {
+			failures = 0
+		} else {
+			failures++
+		}
+		if failures >= spv.maxFailures {
+			spv.fail(ErrNoPeers)
 			return
 		}
-		switch msg := rmsg.(type) {
-		case *wire.MsgPing:
-			log.Printf("<<< MsgPing:%x", msg.Nonce)
-			sm := wire.NewMsgPong(msg.Nonce)
-			spv.msgQueue <- sm
-		case *wire.MsgHeaders:
-			log.Printf("<<< MsgHeaders")
-			spv.recvHeaders(msg)
-		case *wire.MsgBlock:
-			log.Printf("<<< MsgBlock %v", msg.Header.BlockHash())
-			spv.recvBlock(msg)
-		case *wire.MsgInv:
-			log.Printf("<<< MsgInv")
-			for _, inv := range msg.InvList {
-				if inv.Type != wire.InvTypeBlock {
-					continue
-				}
-				spv.inv = true
-			}
-		case *wire.MsgGetData:
-			log.Printf("<<< MsgGetData")
-			for _, inv := range msg.InvList {
-				if inv.Type != wire.InvTypeTx {
-					continue
-				}
-				tx, err := spv.data.GetTx(inv.Hash)
-				if err != nil {
-					log.Printf("spv.data.GetTx Error : %+v", err)
-					continue
-				}
-				if tx == nil {
-					log.Printf("Unknown hash %v", inv.Hash)
-					continue
-				}
-				spv.sendMsg(tx)
-				err = spv.data.DelTx(tx.TxHash())
-				if err != nil {
-					log.Printf("spv.data.DelTx Error : %+v", err)
-				}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (spv *Spv) handleMsg(peer *Peer, rmsg wire.Message) {
+	switch msg := rmsg.(type) {
+	case *wire.MsgHeaders:
+		spv.recvHeaders(peer, msg)
+	case *wire.MsgBlock:
+		log.Printf("<<< MsgBlock %v", msg.Header.BlockHash())
+		spv.recvBlock(peer, msg)
+	case *wire.MsgMerkleBlock:
+		log.Printf("<<< MsgMerkleBlock %v", msg.Header.BlockHash())
+		spv.recvMerkleBlock(peer, msg)
+	case *wire.MsgCFHeaders:
+		spv.recvCFHeaders(peer, msg)
+	case *wire.MsgCFilter:
+		spv.recvCFilter(peer, msg)
+	case *wire.MsgTx:
+		if !spv.recvMerkleTx(msg) {
+			spv.recvMempoolTx(msg)
+		}
+	case *wire.MsgInv:
+		for _, inv := range msg.InvList {
+			if inv.Type != wire.InvTypeBlock {
+				continue
 			}
-		case *wire.MsgAddr:
-			log.Printf("<<< MsgAddr:%v", msg.AddrList)
-		case *wire.MsgVersion:
-			log.Printf("<<< MsgVersion")
-			sm := wire.NewMsgVerAck()
-			spv.msgQueue <- sm
-		case *wire.MsgVerAck:
-			log.Printf("<<< MsgVerAck")
-			spv.updateHeaders()
-		default:
-			log.Printf("<<< NoLogic %v:%v", msg.Command(), size)
+			spv.inv = true
 		}
+		spv.seenTxs(msg.InvList)
+		spv.requestTxs(peer, msg.InvList)
+	case *wire.MsgGetData:
+		spv.sendTxs(peer, msg.InvList)
+	case *wire.MsgReject:
+		spv.recvReject(peer, msg)
+	case *wire.MsgAddr:
+		log.Printf("<<< MsgAddr:%v", msg.AddrList)
+		spv.addrMgr.AddAddrs(msg.AddrList)
+	case *wire.MsgVerAck:
+		spv.addrMgr.Good(peer.addr)
+		spv.publish(PeerConnected{Addr: peer.addr, BestHeight: peer.BestHeight()})
+		peer.sendMsg(wire.NewMsgGetAddr())
+		spv.loadFilter(peer)
+		spv.announceTxs(spv.unconfirmedTxs(), peer)
+		spv.updateHeaders()
 	}
 }
 
-func (spv *Spv) sendHandler() {
-	for msg := range spv.msgQueue {
-		size, err := wire.WriteMessageWithEncodingN(spv.con, msg, spv.pver, spv.params.Net, wire.LatestEncoding)
+// checkPeers disconnects stalled peers and connects new peers
+// it returns false if it failed to connect
+func (spv *Spv) checkPeers() bool {
+	for _, peer := range spv.Peers() {
+		err := peer.ping()
 		if err != nil {
-			log.Printf("wire.WriteMessageWithEncodingN error : %v", err)
-			return
+			log.Printf("peer.ping Error : %+v", err)
+			spv.addrMgr.Bad(peer.addr)
+			peer.Close()
+		}
+	}
+	if spv.PeerCount() < spv.maxPeers {
+		err := spv.Connect()
+		if err != nil {
+			log.Printf("Spv Connect Error : %+v", err)
+			return false
 		}
-		buf := &bytes.Buffer{}
-		msg.BtcEncode(buf, 0, wire.LatestEncoding)
-		log.Printf(">>> %v:%v %x", msg.Command(), size, buf)
 	}
+	return true
 }
 
+// cyclic retries the failed requests and does the periodic work
 func (spv *Spv) cyclic() {
-	for _ = range spv.ticker.C {
-		if !spv.IsConnect() {
-			err := spv.Connect()
-			if err != nil {
-				log.Printf("Spv Connect Error : %+v", err)
-			}
-		} else {
-			if spv.inv {
-				spv.inv = false
-				spv.updateHeaders()
-			}
-			if spv.errHeaders {
-				spv.errHeaders = false
-				spv.updateHeaders()
-			}
-			if spv.errBlock {
-				spv.errBlock = false
-				spv.updateBlock()
-			}
-		}
+	if spv.bestPeer() == nil {
+		return
+	}
+	if spv.inv {
+		spv.inv = false
+		spv.updateHeaders()
+	}
+	if spv.errHeaders {
+		spv.errHeaders = false
+		spv.updateHeaders()
+	}
+	if spv.errBlock {
+		spv.errBlock = false
+		spv.updateBlock()
 	}
+	spv.checkRequest()
+	spv.checkDownloads()
+	spv.expireMempoolTxs()
+	spv.rebroadcastTxs()
 }
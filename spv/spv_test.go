@@ -0,0 +1,285 @@
+// Package spv project spv_test.go
+package spv
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testTimeout is the time to wait for the asynchronous result in tests
+const testTimeout = 10 * time.Second
+
+// newTestSpv returns a new Spv with the in-memory store on regtest
+func newTestSpv(t *testing.T, config *Config) *Spv {
+	return newTestSpvParams(t, chaincfg.RegressionNetParams, config)
+}
+
+// newTestSpvParams returns a new Spv with the in-memory store on the network
+func newTestSpvParams(t *testing.T, params chaincfg.Params, config *Config) *Spv {
+	if config == nil {
+		config = NewConfig()
+	}
+	data, err := NewMemData()
+	if err != nil {
+		t.Fatalf("NewMemData Error : %+v", err)
+	}
+	config.Store = data
+	spv, err := NewSpv(params, config)
+	if err != nil {
+		t.Fatalf("NewSpv Error : %+v", err)
+	}
+	t.Cleanup(func() {
+		spv.Stop()
+	})
+	return spv
+}
+
+// newTestPeer returns a ready peer registered to spv without the handshake
+// the messages sent to the peer are left in its queue, see queuedMsgs
+func newTestPeer(t *testing.T, spv *Spv, addr string, services wire.ServiceFlag, bestHeight int32) *Peer {
+	con, remote := net.Pipe()
+	t.Cleanup(func() {
+		remote.Close()
+	})
+	peer := newPeer(spv, addr, con)
+	peer.services = services
+	peer.bestHeight = bestHeight
+	peer.verAck = true
+	spv.peerMutex.Lock()
+	spv.peers[addr] = peer
+	spv.peerMutex.Unlock()
+	return peer
+}
+
+// queuedMsgs returns the messages sent to the test peer and empties its queue
+func queuedMsgs(peer *Peer) []wire.Message {
+	var msgs []wire.Message
+	for {
+		select {
+		case msg := <-peer.msgQueue:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+// fakePeer is the local node which answers the handshake and ignores the other messages
+type fakePeer struct {
+	listener net.Listener
+	net      wire.BitcoinNet
+	wg       *sync.WaitGroup
+	mutex    *sync.Mutex
+	conns    []net.Conn
+}
+
+// newFakePeer returns a new fakePeer listening on the loopback address
+func newFakePeer(t *testing.T) *fakePeer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen Error : %+v", err)
+	}
+	fp := &fakePeer{}
+	fp.listener = listener
+	fp.net = chaincfg.RegressionNetParams.Net
+	fp.wg = new(sync.WaitGroup)
+	fp.mutex = new(sync.Mutex)
+	fp.wg.Add(1)
+	go fp.serve()
+	t.Cleanup(fp.close)
+	return fp
+}
+
+func (fp *fakePeer) addr() string {
+	return fp.listener.Addr().String()
+}
+
+func (fp *fakePeer) serve() {
+	defer fp.wg.Done()
+	for {
+		con, err := fp.listener.Accept()
+		if err != nil {
+			return
+		}
+		fp.mutex.Lock()
+		fp.conns = append(fp.conns, con)
+		fp.mutex.Unlock()
+		fp.wg.Add(1)
+		go fp.handle(con)
+	}
+}
+
+func (fp *fakePeer) handle(con net.Conn) {
+	defer fp.wg.Done()
+	defer con.Close()
+	for {
+		msg, _, err := wire.ReadMessage(con, wire.ProtocolVersion, fp.net)
+		if _, ok := err.(*wire.MessageError); ok {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if _, ok := msg.(*wire.MsgVersion); !ok {
+			continue
+		}
+		local := con.LocalAddr().(*net.TCPAddr)
+		remote := con.RemoteAddr().(*net.TCPAddr)
+		version := wire.NewMsgVersion(wire.NewNetAddress(local, 0), wire.NewNetAddress(remote, 0), rand.Uint64(), 0)
+		version.Services = wire.SFNodeNetwork | wire.SFNodeWitness
+		for _, reply := range []wire.Message{version, wire.NewMsgVerAck()} {
+			err = wire.WriteMessage(con, reply, wire.ProtocolVersion, fp.net)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// close stops listening and closes all connections
+func (fp *fakePeer) close() {
+	fp.listener.Close()
+	fp.mutex.Lock()
+	for _, con := range fp.conns {
+		con.Close()
+	}
+	fp.mutex.Unlock()
+	fp.wg.Wait()
+}
+
+// waitPeerConnected waits for PeerConnected of the subscription
+func waitPeerConnected(t *testing.T, sub *Subscription) {
+	timer := time.NewTimer(testTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case event := <-sub.Events():
+			if _, ok := event.(PeerConnected); ok {
+				return
+			}
+		case <-timer.C:
+			t.Fatalf("peer is not connected")
+		}
+	}
+}
+
+// waitStopped waits until spv is stopped and returns the error of Wait
+func waitStopped(t *testing.T, spv *Spv) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- spv.Wait()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(testTimeout):
+		t.Fatalf("spv is not stopped")
+	}
+	return nil
+}
+
+func TestStartStop(t *testing.T) {
+	fp := newFakePeer(t)
+	config := NewConfig()
+	config.Peers = []string{fp.addr()}
+	spv := newTestSpv(t, config)
+	sub := spv.Subscribe()
+	defer sub.Close()
+	err := spv.Start(context.Background())
+	if err != nil {
+		t.Fatalf("spv.Start Error : %+v", err)
+	}
+	waitPeerConnected(t, sub)
+	if spv.PeerCount() != 1 {
+		t.Fatalf("unmatch peer count : %d", spv.PeerCount())
+	}
+	err = spv.Start(context.Background())
+	if err == nil {
+		t.Fatalf("spv is started twice")
+	}
+	spv.Stop()
+	err = waitStopped(t, spv)
+	if err != nil {
+		t.Fatalf("spv.Wait Error : %+v", err)
+	}
+	if spv.PeerCount() != 0 {
+		t.Fatalf("peers are not closed : %d", spv.PeerCount())
+	}
+	// Stop can be called again
+	spv.Stop()
+	err = spv.Start(context.Background())
+	if err == nil {
+		t.Fatalf("spv is restarted")
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	fp := newFakePeer(t)
+	config := NewConfig()
+	config.Peers = []string{fp.addr()}
+	spv := newTestSpv(t, config)
+	sub := spv.Subscribe()
+	defer sub.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := spv.Start(ctx)
+	if err != nil {
+		t.Fatalf("spv.Start Error : %+v", err)
+	}
+	waitPeerConnected(t, sub)
+	cancel()
+	err = waitStopped(t, spv)
+	if err != nil {
+		t.Fatalf("spv.Wait Error : %+v", err)
+	}
+	if spv.PeerCount() != 0 {
+		t.Fatalf("peers are not closed : %d", spv.PeerCount())
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	err := spv.Wait()
+	if err == nil {
+		t.Fatalf("Wait returns before Start")
+	}
+	spv.Stop()
+	err = waitStopped(t, spv)
+	if err != nil {
+		t.Fatalf("spv.Wait Error : %+v", err)
+	}
+	err = spv.Start(context.Background())
+	if err == nil {
+		t.Fatalf("spv is started after Stop")
+	}
+}
+
+func TestWaitErrNoPeers(t *testing.T) {
+	// the port is closed after it is allocated, so the connection is refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen Error : %+v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	config := NewConfig()
+	config.Peers = []string{addr}
+	spv := newTestSpv(t, config)
+	spv.interval = 10 * time.Millisecond
+	spv.maxFailures = 3
+	err = spv.Start(context.Background())
+	if err != nil {
+		t.Fatalf("spv.Start Error : %+v", err)
+	}
+	err = waitStopped(t, spv)
+	if err != ErrNoPeers {
+		t.Fatalf("unmatch error : %+v", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Package spv project store.go
+package spv
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Store is the storage of headers, kvs, tx and the other data used by Spv
+// Data (sqlite), LevelData (leveldb or in-memory) and FlatData (flat file) implement it
+//
+// the chain work of the main chain header is the cumulative work from the first stored header,
+// so only the difference of two chain works is meaningful
+//
+// PutTx overwrites the transaction of the same hash
+type Store interface {
+	// KVS
+	PutInt(key string, i int) error
+	GetInt(key string, defaultInt int) (int, error)
+	Put(key string, val []byte) error
+	Get(key string) ([]byte, error)
+	Del(key string) error
+
+	// Header
+	GetHeaderByHash(hash chainhash.Hash) (*wire.BlockHeader, int, error)
+	GetHeaderByHeight(height int) (*wire.BlockHeader, int, error)
+	PutHeaders(headers []*wire.BlockHeader, startHeight int) error
+	GetCntMinMaxHeight() (int, int, int, error)
+	GetTip() (*wire.BlockHeader, int, error)
+	GetHeadersByHeight(startHeight, endHeight int) ([]*wire.BlockHeader, int, error)
+	GetAncestors(hash chainhash.Hash, count int) ([]*wire.BlockHeader, int, error)
+	GetChainWork(height int) (*big.Int, error)
+	GetForkHeader(hash chainhash.Hash) (*wire.BlockHeader, int, error)
+	PutForkHeaders(headers []*wire.BlockHeader, startHeight int) error
+	Reorg(headers []*wire.BlockHeader, startHeight int) error
+	ReorgForks(replaced, headers []*wire.BlockHeader, startHeight int) error
+
+	// Filter header
+	PutCFHeaders(cfheaders []chainhash.Hash, startHeight int) error
+	GetCFHeader(height int) (*chainhash.Hash, error)
+	GetCFHeaderTip() (int, error)
+
+	// Tx
+	PutTx(msgTx *wire.MsgTx) error
+	GetTx(hash chainhash.Hash) (*wire.MsgTx, error)
+	ListTxHash() ([]chainhash.Hash, error)
+	DelTx(hash chainhash.Hash) error
+	PutTxStatus(hash chainhash.Hash, status int, updated int64, reason string) error
+	GetTxStatus(hash chainhash.Hash) (int, int64, string, error)
+
+	// Mempool
+	PutMempoolTx(msgTx *wire.MsgTx, t int64) error
+	ListMempoolTx() ([]*wire.MsgTx, []int64, error)
+	DelMempoolTx(hash chainhash.Hash) error
+
+	// Addr
+	PutAddr(addr string, services uint64, lastSeen int64) error
+	MarkAddr(addr string, success bool, attempt int64) error
+	ListAddrs(lastAttempt int64, limit int) ([]*AddrInfo, error)
+	CountAddrs() (int, error)
+	TrimAddrs(max int) error
+
+	Close() error
+}
+
+// openStore opens the store of the backend in the data directory
+func openStore(backend int, name, datadir string) (Store, error) {
+	switch backend {
+	case BackendSQLite:
+		return NewData(name, datadir)
+	case BackendLevelDB:
+		return NewLevelData(name, datadir)
+	case BackendMemory:
+		return NewMemData()
+	case BackendFlat:
+		data, err := NewData(name, datadir)
+		if err != nil {
+			return nil, err
+		}
+		flat, err := NewFlatData(data, name, datadir)
+		if err != nil {
+			data.Close()
+			return nil, err
+		}
+		return flat, nil
+	}
+	return nil, fmt.Errorf("unknown backend : %d", backend)
+}
+
+// getAncestors returns the main chain header of the hash and its previous headers from the lowest
+// at most count headers are returned, with the height of the first header
+// if the hash is not in the main chain, it returns nil and -1
+func getAncestors(store Store, hash chainhash.Hash, count int) ([]*wire.BlockHeader, int, error) {
+	header, height, err := store.GetHeaderByHash(hash)
+	if err != nil || header == nil || count <= 0 {
+		return nil, -1, err
+	}
+	return store.GetHeadersByHeight(height-count+1, height)
+}
+
+// headerCache caches the count, the height range and the tip of the main chain headers
+// the main chain headers are contiguous, so they are updated without queries when headers are put
+type headerCache struct {
+	mutex  *sync.Mutex
+	loaded bool
+	cnt    int
+	min    int
+	max    int
+	tip    *wire.BlockHeader
+}
+
+func newHeaderCache() *headerCache {
+	cache := &headerCache{}
+	cache.mutex = new(sync.Mutex)
+	return cache
+}
+
+// get returns count, min height, max height and the tip
+// if the cache is not loaded, load is called
+func (cache *headerCache) get(load func() (int, int, int, *wire.BlockHeader, error)) (int, int, int, *wire.BlockHeader, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if !cache.loaded {
+		cnt, min, max, tip, err := load()
+		if err != nil {
+			return -1, -1, -1, nil, err
+		}
+		cache.cnt = cnt
+		cache.min = min
+		cache.max = max
+		cache.tip = tip
+		cache.loaded = true
+	}
+	return cache.cnt, cache.min, cache.max, cache.tip, nil
+}
+
+// update updates the cache after the headers from startHeight are put or replaced
+func (cache *headerCache) update(headers []*wire.BlockHeader, startHeight int) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if !cache.loaded || len(headers) == 0 {
+		return
+	}
+	if cache.cnt == 0 {
+		cache.min = startHeight
+	}
+	cache.max = startHeight + len(headers) - 1
+	cache.cnt = cache.max - cache.min + 1
+	cache.tip = headers[len(headers)-1]
+}
+
+// addWork returns the chain work which is the previous chain work plus the work of the header
+func addWork(prevWork *big.Int, header *wire.BlockHeader) *big.Int {
+	work := new(big.Int).Set(prevWork)
+	return work.Add(work, blockchain.CalcWork(header.Bits))
+}
@@ -0,0 +1,186 @@
+// Package spv project store_test.go
+package spv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testStores returns the stores of all backends in the temporary directory
+func testStores(t *testing.T) map[string]Store {
+	dir := t.TempDir() + string(os.PathSeparator)
+	stores := make(map[string]Store)
+	data, err := NewData("test", dir)
+	if err != nil {
+		t.Fatalf("NewData Error : %+v", err)
+	}
+	stores["sqlite"] = data
+	level, err := NewLevelData("test", dir)
+	if err != nil {
+		t.Fatalf("NewLevelData Error : %+v", err)
+	}
+	stores["leveldb"] = level
+	mem, err := NewMemData()
+	if err != nil {
+		t.Fatalf("NewMemData Error : %+v", err)
+	}
+	stores["memory"] = mem
+	under, err := NewData("flat", dir)
+	if err != nil {
+		t.Fatalf("NewData Error : %+v", err)
+	}
+	flat, err := NewFlatData(under, "flat", dir)
+	if err != nil {
+		t.Fatalf("NewFlatData Error : %+v", err)
+	}
+	stores["flat"] = flat
+	t.Cleanup(func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	})
+	return stores
+}
+
+func TestStorePutTx(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			tx := wire.NewMsgTx(wire.TxVersion)
+			tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, []byte{0x51}, nil))
+			tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+			hash := tx.TxHash()
+			err := store.PutTx(tx)
+			if err != nil {
+				t.Fatalf("store.PutTx Error : %+v", err)
+			}
+			// the transaction of the same hash is overwritten
+			tx.TxIn[0].Witness = wire.TxWitness{[]byte{0x01}}
+			err = store.PutTx(tx)
+			if err != nil {
+				t.Fatalf("store.PutTx duplicate Error : %+v", err)
+			}
+			got, err := store.GetTx(hash)
+			if err != nil || got == nil {
+				t.Fatalf("store.GetTx : %v %+v", got, err)
+			}
+			if len(got.TxIn[0].Witness) != 1 {
+				t.Fatalf("transaction is not overwritten")
+			}
+			hashes, err := store.ListTxHash()
+			if err != nil || len(hashes) != 1 || hashes[0] != hash {
+				t.Fatalf("store.ListTxHash : %v %+v", hashes, err)
+			}
+			err = store.DelTx(hash)
+			if err != nil {
+				t.Fatalf("store.DelTx Error : %+v", err)
+			}
+			got, err = store.GetTx(hash)
+			if err != nil || got != nil {
+				t.Fatalf("transaction is not deleted : %v %+v", got, err)
+			}
+		})
+	}
+}
+
+func TestStoreTrimAddrs(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			addrs := []string{"10.0.0.1:8333", "10.0.0.2:8333", "10.0.0.3:8333"}
+			for i, addr := range addrs {
+				err := store.PutAddr(addr, uint64(wire.SFNodeNetwork), int64(100+i))
+				if err != nil {
+					t.Fatalf("store.PutAddr Error : %+v", err)
+				}
+			}
+			err := store.MarkAddr(addrs[0], true, 200)
+			if err != nil {
+				t.Fatalf("store.MarkAddr Error : %+v", err)
+			}
+			err = store.TrimAddrs(2)
+			if err != nil {
+				t.Fatalf("store.TrimAddrs Error : %+v", err)
+			}
+			cnt, err := store.CountAddrs()
+			if err != nil || cnt != 2 {
+				t.Fatalf("store.CountAddrs : %d %+v", cnt, err)
+			}
+			list, err := store.ListAddrs(1000, 10)
+			if err != nil || len(list) != 2 {
+				t.Fatalf("store.ListAddrs : %v %+v", list, err)
+			}
+			if list[0].Addr != addrs[0] || list[1].Addr != addrs[2] {
+				t.Fatalf("unmatch kept addrs : %s %s", list[0].Addr, list[1].Addr)
+			}
+		})
+	}
+}
+
+func TestStoreReorg(t *testing.T) {
+	for name, store := range testStores(t) {
+		headers := testHeaders(chainhash.Hash{}, 5, 0)
+		branch := testHeaders(headers[2].BlockHash(), 3, 100)
+		err := store.PutHeaders(headers, 100)
+		if err != nil {
+			t.Fatalf("%s : store.PutHeaders Error : %+v", name, err)
+		}
+		err = store.PutCFHeaders([]chainhash.Hash{{1}, {2}, {3}, {4}, {5}}, 100)
+		if err != nil {
+			t.Fatalf("%s : store.PutCFHeaders Error : %+v", name, err)
+		}
+		err = store.PutForkHeaders(branch, 103)
+		if err != nil {
+			t.Fatalf("%s : store.PutForkHeaders Error : %+v", name, err)
+		}
+		err = store.Reorg(branch, 103)
+		if err != nil {
+			t.Fatalf("%s : store.Reorg Error : %+v", name, err)
+		}
+		checkReorgForks(t, name, store, headers[3:], branch)
+	}
+}
+
+func TestStoreReorgForks(t *testing.T) {
+	for name, store := range testStores(t) {
+		if name == "flat" {
+			continue
+		}
+		replaced := testHeaders(chainhash.Hash{}, 2, 0)
+		branch := testHeaders(chainhash.Hash{}, 3, 100)
+		err := store.PutCFHeaders([]chainhash.Hash{{1}, {2}, {3}, {4}, {5}}, 100)
+		if err != nil {
+			t.Fatalf("%s : store.PutCFHeaders Error : %+v", name, err)
+		}
+		err = store.PutForkHeaders(branch, 103)
+		if err != nil {
+			t.Fatalf("%s : store.PutForkHeaders Error : %+v", name, err)
+		}
+		err = store.ReorgForks(replaced, branch, 103)
+		if err != nil {
+			t.Fatalf("%s : store.ReorgForks Error : %+v", name, err)
+		}
+		checkReorgForks(t, name, store, replaced, branch)
+	}
+}
+
+// checkReorgForks checks the side branch and the filter headers after the reorg at height 103
+func checkReorgForks(t *testing.T, name string, store Store, replaced, branch []*wire.BlockHeader) {
+	for i, header := range replaced {
+		fork, height, err := store.GetForkHeader(header.BlockHash())
+		if err != nil || fork == nil || height != 103+i {
+			t.Errorf("%s : replaced header is not in the side branch : %d %+v", name, height, err)
+		}
+	}
+	for _, header := range branch {
+		fork, _, err := store.GetForkHeader(header.BlockHash())
+		if err != nil || fork != nil {
+			t.Errorf("%s : promoted header is left in the side branch : %+v", name, err)
+		}
+	}
+	cfTip, err := store.GetCFHeaderTip()
+	if err != nil || cfTip != 102 {
+		t.Errorf("%s : filter headers are not removed : %d %+v", name, cfTip, err)
+	}
+}
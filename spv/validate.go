@@ -0,0 +1,261 @@
+// Package spv project validate.go
+package spv
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// header validation settings
+const (
+	MedianTimeBlocks     = 11
+	MaxTimeOffsetSeconds = 2 * 60 * 60
+)
+
+// headerChain is headers by height used for validation
+// headers which are not cached are read from the data
+type headerChain struct {
+	data      Store
+	headers   map[int]*wire.BlockHeader
+	min       int
+	minLoaded bool
+}
+
+func newHeaderChain(data Store) *headerChain {
+	chain := &headerChain{}
+	chain.data = data
+	chain.headers = make(map[int]*wire.BlockHeader)
+	return chain
+}
+
+// get returns the header at the height, if it is not found, it returns nil
+func (chain *headerChain) get(height int) (*wire.BlockHeader, error) {
+	if height < 0 {
+		return nil, nil
+	}
+	header, ok := chain.headers[height]
+	if ok {
+		return header, nil
+	}
+	header, _, err := chain.data.GetHeaderByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		chain.headers[height] = header
+	}
+	return header, nil
+}
+
+// ancestor returns the header at the height which is needed for the validation
+// if the height is before the first stored header (the headers start from the checkpoint), it returns nil
+// and the check which needs it is skipped, but the header which is not found after it is an error
+func (chain *headerChain) ancestor(height int) (*wire.BlockHeader, error) {
+	header, err := chain.get(height)
+	if err != nil || header != nil || height < 0 {
+		return header, err
+	}
+	if !chain.minLoaded {
+		_, min, _, err := chain.data.GetCntMinMaxHeight()
+		if err != nil {
+			return nil, err
+		}
+		chain.min = min
+		chain.minLoaded = true
+	}
+	if height < chain.min {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("header not found : %d", height)
+}
+
+// prefetch caches the header of the hash at the height and its previous headers with one query
+// if the header of the hash is not at the height, nothing is cached
+func (chain *headerChain) prefetch(hash chainhash.Hash, height, count int) error {
+	headers, first, err := chain.data.GetAncestors(hash, count)
+	if err != nil {
+		return err
+	}
+	if first+len(headers)-1 != height {
+		return nil
+	}
+	for i, header := range headers {
+		chain.headers[first+i] = header
+	}
+	return nil
+}
+
+func (chain *headerChain) add(header *wire.BlockHeader, height int) {
+	chain.headers[height] = header
+}
+
+// newValidationChain returns the header chain to validate the headers from the height
+// prevHash is the hash of the main chain header at the previous height,
+// it and its previous headers for the median time past and the testnet difficulty rule are prefetched
+func (spv *Spv) newValidationChain(prevHash chainhash.Hash, height int) (*headerChain, error) {
+	chain := newHeaderChain(spv.data)
+	count := MedianTimeBlocks
+	if spv.params.ReduceMinDifficulty {
+		blocksPerRetarget := int(spv.params.TargetTimespan / spv.params.TargetTimePerBlock)
+		count = (height-1)%blocksPerRetarget + 1
+	}
+	err := chain.prefetch(prevHash, height-1, count)
+	if err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// validateHeader validates the header at the height
+// the previous header must be already in the chain
+func (spv *Spv) validateHeader(chain *headerChain, header *wire.BlockHeader, height int) error {
+	prev, err := chain.get(height - 1)
+	if err != nil {
+		return err
+	}
+	if prev == nil {
+		return fmt.Errorf("previous header not found : %d", height-1)
+	}
+	prevHash := prev.BlockHash()
+	if !header.PrevBlock.IsEqual(&prevHash) {
+		return fmt.Errorf("header does not connect : %d %v", height, header.PrevBlock)
+	}
+	hash := header.BlockHash()
+	err = spv.checkCheckpoint(&hash, height)
+	if err != nil {
+		return err
+	}
+	err = spv.checkProofOfWork(header)
+	if err != nil {
+		return err
+	}
+	bits, err := spv.calcRequiredBits(chain, prev, height, header.Timestamp)
+	if err != nil {
+		return err
+	}
+	if bits != 0 && header.Bits != bits {
+		return fmt.Errorf("unexpected difficulty bits : %d %08x %08x", height, header.Bits, bits)
+	}
+	mtp, err := spv.calcMedianTime(chain, height-1)
+	if err != nil {
+		return err
+	}
+	if !header.Timestamp.After(mtp) {
+		return fmt.Errorf("timestamp is not after median time past : %d %v %v", height, header.Timestamp, mtp)
+	}
+	maxTime := time.Now().Add(time.Second * MaxTimeOffsetSeconds)
+	if header.Timestamp.After(maxTime) {
+		return fmt.Errorf("timestamp is too far in the future : %d %v", height, header.Timestamp)
+	}
+	return nil
+}
+
+// checkProofOfWork checks the target range and the block hash
+func (spv *Spv) checkProofOfWork(header *wire.BlockHeader) error {
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 {
+		return fmt.Errorf("target is not positive : %08x", header.Bits)
+	}
+	if target.Cmp(spv.params.PowLimit) > 0 {
+		return fmt.Errorf("target is higher than pow limit : %08x", header.Bits)
+	}
+	hash := header.BlockHash()
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return fmt.Errorf("block hash is higher than target : %v %08x", hash, header.Bits)
+	}
+	return nil
+}
+
+// calcRequiredBits returns the required bits of the header at the height
+// if the headers needed for the calculation are before the first stored header (the checkpoint), it returns 0
+func (spv *Spv) calcRequiredBits(chain *headerChain, prev *wire.BlockHeader, height int, timestamp time.Time) (uint32, error) {
+	blocksPerRetarget := int(spv.params.TargetTimespan / spv.params.TargetTimePerBlock)
+	if height%blocksPerRetarget != 0 {
+		if spv.params.ReduceMinDifficulty {
+			reductionTime := int64(spv.params.MinDiffReductionTime / time.Second)
+			if timestamp.Unix() > prev.Timestamp.Unix()+reductionTime {
+				return spv.params.PowLimitBits, nil
+			}
+			return spv.findPrevTestNetBits(chain, prev, height-1, blocksPerRetarget)
+		}
+		return prev.Bits, nil
+	}
+	if spv.noRetargeting() {
+		return prev.Bits, nil
+	}
+	first, err := chain.ancestor(height - blocksPerRetarget)
+	if err != nil {
+		return 0, err
+	}
+	if first == nil {
+		return 0, nil
+	}
+	minTimespan := int64(spv.params.TargetTimespan/time.Second) / spv.params.RetargetAdjustmentFactor
+	maxTimespan := int64(spv.params.TargetTimespan/time.Second) * spv.params.RetargetAdjustmentFactor
+	timespan := prev.Timestamp.Unix() - first.Timestamp.Unix()
+	if timespan < minTimespan {
+		timespan = minTimespan
+	} else if timespan > maxTimespan {
+		timespan = maxTimespan
+	}
+	target := blockchain.CompactToBig(prev.Bits)
+	target.Mul(target, big.NewInt(timespan))
+	target.Div(target, big.NewInt(int64(spv.params.TargetTimespan/time.Second)))
+	if target.Cmp(spv.params.PowLimit) > 0 {
+		target.Set(spv.params.PowLimit)
+	}
+	return blockchain.BigToCompact(target), nil
+}
+
+// findPrevTestNetBits returns the bits of the last header without the minimum difficulty rule
+// if the headers are before the first stored header, it returns 0
+func (spv *Spv) findPrevTestNetBits(chain *headerChain, header *wire.BlockHeader, height int, blocksPerRetarget int) (uint32, error) {
+	for header.Bits == spv.params.PowLimitBits && height%blocksPerRetarget != 0 {
+		height--
+		prev, err := chain.ancestor(height)
+		if err != nil {
+			return 0, err
+		}
+		if prev == nil {
+			return 0, nil
+		}
+		header = prev
+	}
+	return header.Bits, nil
+}
+
+// noRetargeting returns whether the network does not retarget the difficulty
+// chaincfg.Params does not have the flag, regtest is the only network (fPowNoRetargeting)
+func (spv *Spv) noRetargeting() bool {
+	return spv.params.Net == wire.TestNet
+}
+
+// calcMedianTime returns the median time of the last MedianTimeBlocks headers to the height
+// near the genesis, it is the median time of all headers to the height as bitcoin core does
+// if the headers are before the first stored header (near the checkpoint), it returns zero time
+func (spv *Spv) calcMedianTime(chain *headerChain, height int) (time.Time, error) {
+	var timestamps []int64
+	for i := 0; i < MedianTimeBlocks && height-i >= 0; i++ {
+		header, err := chain.ancestor(height - i)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if header == nil {
+			return time.Time{}, nil
+		}
+		timestamps = append(timestamps, header.Timestamp.Unix())
+	}
+	if len(timestamps) == 0 {
+		return time.Time{}, nil
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return time.Unix(timestamps[len(timestamps)/2], 0), nil
+}
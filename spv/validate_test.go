@@ -0,0 +1,241 @@
+// Package spv project validate_test.go
+package spv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// real headers of mainnet block 1, 2 and testnet3 block 1
+const (
+	mainNetHeader1  = "010000006fe28c0ab6f1b372c1a6a246ae63f74f931e8365e15a089c68d6190000000000982051fd1e4ba744bbbe680e1fee14677ba1a3c3540bf7b1cdb606e857233e0e61bc6649ffff001d01e36299"
+	mainNetHeader2  = "010000004860eb18bf1b1620e37e9490fc8a427514416fd75159ab86688e9a8300000000d5fdcc541e25de1c7a5addedf24858b8bb665c9f36ef744ee42c316022c90f9bb0bc6649ffff001d08d2bd61"
+	testNet3Header1 = "0100000043497fd7f826957108f4a30fd9cec3aeba79972084e90ead01ea330900000000bac8b0fa927c0ac8234287e33c5f74d38d354820e24756ad709d7038fc5f31f020e7494dffff001d03e4b672"
+)
+
+// parseHeader returns the header of the hex string
+func parseHeader(t *testing.T, s string) *wire.BlockHeader {
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("hex.DecodeString Error : %+v", err)
+	}
+	header := &wire.BlockHeader{}
+	err = header.Deserialize(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatalf("header.Deserialize Error : %+v", err)
+	}
+	return header
+}
+
+// mineHeader returns the regtest header which satisfies the proof of work
+func mineHeader(prev chainhash.Hash, timestamp time.Time) *wire.BlockHeader {
+	header := &wire.BlockHeader{}
+	header.Version = 1
+	header.PrevBlock = prev
+	header.Timestamp = timestamp
+	header.Bits = chaincfg.RegressionNetParams.PowLimitBits
+	spv := &Spv{}
+	spv.params = chaincfg.RegressionNetParams
+	for spv.checkProofOfWork(header) != nil {
+		header.Nonce++
+	}
+	return header
+}
+
+// putTestHeaders stores the headers from the height
+func putTestHeaders(t *testing.T, spv *Spv, headers []*wire.BlockHeader, height int) {
+	err := spv.data.PutHeaders(headers, height)
+	if err != nil {
+		t.Fatalf("spv.data.PutHeaders Error : %+v", err)
+	}
+}
+
+func TestValidateRealHeaders(t *testing.T) {
+	cases := []struct {
+		name    string
+		params  chaincfg.Params
+		headers []string
+		ok      bool
+	}{
+		{"mainnet", chaincfg.MainNetParams, []string{mainNetHeader1, mainNetHeader2}, true},
+		{"mainnet unconnected", chaincfg.MainNetParams, []string{mainNetHeader2}, false},
+		{"mainnet on testnet3", chaincfg.TestNet3Params, []string{mainNetHeader1}, false},
+		{"testnet3 min difficulty", chaincfg.TestNet3Params, []string{testNet3Header1}, true},
+	}
+	for _, c := range cases {
+		spv := newTestSpvParams(t, c.params, nil)
+		putTestHeaders(t, spv, []*wire.BlockHeader{&c.params.GenesisBlock.Header}, 0)
+		chain := newHeaderChain(spv.data)
+		var err error
+		for i, s := range c.headers {
+			header := parseHeader(t, s)
+			err = spv.validateHeader(chain, header, i+1)
+			if err != nil {
+				break
+			}
+			chain.add(header, i+1)
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("%s : unmatch result : %+v", c.name, err)
+		}
+	}
+}
+
+func TestValidateModifiedHeader(t *testing.T) {
+	spv := newTestSpvParams(t, chaincfg.MainNetParams, nil)
+	putTestHeaders(t, spv, []*wire.BlockHeader{&chaincfg.MainNetParams.GenesisBlock.Header}, 0)
+	header := parseHeader(t, mainNetHeader1)
+	header.Nonce++
+	err := spv.validateHeader(newHeaderChain(spv.data), header, 1)
+	if err == nil {
+		t.Fatalf("header without the proof of work is valid")
+	}
+}
+
+// the timestamps and the bits are of the mainnet blocks used by the pow tests of bitcoin core
+func TestCalcRequiredBitsMainNet(t *testing.T) {
+	cases := []struct {
+		height    int
+		firstTime int64
+		prevTime  int64
+		prevBits  uint32
+		want      uint32
+	}{
+		{32256, 1261130161, 1262152739, 0x1d00ffff, 0x1d00d86a},
+		{2016, 1231006505, 1233061996, 0x1d00ffff, 0x1d00ffff},
+		{68544, 1279008237, 1279297671, 0x1c05a3f4, 0x1c0168fd},
+		{46368, 1263163443, 1269211443, 0x1c387f6f, 0x1d00e1fd},
+		{32257, 1261130161, 1262152739, 0x1d00d86a, 0x1d00d86a},
+	}
+	spv := newTestSpvParams(t, chaincfg.MainNetParams, nil)
+	for _, c := range cases {
+		chain := newHeaderChain(spv.data)
+		first := &wire.BlockHeader{Timestamp: time.Unix(c.firstTime, 0), Bits: 0x1d00ffff}
+		prev := &wire.BlockHeader{Timestamp: time.Unix(c.prevTime, 0), Bits: c.prevBits}
+		chain.add(first, c.height/2016*2016-2016)
+		chain.add(prev, c.height-1)
+		bits, err := spv.calcRequiredBits(chain, prev, c.height, prev.Timestamp.Add(10*time.Minute))
+		if err != nil {
+			t.Fatalf("spv.calcRequiredBits Error : %d %+v", c.height, err)
+		}
+		if bits != c.want {
+			t.Errorf("unmatch bits : %d %08x %08x", c.height, bits, c.want)
+		}
+	}
+}
+
+func TestCalcRequiredBitsTestNet(t *testing.T) {
+	params := chaincfg.TestNet3Params
+	spv := newTestSpvParams(t, params, nil)
+	start := time.Unix(1600000000, 0)
+	// 2016 is the retarget height, and 2017 and 2018 are mined with the minimum difficulty
+	headers := []*wire.BlockHeader{
+		{Timestamp: start, Bits: 0x1c0fffff},
+		{Timestamp: start.Add(30 * time.Minute), Bits: params.PowLimitBits},
+		{Timestamp: start.Add(60 * time.Minute), Bits: params.PowLimitBits},
+	}
+	putTestHeaders(t, spv, headers, 2016)
+	prev := headers[2]
+	cases := []struct {
+		name  string
+		delta time.Duration
+		want  uint32
+	}{
+		{"after 20 minutes", 20*time.Minute + time.Second, params.PowLimitBits},
+		{"just 20 minutes", 20 * time.Minute, 0x1c0fffff},
+		{"within 20 minutes", time.Minute, 0x1c0fffff},
+	}
+	for _, c := range cases {
+		bits, err := spv.calcRequiredBits(newHeaderChain(spv.data), prev, 2019, prev.Timestamp.Add(c.delta))
+		if err != nil {
+			t.Fatalf("%s : spv.calcRequiredBits Error : %+v", c.name, err)
+		}
+		if bits != c.want {
+			t.Errorf("%s : unmatch bits : %08x %08x", c.name, bits, c.want)
+		}
+	}
+	// the stored headers start from 2017, so the last bits before the minimum difficulty are unknown
+	spv = newTestSpvParams(t, params, nil)
+	putTestHeaders(t, spv, headers[1:], 2017)
+	bits, err := spv.calcRequiredBits(newHeaderChain(spv.data), prev, 2019, prev.Timestamp.Add(time.Minute))
+	if err != nil || bits != 0 {
+		t.Fatalf("check before the first stored header is not skipped : %08x %+v", bits, err)
+	}
+}
+
+func TestMissingAncestor(t *testing.T) {
+	spv := newTestSpvParams(t, chaincfg.MainNetParams, nil)
+	putTestHeaders(t, spv, []*wire.BlockHeader{&chaincfg.MainNetParams.GenesisBlock.Header}, 0)
+	prev := &wire.BlockHeader{Timestamp: time.Unix(1262152739, 0), Bits: 0x1d00ffff}
+	chain := newHeaderChain(spv.data)
+	chain.add(prev, 4031)
+	_, err := spv.calcRequiredBits(chain, prev, 4032, prev.Timestamp)
+	if err == nil {
+		t.Fatalf("missing retarget header is not an error")
+	}
+	_, err = spv.calcMedianTime(chain, 4031)
+	if err == nil {
+		t.Fatalf("missing median time header is not an error")
+	}
+	// the stored headers start from the checkpoint, and the headers before it are not needed
+	spv = newTestSpvParams(t, chaincfg.MainNetParams, nil)
+	putTestHeaders(t, spv, []*wire.BlockHeader{prev}, 4031)
+	chain = newHeaderChain(spv.data)
+	bits, err := spv.calcRequiredBits(chain, prev, 4032, prev.Timestamp)
+	if err != nil || bits != 0 {
+		t.Fatalf("retarget before the first stored header is not skipped : %08x %+v", bits, err)
+	}
+	mtp, err := spv.calcMedianTime(chain, 4031)
+	if err != nil || !mtp.IsZero() {
+		t.Fatalf("median time before the first stored header is not skipped : %v %+v", mtp, err)
+	}
+}
+
+func TestMedianTimePast(t *testing.T) {
+	spv := newTestSpv(t, nil)
+	genesis := chaincfg.RegressionNetParams.GenesisBlock.Header
+	headers := []*wire.BlockHeader{&genesis}
+	// the timestamps are not ordered, the median of the last 11 headers is the 6th
+	offsets := []int{0, 50, 10, 40, 20, 30, 90, 60, 100, 80, 70, 110}
+	base := genesis.Timestamp
+	for _, offset := range offsets[1:] {
+		prev := headers[len(headers)-1].BlockHash()
+		headers = append(headers, mineHeader(prev, base.Add(time.Duration(offset)*time.Minute)))
+	}
+	putTestHeaders(t, spv, headers, 0)
+	tip := len(headers) - 1
+	chain := newHeaderChain(spv.data)
+	mtp, err := spv.calcMedianTime(chain, tip)
+	if err != nil || !mtp.Equal(base.Add(60*time.Minute)) {
+		t.Fatalf("unmatch median time : %v %+v", mtp, err)
+	}
+	// near the genesis, the median of all headers is used
+	mtp, err = spv.calcMedianTime(chain, 2)
+	if err != nil || !mtp.Equal(base.Add(10*time.Minute)) {
+		t.Fatalf("unmatch median time near the genesis : %v %+v", mtp, err)
+	}
+	now := time.Unix(time.Now().Unix(), 0)
+	cases := []struct {
+		name      string
+		timestamp time.Time
+		ok        bool
+	}{
+		{"median time past", base.Add(60 * time.Minute), false},
+		{"after median time past", base.Add(61 * time.Minute), true},
+		{"within 2 hours", now.Add(MaxTimeOffsetSeconds*time.Second - time.Minute), true},
+		{"over 2 hours", now.Add(MaxTimeOffsetSeconds*time.Second + time.Minute), false},
+	}
+	for _, c := range cases {
+		header := mineHeader(headers[tip].BlockHash(), c.timestamp)
+		err := spv.validateHeader(newHeaderChain(spv.data), header, tip+1)
+		if (err == nil) != c.ok {
+			t.Errorf("%s : unmatch result : %+v", c.name, err)
+		}
+	}
+}
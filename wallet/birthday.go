@@ -0,0 +1,76 @@
+// wallet project birthday.go
+package wallet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tnakagawa/sbc/spv"
+)
+
+// BirthdayFileName is the file name of the birthday in the wallet directory
+const BirthdayFileName = "birthday.json"
+
+// birthdayFile is the stored birthday type
+type birthdayFile struct {
+	Time   int64 `json:"time"`
+	Height int   `json:"height"`
+}
+
+// LoadBirthday loads the birthday stored in the wallet directory
+// if it is not stored yet, birthday is stored as the birthday of the wallet unless it is zero
+func (wallet *Wallet) LoadBirthday(dir string, birthday spv.Birthday) error {
+	path := filepath.Join(dir, BirthdayFileName)
+	bs, err := ioutil.ReadFile(path)
+	if err == nil {
+		file := &birthdayFile{}
+		err = json.Unmarshal(bs, file)
+		if err != nil {
+			log.Printf("json.Unmarshal error : %v", err)
+			return err
+		}
+		wallet.birthday.Height = file.Height
+		if file.Time > 0 {
+			wallet.birthday.Time = time.Unix(file.Time, 0)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		log.Printf("ioutil.ReadFile error : %v", err)
+		return err
+	}
+	if birthday.IsZero() {
+		return nil
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		log.Printf("os.MkdirAll error : %v", err)
+		return err
+	}
+	file := &birthdayFile{}
+	file.Height = birthday.Height
+	if !birthday.Time.IsZero() {
+		file.Time = birthday.Time.Unix()
+	}
+	bs, err = json.Marshal(file)
+	if err != nil {
+		log.Printf("json.Marshal error : %v", err)
+		return err
+	}
+	err = ioutil.WriteFile(path, bs, 0600)
+	if err != nil {
+		log.Printf("ioutil.WriteFile error : %v", err)
+		return err
+	}
+	wallet.birthday = birthday
+	return nil
+}
+
+// Birthday returns the birthday of the wallet
+func (wallet *Wallet) Birthday() spv.Birthday {
+	return wallet.birthday
+}
@@ -0,0 +1,82 @@
+// wallet project birthday_test.go
+package wallet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tnakagawa/sbc/spv"
+)
+
+func TestLoadBirthday(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wallet")
+	birthday := spv.Birthday{Time: time.Unix(1577836800, 0), Height: 100}
+	// the zero birthday is not stored
+	wallet := &Wallet{}
+	err := wallet.LoadBirthday(dir, spv.Birthday{})
+	if err != nil {
+		t.Fatalf("wallet.LoadBirthday Error : %+v", err)
+	}
+	if !wallet.Birthday().IsZero() {
+		t.Fatalf("birthday is set : %+v", wallet.Birthday())
+	}
+	if _, err := os.Stat(filepath.Join(dir, BirthdayFileName)); !os.IsNotExist(err) {
+		t.Fatalf("zero birthday is stored : %+v", err)
+	}
+	// the first birthday is stored
+	wallet = &Wallet{}
+	err = wallet.LoadBirthday(dir, birthday)
+	if err != nil {
+		t.Fatalf("wallet.LoadBirthday Error : %+v", err)
+	}
+	if !wallet.Birthday().Time.Equal(birthday.Time) || wallet.Birthday().Height != birthday.Height {
+		t.Fatalf("unmatch birthday : %+v", wallet.Birthday())
+	}
+	// the stored birthday is loaded, and the other birthday is ignored
+	for _, other := range []spv.Birthday{{}, {Time: time.Unix(1600000000, 0)}, {Height: 200}} {
+		wallet = &Wallet{}
+		err = wallet.LoadBirthday(dir, other)
+		if err != nil {
+			t.Fatalf("wallet.LoadBirthday Error : %+v", err)
+		}
+		if !wallet.Birthday().Time.Equal(birthday.Time) || wallet.Birthday().Height != birthday.Height {
+			t.Fatalf("stored birthday is not loaded : %+v %+v", wallet.Birthday(), other)
+		}
+	}
+}
+
+func TestLoadBirthdayHeight(t *testing.T) {
+	dir := t.TempDir()
+	wallet := &Wallet{}
+	err := wallet.LoadBirthday(dir, spv.Birthday{Height: 100})
+	if err != nil {
+		t.Fatalf("wallet.LoadBirthday Error : %+v", err)
+	}
+	wallet = &Wallet{}
+	err = wallet.LoadBirthday(dir, spv.Birthday{})
+	if err != nil {
+		t.Fatalf("wallet.LoadBirthday Error : %+v", err)
+	}
+	if !wallet.Birthday().Time.IsZero() || wallet.Birthday().Height != 100 {
+		t.Fatalf("unmatch birthday : %+v", wallet.Birthday())
+	}
+}
+
+func TestLoadBirthdayInvalid(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, BirthdayFileName), []byte("{"), 0600)
+	if err != nil {
+		t.Fatalf("ioutil.WriteFile Error : %+v", err)
+	}
+	wallet := &Wallet{}
+	err = wallet.LoadBirthday(dir, spv.Birthday{Height: 100})
+	if err == nil {
+		t.Fatalf("invalid birthday file is loaded")
+	}
+	if !wallet.Birthday().IsZero() {
+		t.Fatalf("birthday is set : %+v", wallet.Birthday())
+	}
+}
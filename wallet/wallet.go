@@ -6,29 +6,33 @@ import (
 	"math/rand"
 	"time"
 
-	"github.com/adiabat/btcutil"
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
 	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/tnakagawa/sbc/spv"
 )
 
 // Wallet is wallet type
 type Wallet struct {
-	extKey *hdkeychain.ExtendedKey
-	utxom  map[wire.OutPoint]*Utxo
-	pkhs   []*Pkh
+	extKey   *hdkeychain.ExtendedKey
+	utxom    map[wire.OutPoint]*Utxo
+	pkhs     []*Pkh
+	birthday spv.Birthday
 }
 
 // Utxo is utxo type
 type Utxo struct {
-	height   int
-	outpoint *wire.OutPoint
-	value    int64
-	path     int
-	kind     int
-	status   int
+	height      int
+	outpoint    *wire.OutPoint
+	value       int64
+	path        int
+	kind        int
+	status      int
+	spentTxid   *chainhash.Hash
+	spentHeight int
 }
 
 // Pkh is pulickey hash type
@@ -132,6 +136,52 @@ func (wallet *Wallet) CheckTxIn(txin *wire.TxIn) {
 	}
 }
 
+// CheckTx check transaction
+// it records the transaction and the height which spend utxos, and checks txouts
+func (wallet *Wallet) CheckTx(info *spv.TxInfo) {
+	for _, txin := range info.Tx.TxIn {
+		utxo, ok := wallet.utxom[txin.PreviousOutPoint]
+		if !ok {
+			continue
+		}
+		if utxo.status == WalletUtxoStatusUsed && (utxo.spentHeight >= 0 || info.Height < 0) {
+			continue
+		}
+		txid := info.Hash
+		utxo.status = WalletUtxoStatusUsed
+		utxo.spentTxid = &txid
+		utxo.spentHeight = info.Height
+		log.Printf("CheckTx spent %v by %v at %d", utxo.outpoint, txid, info.Height)
+	}
+	for idx, txout := range info.Tx.TxOut {
+		wallet.CheckTxOut(info.Height, info.Hash, idx, txout)
+	}
+}
+
+// BlockDisconnected unwinds the transactions in the disconnected block by txid
+// utxos spent by them are restored, and utxos created by them are marked as forked
+// utxos spent at the height are also restored, because the transactions of an old block are not kept
+func (wallet *Wallet) BlockDisconnected(header *wire.BlockHeader, height int, txs []*spv.TxInfo) {
+	txids := make(map[chainhash.Hash]bool)
+	for _, info := range txs {
+		txids[info.Hash] = true
+	}
+	for outpoint, utxo := range wallet.utxom {
+		if txids[outpoint.Hash] && utxo.height == height {
+			utxo.status = WalletUtxoStatusFork
+			continue
+		}
+		if utxo.status != WalletUtxoStatusUsed {
+			continue
+		}
+		if (utxo.spentTxid != nil && txids[*utxo.spentTxid]) || utxo.spentHeight == height {
+			utxo.status = WalletUtxoStatusCanUse
+			utxo.spentTxid = nil
+			utxo.spentHeight = -1
+		}
+	}
+}
+
 // CheckTxOut check txout
 func (wallet *Wallet) CheckTxOut(height int, txid chainhash.Hash, index int, txout *wire.TxOut) {
 	exist := false
@@ -170,11 +220,18 @@ func (wallet *Wallet) CheckTxOut(height int, txid chainhash.Hash, index int, txo
 		return
 	}
 	outpoint := wire.NewOutPoint(&txid, uint32(index))
-	_, ok := wallet.utxom[*outpoint]
+	utxo, ok := wallet.utxom[*outpoint]
 	if ok {
+		if utxo.status == WalletUtxoStatusFork {
+			utxo.height = height
+			utxo.status = WalletUtxoStatusCanUse
+		}
+		if utxo.height < 0 && height >= 0 {
+			utxo.height = height
+		}
 		return
 	}
-	utxo := &Utxo{}
+	utxo = &Utxo{}
 	utxo.height = height
 	utxo.outpoint = outpoint
 	utxo.value = txout.Value
@@ -184,6 +241,66 @@ func (wallet *Wallet) CheckTxOut(height int, txid chainhash.Hash, index int, txo
 	wallet.utxom[*outpoint] = utxo
 }
 
+// PkScripts returns P2PKH and P2WPKH scripts to match with compact filters
+func (wallet *Wallet) PkScripts() [][]byte {
+	var scripts [][]byte
+	for _, pkh := range wallet.pkhs {
+		p2pkh := []byte{0x76, 0xa9, 0x14}
+		p2pkh = append(p2pkh, pkh.hash...)
+		p2pkh = append(p2pkh, 0x88, 0xac)
+		p2wpkh := []byte{0x00, 0x14}
+		p2wpkh = append(p2wpkh, pkh.hash...)
+		scripts = append(scripts, p2pkh, p2wpkh)
+	}
+	return scripts
+}
+
+// OutPoints returns outpoints of unspent utxos to build the filter
+func (wallet *Wallet) OutPoints() []*wire.OutPoint {
+	var outpoints []*wire.OutPoint
+	for _, utxo := range wallet.utxom {
+		if utxo.status == WalletUtxoStatusUsed {
+			continue
+		}
+		outpoints = append(outpoints, utxo.outpoint)
+	}
+	return outpoints
+}
+
+// TxFilter returns the filter of the scripts and the unspent utxos to register CheckTx
+func (wallet *Wallet) TxFilter() *spv.TxFilter {
+	filter := &spv.TxFilter{}
+	filter.PkScripts = wallet.PkScripts()
+	filter.OutPoints = wallet.OutPoints()
+	return filter
+}
+
+// NotifyFork marks utxos above the fork height as forked
+// they are restored when the blocks of the new branch are rescanned
+func (wallet *Wallet) NotifyFork(forkHeight int, tipHeight int) {
+	log.Printf("NotifyFork fork %d tip %d", forkHeight, tipHeight)
+	for _, utxo := range wallet.utxom {
+		if utxo.height > forkHeight {
+			utxo.status = WalletUtxoStatusFork
+		}
+	}
+}
+
+// RemoveTx removes unconfirmed utxos of the evicted transaction
+// and restores utxos spent by it
+func (wallet *Wallet) RemoveTx(txid chainhash.Hash) {
+	for outpoint, utxo := range wallet.utxom {
+		if utxo.height < 0 && outpoint.Hash.IsEqual(&txid) {
+			delete(wallet.utxom, outpoint)
+			continue
+		}
+		if utxo.spentHeight < 0 && utxo.spentTxid != nil && utxo.spentTxid.IsEqual(&txid) {
+			utxo.status = WalletUtxoStatusCanUse
+			utxo.spentTxid = nil
+		}
+	}
+}
+
 func (wallet *Wallet) beq(bs1, bs2 []byte) bool {
 	result := false
 	if len(bs1) == len(bs2) {
@@ -217,7 +334,8 @@ func (wallet *Wallet) getKeyPair(extKey *hdkeychain.ExtendedKey, path ...int) (*
 	key = extKey
 	var err error
 	for _, i := range path {
-		key, err = key.Child(uint32(i))
+		// DeriveNonStandard is Child of btcutil v1.0.2, so the keys of the existing wallets are not changed
+		key, err = key.DeriveNonStandard(uint32(i))
 		if err != nil {
 			return nil, nil, err
 		}